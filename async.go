@@ -0,0 +1,52 @@
+package spf
+
+import (
+	"context"
+	"net"
+)
+
+// CheckResult is the outcome of an SPF check, as delivered by
+// CheckHostAsync.
+//
+// This is EXPERIMENTAL for now, and the fields are subject to change.
+type CheckResult struct {
+	Result Result
+	Err    error
+}
+
+// CheckHostAsync starts the evaluation of the SPF records for `domain` in
+// the background, like CheckHost does, and returns a channel on which the
+// result is delivered when ready. The channel receives exactly one value,
+// and then it is closed.
+//
+// The evaluation uses the given context (it overrides the one given with
+// WithContext, if any). If it is done before the evaluation completes, the
+// evaluation is stopped, and the result is TempError with the context's
+// error.
+//
+// The channel is buffered, so it is fine to not receive from it (for
+// example, if the caller gave up): the evaluation will still finish and
+// release its resources.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CheckHostAsync(ctx context.Context, ip net.IP, domain string, opts ...Option) <-chan CheckResult {
+	c := make(chan CheckResult, 1)
+
+	// Copy the options, so appending doesn't modify the caller's slice.
+	opts = append(opts[:len(opts):len(opts)], WithContext(ctx))
+
+	go func() {
+		defer close(c)
+		trace("check host async %q %q", ip, domain)
+		r := newResolution(ip, "@"+domain, opts)
+		res, err := r.checkTopLevel(domain)
+		if ctx.Err() != nil {
+			// Queries may have failed because of the context, so the
+			// result can't be trusted.
+			res, err = TempError, ctx.Err()
+		}
+		c <- CheckResult{res, err}
+	}()
+
+	return c
+}
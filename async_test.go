@@ -0,0 +1,70 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCheckHostAsync(t *testing.T) {
+	trace = t.Logf
+	dns := NewResolver()
+	dns.txt["domain"] = []string{"v=spf1 a:host1 a:host2 a:host3 -all"}
+	dns.ip["host3"] = []net.IP{ip1111}
+
+	before := runtime.NumGoroutine()
+
+	// Delivery.
+	c := CheckHostAsync(context.Background(), ip1111, "domain",
+		WithResolver(dns))
+	cr := <-c
+	if cr.Result != Pass || cr.Err != errMatchedA {
+		t.Errorf("expected pass, got %v (%v)", cr.Result, cr.Err)
+	}
+	if _, ok := <-c; ok {
+		t.Errorf("channel not closed after the result")
+	}
+
+	// The given context overrides the one from the options.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cr = <-CheckHostAsync(ctx, ip1111, "domain",
+		WithResolver(dns), WithContext(context.Background()))
+	if cr.Result != TempError || cr.Err != context.Canceled {
+		t.Errorf("expected temperror, got %v (%v)", cr.Result, cr.Err)
+	}
+
+	// Cancellation while the evaluation is in progress stops it.
+	dns.delay = 50 * time.Millisecond
+	dns.lookups = map[string]int{}
+	ctx, cancel = context.WithCancel(context.Background())
+	c = CheckHostAsync(ctx, ip1111, "domain", WithResolver(dns))
+	time.Sleep(75 * time.Millisecond)
+	cancel()
+	cr = <-c
+	if cr.Result != TempError || cr.Err != context.Canceled {
+		t.Errorf("expected temperror, got %v (%v)", cr.Result, cr.Err)
+	}
+	if n := dns.lookups["ip"]; n > 1 {
+		t.Errorf("evaluation was not stopped, %d ip lookups", n)
+	}
+
+	// Abandoned checks still finish. They use their own resolvers, since
+	// they run concurrently.
+	for i := 0; i < 10; i++ {
+		r := NewResolver()
+		r.txt["domain"] = []string{"v=spf1 a:host -all"}
+		CheckHostAsync(context.Background(), ip1111, "domain",
+			WithResolver(r))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("goroutines leaked: %d before, %d after", before, n)
+	}
+}
@@ -0,0 +1,158 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// cachingResolver wraps a DNSResolver, and remembers its answers, so
+// repeated queries for the same name are only resolved once.
+//
+// Errors are not remembered, so a query that failed (for example, because
+// of a timeout or a cancelled context) is done again the next time.
+//
+// There is no expiration: it is intended to be used for a short and bounded
+// period of time, like a batch of checks, or by a PreparedPolicy.
+type cachingResolver struct {
+	resolver DNSResolver
+
+	mu   sync.Mutex
+	txt  map[string]txtAnswer
+	mx   map[string]mxAnswer
+	ip   map[string]ipAnswer
+	addr map[string]txtAnswer
+
+	// Answers of LookupIP, by network and host (see
+	// cachingFamilyResolver).
+	ipf map[string]ipfAnswer
+}
+
+type txtAnswer struct {
+	txts []string
+	err  error
+}
+
+type mxAnswer struct {
+	mxs []*net.MX
+	err error
+}
+
+type ipAnswer struct {
+	ips []net.IPAddr
+	err error
+}
+
+type ipfAnswer struct {
+	ips []net.IP
+	err error
+}
+
+// cachingFamilyResolver is a cachingResolver for resolvers which can look
+// up addresses of a single family (see familyResolver).
+type cachingFamilyResolver struct {
+	*cachingResolver
+}
+
+// newCachingResolver returns a resolver that wraps the given one, to cache
+// its answers. It implements familyResolver if the given one does.
+func newCachingResolver(resolver DNSResolver) DNSResolver {
+	c := &cachingResolver{
+		resolver: resolver,
+		txt:      map[string]txtAnswer{},
+		mx:       map[string]mxAnswer{},
+		ip:       map[string]ipAnswer{},
+		addr:     map[string]txtAnswer{},
+		ipf:      map[string]ipfAnswer{},
+	}
+	if _, ok := resolver.(familyResolver); ok {
+		return cachingFamilyResolver{c}
+	}
+	return c
+}
+
+func (c *cachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	c.mu.Lock()
+	a, ok := c.txt[name]
+	c.mu.Unlock()
+	if ok {
+		return a.txts, a.err
+	}
+
+	a.txts, a.err = c.resolver.LookupTXT(ctx, name)
+	if a.err == nil {
+		c.mu.Lock()
+		c.txt[name] = a
+		c.mu.Unlock()
+	}
+	return a.txts, a.err
+}
+
+func (c *cachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	c.mu.Lock()
+	a, ok := c.mx[name]
+	c.mu.Unlock()
+	if ok {
+		return a.mxs, a.err
+	}
+
+	a.mxs, a.err = c.resolver.LookupMX(ctx, name)
+	if a.err == nil {
+		c.mu.Lock()
+		c.mx[name] = a
+		c.mu.Unlock()
+	}
+	return a.mxs, a.err
+}
+
+func (c *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	c.mu.Lock()
+	a, ok := c.ip[host]
+	c.mu.Unlock()
+	if ok {
+		return a.ips, a.err
+	}
+
+	a.ips, a.err = c.resolver.LookupIPAddr(ctx, host)
+	if a.err == nil {
+		c.mu.Lock()
+		c.ip[host] = a
+		c.mu.Unlock()
+	}
+	return a.ips, a.err
+}
+
+func (c *cachingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	c.mu.Lock()
+	a, ok := c.addr[addr]
+	c.mu.Unlock()
+	if ok {
+		return a.txts, a.err
+	}
+
+	a.txts, a.err = c.resolver.LookupAddr(ctx, addr)
+	if a.err == nil {
+		c.mu.Lock()
+		c.addr[addr] = a
+		c.mu.Unlock()
+	}
+	return a.txts, a.err
+}
+
+func (c cachingFamilyResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	key := network + " " + host
+	c.mu.Lock()
+	a, ok := c.ipf[key]
+	c.mu.Unlock()
+	if ok {
+		return a.ips, a.err
+	}
+
+	a.ips, a.err = c.resolver.(familyResolver).LookupIP(ctx, network, host)
+	if a.err == nil {
+		c.mu.Lock()
+		c.ipf[key] = a
+		c.mu.Unlock()
+	}
+	return a.ips, a.err
+}
@@ -0,0 +1,153 @@
+package spf
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// CoalesceIPs returns a copy of the record where the ip4 and ip6 mechanisms
+// are coalesced into a minimal set: ranges contained in others are removed,
+// and adjacent ranges are merged. It also returns a human-readable report
+// of the changes that were made. No DNS queries are done.
+//
+// Only consecutive mechanisms with the same qualifier are coalesced
+// together, and the resulting ones are placed where they were, so the
+// evaluation result doesn't change. Mechanisms after "all" are never
+// evaluated, and are left as they are.
+//
+// This is useful to shrink large (for example, flattened) records.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CoalesceIPs(rec *Record) (*Record, []string) {
+	report := []string{}
+	isIP := func(m Mechanism) bool {
+		return m.Name == "ip4" || m.Name == "ip6"
+	}
+
+	out := &Record{Modifiers: rec.Modifiers}
+	afterAll := false
+	for i := 0; i < len(rec.Mechanisms); {
+		m := rec.Mechanisms[i]
+		if afterAll || !isIP(m) {
+			out.Mechanisms = append(out.Mechanisms, m)
+			afterAll = afterAll || m.Name == "all"
+			i++
+			continue
+		}
+
+		// The run of ip mechanisms with the same qualifier starting here.
+		nets := []*net.IPNet{}
+		for ; i < len(rec.Mechanisms); i++ {
+			n := rec.Mechanisms[i]
+			if !isIP(n) || n.Qualifier != m.Qualifier {
+				break
+			}
+			nets = append(nets, n.ipNet())
+		}
+		for _, n := range coalesceNets(nets, &report) {
+			out.Mechanisms = append(out.Mechanisms,
+				netMechanism(m.Qualifier, n))
+		}
+	}
+
+	return out, report
+}
+
+// coalesceNets returns the minimal set of networks covering the same
+// addresses as the given ones, sorted. The changes are added to the report.
+func coalesceNets(nets []*net.IPNet, report *[]string) []*net.IPNet {
+	nets = append([]*net.IPNet{}, nets...)
+	for changed := true; changed; {
+		changed = false
+		sortNets(nets)
+
+		for i := 0; i < len(nets)-1; i++ {
+			a, b := nets[i], nets[i+1]
+			if len(a.IP) != len(b.IP) {
+				continue
+			}
+
+			var merged *net.IPNet
+			if netContains(a, b) {
+				*report = append(*report, fmt.Sprintf(
+					"%v is redundant, contained in %v", b, a))
+				merged = a
+			} else if s := siblingSupernet(a, b); s != nil {
+				*report = append(*report, fmt.Sprintf(
+					"%v and %v merged into %v", a, b, s))
+				merged = s
+			} else {
+				continue
+			}
+
+			nets[i] = merged
+			nets = append(nets[:i+1], nets[i+2:]...)
+			changed = true
+			i--
+		}
+	}
+	return nets
+}
+
+// sortNets sorts the networks by family, address, and then prefix length
+// (larger networks first).
+func sortNets(nets []*net.IPNet) {
+	sort.Slice(nets, func(i, j int) bool {
+		a, b := nets[i], nets[j]
+		if len(a.IP) != len(b.IP) {
+			return len(a.IP) < len(b.IP)
+		}
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		aones, _ := a.Mask.Size()
+		bones, _ := b.Mask.Size()
+		return aones < bones
+	})
+}
+
+// netContains returns true if b is fully contained in a. Both must be of the
+// same family.
+func netContains(a, b *net.IPNet) bool {
+	aones, _ := a.Mask.Size()
+	bones, _ := b.Mask.Size()
+	return aones <= bones && a.Contains(b.IP)
+}
+
+// siblingSupernet returns the network that contains exactly a and b, if they
+// are adjacent halves of it; otherwise it returns nil.
+func siblingSupernet(a, b *net.IPNet) *net.IPNet {
+	aones, bits := a.Mask.Size()
+	bones, _ := b.Mask.Size()
+	if aones != bones || aones == 0 {
+		return nil
+	}
+
+	mask := net.CIDRMask(aones-1, bits)
+	s := &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}
+	if !s.IP.Equal(a.IP) || !s.Contains(b.IP) {
+		return nil
+	}
+	return s
+}
+
+// netMechanism returns an ip4 or ip6 mechanism for the given network.
+func netMechanism(qualifier Result, n *net.IPNet) Mechanism {
+	ones, bits := n.Mask.Size()
+	m := Mechanism{Qualifier: qualifier, Value: n.IP.String(),
+		Mask4: -1, Mask6: -1}
+	if bits == 32 {
+		m.Name = "ip4"
+		if ones != 32 {
+			m.Mask4 = ones
+		}
+	} else {
+		m.Name = "ip6"
+		if ones != 128 {
+			m.Mask6 = ones
+		}
+	}
+	return m
+}
@@ -0,0 +1,92 @@
+package spf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCoalesceIPs(t *testing.T) {
+	cases := []struct {
+		in, out string
+		nreport int
+	}{
+		{"v=spf1 ip4:192.0.2.0/25 ip4:192.0.2.128/25 -all",
+			"v=spf1 ip4:192.0.2.0/24 -all", 1},
+
+		// Contained ranges are removed, in any order.
+		{"v=spf1 ip4:192.0.2.10 ip4:192.0.2.0/24 ip4:192.0.2.7/30",
+			"v=spf1 ip4:192.0.2.0/24", 2},
+
+		// Merges cascade, and non-aligned neighbours are not merged.
+		{"v=spf1 ip4:10.0.0.0/26 ip4:10.0.0.64/26 ip4:10.0.0.128/25 " +
+			"ip4:10.0.1.0/24 ip4:10.0.3.0/24",
+			"v=spf1 ip4:10.0.0.0/23 ip4:10.0.3.0/24", 3},
+
+		// Individual addresses.
+		{"v=spf1 ip4:1.1.1.0 ip4:1.1.1.1 ip4:1.1.1.1",
+			"v=spf1 ip4:1.1.1.0/31", 2},
+
+		// IPv6, mixed with IPv4.
+		{"v=spf1 ip6:2001:db8::/33 ip4:1.1.1.1 ip6:2001:db8:8000::/33",
+			"v=spf1 ip4:1.1.1.1 ip6:2001:db8::/32", 1},
+
+		// Only consecutive ranges with the same qualifier are merged, so
+		// ranges are never moved past other mechanisms. Modifiers are left
+		// alone.
+		{"v=spf1 a ip4:192.0.2.0/25 -ip4:192.0.2.128/25 mx " +
+			"ip4:192.0.2.128/25 ip4:192.0.2.0/25 redirect=domain",
+			"v=spf1 a ip4:192.0.2.0/25 -ip4:192.0.2.128/25 mx " +
+				"ip4:192.0.2.0/24 redirect=domain", 1},
+		{"v=spf1 ip4:1.1.1.1 -a ip4:2.2.2.2 -all",
+			"v=spf1 ip4:1.1.1.1 -a ip4:2.2.2.2 -all", 0},
+
+		// Mechanisms after "all" are left as they are.
+		{"v=spf1 ip4:1.1.1.1 -all ip4:2.2.2.2",
+			"v=spf1 ip4:1.1.1.1 -all ip4:2.2.2.2", 0},
+		{"v=spf1 -all ip4:1.1.1.0 ip4:1.1.1.1",
+			"v=spf1 -all ip4:1.1.1.0 ip4:1.1.1.1", 0},
+
+		// Nothing to do.
+		{"v=spf1 ip4:192.0.2.0/25 ip4:192.0.3.0/25 include:domain -all",
+			"v=spf1 ip4:192.0.2.0/25 ip4:192.0.3.0/25 include:domain -all", 0},
+	}
+
+	for _, c := range cases {
+		rec, err := Parse(c.in)
+		if err != nil {
+			t.Fatalf("%q: parse error: %v", c.in, err)
+		}
+
+		out, report := CoalesceIPs(rec)
+		if out.String() != c.out || len(report) != c.nreport {
+			t.Errorf("%q: expected %q (%d changes), got %q %q",
+				c.in, c.out, c.nreport, out.String(), report)
+		}
+
+		// The results must not change.
+		for _, s := range []string{"1.1.1.1", "2.2.2.2", "192.0.2.130",
+			"10.0.0.65", "2001:db8::1"} {
+			ip := net.ParseIP(s)
+			before, ok1 := EvaluateStatic(ip, c.in)
+			after, ok2 := EvaluateStatic(ip, out.String())
+			if before != after || ok1 != ok2 {
+				t.Errorf("%q: %s: result changed from %v/%v to %v/%v",
+					c.in, s, before, ok1, after, ok2)
+			}
+		}
+	}
+}
+
+func TestCoalesceReport(t *testing.T) {
+	rec, _ := Parse("v=spf1 ip4:192.0.2.0/25 ip4:192.0.2.128/25 " +
+		"ip4:192.0.2.5")
+	_, report := CoalesceIPs(rec)
+	expected := []string{
+		"192.0.2.5/32 is redundant, contained in 192.0.2.0/25",
+		"192.0.2.0/25 and 192.0.2.128/25 merged into 192.0.2.0/24",
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %q, got %q", expected, report)
+	}
+}
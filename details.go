@@ -0,0 +1,275 @@
+package spf
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Details contains additional information about the evaluation of an SPF
+// check, beyond the result. See CheckHostDetailed.
+//
+// This is EXPERIMENTAL for now, and the fields are subject to change.
+type Details struct {
+	// Qualifier of the "all" mechanism in the domain's policy record,
+	// expressed as the result it produces (for example, Fail for "-all").
+	// It is empty if the record has no "all" mechanism.
+	//
+	// The policy record is the top-level one, or the target of its
+	// redirect; "all" mechanisms within includes are not considered.
+	AllQualifier Result
+
+	// The domain that was authenticated by the check: the sender's domain,
+	// or the HELO domain if the sender had none. It is only set when the
+	// result is Pass (as given by the records, not by local policy
+	// overrides like WithTrustedNetworks). This is useful for DMARC
+	// alignment checks.
+	Identity string
+
+	// Whether the ip is explicitly authorized by the records: the result is
+	// Pass because a mechanism other than "all" matched (directly, or
+	// within an include or redirect). It is false if the result comes from
+	// a "+all", which matches any ip, or is not Pass. This tells apart an ip
+	// that is listed from one that falls into the default.
+	Authorized bool
+
+	// The term that ended the evaluation of the policy record, as written
+	// in it (for example "~all", or "include:_spf.example.com"), and the
+	// domain whose record it is in. The term can be a mechanism that
+	// matched, or one that resulted in an error. With a redirect, it is the
+	// term from the target's record.
+	//
+	// If the evaluation got to the end of the policy record without any
+	// term matching, FellThrough is set, Terminal is empty, and the result
+	// is Neutral. This tells it apart from an explicit "?all".
+	Terminal       string
+	TerminalDomain string
+	FellThrough    bool
+
+	// Number of TXT records found for the domain, of any kind. When the
+	// domain has no SPF record, this tells apart a domain without any TXT
+	// records (0) from one that has some, but none of them for SPF.
+	TXTRecords int
+
+	// The SPF record that was evaluated for the domain, empty if none was
+	// found.
+	Record string
+
+	// The domain the policy was taken from, when the record for the domain
+	// delegates it with a "redirect" modifier, and the result was decided
+	// by the target's record. With chained redirects, it is the last one.
+	// Empty if the result came directly from the domain's record.
+	RedirectTarget string
+
+	// Size of the record in bytes, and the number of character-strings it
+	// is made of, to help spot records that are approaching the DNS
+	// response size limits. Resolvers (including the standard one) join
+	// the character-strings of the TXT record, so the number is the minimum
+	// needed for the record: each can be at most 255 bytes long.
+	// https://tools.ietf.org/html/rfc7208#section-3.3
+	RecordBytes   int
+	RecordStrings int
+
+	// The SPF records evaluated during the check, indexed by domain. This
+	// includes the top-level one, and the ones from include and redirect.
+	Records map[string]string
+
+	// The SPF records found for domains that publish more than one, indexed
+	// by domain. This is a misconfiguration which results in PermError;
+	// each of the records can be evaluated individually with CheckRecord to
+	// diagnose it.
+	ConflictingRecords map[string][]string
+
+	// Explanation given by the domain for a Fail result, via the "exp"
+	// modifier, with its macros expanded. Empty if there is none, or it
+	// could not be obtained.
+	Explanation string
+
+	// Names returned by the reverse lookup of the ip, if it was needed
+	// (for the ptr mechanism, or the "p" macro), and the ones among them
+	// which were validated (their forward lookup includes the ip), in
+	// lowercase. Only the first 10 names are considered. Useful to identify
+	// ips with misleading reverse DNS.
+	// https://tools.ietf.org/html/rfc7208#section-5.5
+	PTRNames     []string
+	PTRValidated []string
+
+	// Steps of the evaluation, in order. Only collected when using
+	// WithEvaluationSteps.
+	Steps []Step
+
+	// Time taken by each of the DNS queries, in order, and in total. Only
+	// collected when using WithQueryTimes.
+	QueryTimes []QueryTime
+	DNSTime    time.Duration
+
+	// Problems found during the check which don't affect the result, but
+	// likely indicate a misconfiguration, as human-readable messages.
+	Warnings []string
+}
+
+// CheckHostDetailed is like CheckHostWithSender, but also returns additional
+// details about the evaluation.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CheckHostDetailed(ip net.IP, helo, sender string, opts ...Option) (Result, *Details, error) {
+	_, domain := split(sender)
+	if domain == "" {
+		domain = helo
+	}
+
+	trace("check host with sender %q %q %q (%q)", ip, helo, sender, domain)
+	r := newResolution(ip, sender, opts)
+	res, err := r.checkTopLevel(domain)
+	return res, &r.details, err
+}
+
+// CheckRecord evaluates the given SPF record as if it was the one published
+// for `sender`'s domain (or `helo`, if the sender has no domain part), to
+// determine if `ip` is permitted to send mail for it. Records referenced by
+// it (for example, via include) are fetched from DNS as usual.
+//
+// This is meant for diagnostics, for example to evaluate each of the
+// records found in Details.ConflictingRecords individually. The result
+// reflects what a published record would decide, including the lookup
+// count.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CheckRecord(ip net.IP, record, helo, sender string, opts ...Option) (Result, *Details, error) {
+	_, domain := split(sender)
+	if domain == "" {
+		domain = helo
+	}
+
+	trace("check record %q %q %q %q", ip, record, helo, sender)
+	r := newResolution(ip, sender, opts)
+	if err := r.validIP(); err != nil {
+		return None, &r.details, err
+	}
+	if !isSPFRecord(record) {
+		return PermError, &r.details, errInvalidVersion
+	}
+
+	// Count the lookup of the record, which is not done here but would be
+	// needed if it was published.
+	r.count++
+	res, err := r.checkRecord(domain, record)
+	r.details.setRecord(record)
+	if res == Pass {
+		r.details.Identity = domain
+		r.details.Authorized = isPositiveMatch(err)
+	}
+	if res == Fail {
+		r.details.Explanation, _ = r.explanation()
+	}
+	return res, &r.details, err
+}
+
+// CheckRecordStrings is like CheckRecord, but the record is given as the
+// character-strings of the TXT record, as returned by some resolvers (long
+// records have to be split into strings of up to 255 bytes); they are
+// concatenated to form the record. It is evaluated as if it was published
+// for `domain`, like CheckHost does.
+//
+// This is useful to reuse the TXT records already fetched for other
+// purposes, without querying them again.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CheckRecordStrings(ip net.IP, domain string, strs []string, opts ...Option) (Result, *Details, error) {
+	return CheckRecord(ip, joinTXT(strs...), domain, "@"+domain, opts...)
+}
+
+// WhatIf evaluates the SPF record published for `domain`, with the given
+// mechanism added to it, to determine if `ip` would be permitted to send
+// mail for it if the change was published. The mechanism is inserted before
+// the "all" mechanism, or after the last mechanism if there is none.
+//
+// The evaluation is done like CheckRecord's, so it reflects the impact of
+// the new mechanism on the lookup limit. It returns PermError if the
+// mechanism or the published record are not valid, and None if the domain
+// has no record.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WhatIf(domain, mechanism string, ip net.IP, opts ...Option) (Result, *Details, error) {
+	trace("what if %q %q %q", domain, mechanism, ip)
+	if _, err := ParseMechanism(mechanism); err != nil {
+		return PermError, &Details{}, &FieldError{domain, mechanism, err}
+	}
+
+	r := newResolution(ip, "@"+domain, opts)
+	txt, err := r.getDNSRecord(domain)
+	if err != nil {
+		if r.temporary(err) {
+			return TempError, &r.details, err
+		}
+		if err == errMultipleRecords || err == errNearMissRecord ||
+			err == errTooManyAnswers {
+			return PermError, &r.details, err
+		}
+		return None, &r.details, err
+	}
+	if txt == "" {
+		return None, &r.details, errNoResult
+	}
+	if _, err := Parse(txt); err != nil {
+		return PermError, &r.details, err
+	}
+
+	return CheckRecord(ip, insertMechanism(txt, mechanism),
+		domain, "@"+domain, opts...)
+}
+
+// insertMechanism returns the record with the mechanism inserted before its
+// "all" mechanism, or after its last mechanism if there is none.
+func insertMechanism(txt, mechanism string) string {
+	fields := strings.Fields(txt)
+	pos := 1
+	for i := 1; i < len(fields); i++ {
+		field := fields[i]
+		if isModifier(field) {
+			continue
+		}
+		if _, ok := qualToResult[field[0]]; ok {
+			field = field[1:]
+		}
+		if strings.EqualFold(field, "all") {
+			pos = i
+			break
+		}
+		pos = i + 1
+	}
+
+	fields = append(fields[:pos],
+		append([]string{mechanism}, fields[pos:]...)...)
+	return strings.Join(fields, " ")
+}
+
+// setRecord sets the record evaluated for the domain, and its size.
+func (d *Details) setRecord(record string) {
+	d.Record = record
+	d.RecordBytes = len(record)
+	d.RecordStrings = (len(record) + 254) / 255
+}
+
+// SlowestQuery returns the DNS query that took the longest, if any were
+// measured (see WithQueryTimes).
+func (d *Details) SlowestQuery() (QueryTime, bool) {
+	slowest, ok := QueryTime{}, false
+	for _, q := range d.QueryTimes {
+		if !ok || q.Time > slowest.Time {
+			slowest, ok = q, true
+		}
+	}
+	return slowest, ok
+}
+
+// isPositiveMatch returns true if the error (that came with a Pass result)
+// indicates a match of a mechanism other than "all".
+func isPositiveMatch(err error) bool {
+	switch err {
+	case errMatchedA, errMatchedIP, errMatchedMX, errMatchedPTR,
+		errMatchedExists, errMatchedHandler:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,805 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllQualifier(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["inc"] = []string{"v=spf1 ~all"}
+	dns.txt["target"] = []string{"v=spf1 ?all"}
+
+	cases := []struct {
+		txt  string
+		res  Result
+		qual Result
+	}{
+		{"v=spf1 -all", Fail, Fail},
+		{"v=spf1 ~all", SoftFail, SoftFail},
+		{"v=spf1 ?all", Neutral, Neutral},
+		{"v=spf1 all", Pass, Pass},
+		{"v=spf1 ip4:1.1.1.1 -ALL", Pass, Fail},
+		{"v=spf1 ip4:1.2.3.4", Neutral, ""},
+		{"v=spf1", Neutral, ""},
+
+		// The include's all must not be taken into account.
+		{"v=spf1 include:inc", Neutral, ""},
+		{"v=spf1 include:inc -all", Fail, Fail},
+
+		// The redirect target's all is the effective one.
+		{"v=spf1 redirect=target", Neutral, Neutral},
+	}
+
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+		if res != c.res || details.AllQualifier != c.qual {
+			t.Errorf("%q: expected %v/%q, got %v/%q (%v)",
+				c.txt, c.res, c.qual, res, details.AllQualifier, err)
+		}
+	}
+}
+
+func TestDetailsRecord(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{
+		"google-site-verification=blah",
+		"v=spf1 include:inc redirect=target",
+	}
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.2.3.4"}
+	dns.txt["target"] = []string{"v=spf1 -all"}
+
+	res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+	if res != Fail {
+		t.Errorf("expected fail, got %v (%v)", res, err)
+	}
+	if details.Record != "v=spf1 include:inc redirect=target" {
+		t.Errorf("unexpected record: %q", details.Record)
+	}
+	if details.RecordBytes != 34 || details.RecordStrings != 1 {
+		t.Errorf("expected 34 bytes in 1 string, got %d in %d",
+			details.RecordBytes, details.RecordStrings)
+	}
+	exp := map[string]string{
+		"domain": "v=spf1 include:inc redirect=target",
+		"inc":    "v=spf1 ip4:1.2.3.4",
+		"target": "v=spf1 -all",
+	}
+	if !reflect.DeepEqual(details.Records, exp) {
+		t.Errorf("expected records %q, got %q", exp, details.Records)
+	}
+
+	// No record.
+	_, details, _ = CheckHostDetailed(ip1111, "helo", "user@nospf")
+	if details.Record != "" || details.Records != nil ||
+		details.RecordBytes != 0 || details.RecordStrings != 0 {
+		t.Errorf("expected no records, got %q / %q",
+			details.Record, details.Records)
+	}
+
+	// Long records need more than one string.
+	for n, exp := range map[int]int{255: 1, 256: 2, 510: 2, 511: 3} {
+		txt := "v=spf1 " + strings.Repeat("a", n-len("v=spf1 "))
+		_, details, _ = CheckRecord(ip1111, txt, "helo", "user@domain")
+		if details.RecordBytes != n || details.RecordStrings != exp {
+			t.Errorf("expected %d bytes in %d strings, got %d in %d",
+				n, exp, details.RecordBytes, details.RecordStrings)
+		}
+	}
+}
+
+func TestNearMissRecords(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	cases := []struct {
+		txt     string
+		lenient Result
+		strict  Result
+		warning string
+	}{
+		{"v=spf1 -all", Fail, Fail, ""},
+		{"v=SPF1 -all", Fail, PermError,
+			`"v=SPF1 -all": version should be written as "v=spf1"`},
+		{"spf1 -all", None, PermError,
+			`"spf1 -all": record looks like SPF but is not valid`},
+		{"v=spf1;-all", None, PermError,
+			`"v=spf1;-all": record looks like SPF but is not valid`},
+		{"v=spf1;", None, PermError,
+			`"v=spf1;": record looks like SPF but is not valid`},
+		{"v=spf1; -all", None, PermError,
+			`"v=spf1; -all": record looks like SPF but is not valid`},
+		{"v = spf1 -all", None, PermError,
+			`"v = spf1 -all": record looks like SPF but is not valid`},
+		{"V=Spf1 -all", Fail, PermError,
+			`"V=Spf1 -all": version should be written as "v=spf1"`},
+		{"v=spf1", Neutral, Neutral, ""},
+
+		// Any whitespace is accepted after the version, but in strict mode
+		// only spaces are valid separators.
+		{"v=spf1\t-all", Fail, PermError, ""},
+		{"v=spf1\u00a0-all", Fail, PermError, ""},
+
+		// The version must be followed by whitespace.
+		{"v=spf10 -all", None, PermError,
+			`"v=spf10 -all": record looks like SPF but is not valid`},
+		{"v=spf1-all", None, PermError,
+			`"v=spf1-all": record looks like SPF but is not valid`},
+		{"v=spf1extra", None, PermError,
+			`"v=spf1extra": record looks like SPF but is not valid`},
+		{"v=spf1:something -all", None, PermError,
+			`"v=spf1:something -all": record looks like SPF but is not valid`},
+
+		{"some-verification=1234", None, None, ""},
+	}
+
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+		if res != c.lenient {
+			t.Errorf("%q lenient: expected %v, got %v (%v)",
+				c.txt, c.lenient, res, err)
+		}
+		if c.lenient == None && c.warning != "" && err != errNearMissOnly {
+			t.Errorf("%q lenient: expected near-miss error, got %v",
+				c.txt, err)
+		}
+		if c.warning == "" && len(details.Warnings) != 0 {
+			t.Errorf("%q: unexpected warnings %q", c.txt, details.Warnings)
+		}
+		if c.warning != "" &&
+			!reflect.DeepEqual(details.Warnings, []string{c.warning}) {
+			t.Errorf("%q: expected warning %q, got %q",
+				c.txt, c.warning, details.Warnings)
+		}
+
+		res, _, err = CheckHostDetailed(ip1111, "helo", "user@domain",
+			WithStrictParsing())
+		if res != c.strict {
+			t.Errorf("%q strict: expected %v, got %v (%v)",
+				c.txt, c.strict, res, err)
+		}
+		if c.warning != "" && res == PermError && err != errNearMissRecord {
+			t.Errorf("%q strict: expected near-miss error, got %v", c.txt, err)
+		}
+	}
+
+	// Records with other versions are ignored when there is a valid one,
+	// they don't count as multiple records.
+	for _, other := range []string{"v=spf10 +all", "v=spf1extra +all"} {
+		dns.txt["domain"] = []string{other, "v=spf1 -all"}
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+		if res != Fail || err != errMatchedAll ||
+			details.Record != "v=spf1 -all" {
+			t.Errorf("%q: expected fail from the valid record, got %v "+
+				"(%v) %q", other, res, err, details.Record)
+		}
+	}
+}
+
+func TestConflictingRecords(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 -all", "v=spf1 -all"}
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.1.1.1"}
+
+	res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+	if res != PermError || err != errMultipleRecords {
+		t.Errorf("expected permerror, got %v (%v)", res, err)
+	}
+	if !reflect.DeepEqual(details.ConflictingRecords["domain"],
+		dns.txt["domain"]) {
+		t.Errorf("unexpected conflicting records: %q",
+			details.ConflictingRecords)
+	}
+
+	// Each record can be evaluated on its own.
+	cases := []struct {
+		record string
+		res    Result
+		err    error
+	}{
+		{"v=spf1 ip4:1.1.1.1 -all", Pass, errMatchedIP},
+		{"v=spf1 -all", Fail, errMatchedAll},
+		{"v=spf1 include:inc -all", Pass, errMatchedIP},
+		{"V=SPF1", Neutral, nil},
+		{"spf1 -all", PermError, errInvalidVersion},
+	}
+	for _, c := range cases {
+		res, details, err := CheckRecord(
+			ip1111, c.record, "helo", "user@domain")
+		if res != c.res || err != c.err {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.record, c.res, c.err, res, err)
+		}
+		if err != errInvalidVersion && details.Record != c.record {
+			t.Errorf("%q: unexpected details record %q",
+				c.record, details.Record)
+		}
+	}
+
+	// The lookup of the record counts towards the limit.
+	res, _, err = CheckRecord(ip1111, "v=spf1 include:inc -all",
+		"helo", "user@domain", OverrideLookupLimit(1))
+	if res != PermError || err != errLookupLimitReached {
+		t.Errorf("expected lookup limit permerror, got %v (%v)", res, err)
+	}
+}
+
+func TestCheckRecordStrings(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.ip["host"] = []net.IP{ip1111}
+
+	cases := []struct {
+		strs []string
+		res  Result
+		err  error
+	}{
+		// Split in the middle of a term, and between terms: no spaces are
+		// added when joining.
+		{[]string{"v=spf1 ip4:1.2.3.4 a:h", "ost -all"}, Pass, errMatchedA},
+		{[]string{"v=spf1 ip4:1.2.3.4", " ip4:1.1.1.1 -all"}, Pass,
+			errMatchedIP},
+		{[]string{"v=spf1 ip4:1.2.3.4", "ip4:1.1.1.1 -all"}, PermError,
+			errInvalidIP},
+		{[]string{`"v=spf1 ip4:1.2.3.4 "`, `"-all"`}, Fail, errMatchedAll},
+		{[]string{"v=spf1 -all"}, Fail, errMatchedAll},
+		{[]string{"v=sp", "f1 -all"}, Fail, errMatchedAll},
+		{[]string{}, PermError, errInvalidVersion},
+	}
+	for _, c := range cases {
+		res, details, err := CheckRecordStrings(ip1111, "domain", c.strs)
+		if res != c.res || !isError(err, c.err) {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.strs, c.res, c.err, res, err)
+		}
+		if res == Pass && details.Identity != "domain" {
+			t.Errorf("%q: unexpected identity %q", c.strs,
+				details.Identity)
+		}
+	}
+
+	// The record is long enough that it has to be split in DNS.
+	long := "v=spf1" + strings.Repeat(" ip4:1.2.3.4", 30) + " ip4:1.1.1.1 -all"
+	res, details, err := CheckRecordStrings(ip1111, "domain",
+		[]string{long[:255], long[255:]})
+	if res != Pass || err != errMatchedIP || details.Record != long ||
+		details.RecordStrings != 2 {
+		t.Errorf("long record: got %v/%v, %q %d", res, err,
+			details.Record, details.RecordStrings)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	dns.txt["helo"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+
+	cases := []struct {
+		ip       net.IP
+		helo     string
+		sender   string
+		identity string
+	}{
+		{ip1111, "helo", "user@domain", "domain"},
+		{ip1111, "helo", "", "helo"},
+		{ip1111, "helo", "postmaster", "helo"},
+		{ip1110, "helo", "user@domain", ""},
+		{ip1111, "helo", "user@nospf", ""},
+	}
+	for _, c := range cases {
+		res, details, err := CheckHostDetailed(c.ip, c.helo, c.sender)
+		if details.Identity != c.identity {
+			t.Errorf("%v %q %q: expected identity %q, got %q (%v %v)",
+				c.ip, c.helo, c.sender, c.identity, details.Identity,
+				res, err)
+		}
+	}
+
+	// Local policy overrides don't authenticate the domain.
+	_, n, _ := net.ParseCIDR("1.1.1.0/24")
+	res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain",
+		WithTrustedNetworks([]net.IPNet{*n}, Pass))
+	if res != Pass || details.Identity != "" {
+		t.Errorf("unexpected result with trusted network: %v %q (%v)",
+			res, details.Identity, err)
+	}
+}
+
+func TestRejectPlusAll(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["inc"] = []string{"v=spf1 +all"}
+	cases := []struct {
+		txt      string
+		res, rej Result
+		warn     bool
+	}{
+		{"v=spf1 +all", Pass, PermError, true},
+		{"v=spf1 ip4:1.2.3.4 all", Pass, PermError, true},
+		{"v=spf1 include:inc -all", Pass, PermError, true},
+		{"v=spf1 ip4:1.1.1.1 +all", Pass, Pass, false},
+		{"v=spf1 ~all", SoftFail, SoftFail, false},
+		{"v=spf1 ?all", Neutral, Neutral, false},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+		if warn := len(details.Warnings) > 0; warn != c.warn {
+			t.Errorf("%q: unexpected warnings: %q", c.txt, details.Warnings)
+		}
+
+		res, _, err = CheckHostDetailed(ip1111, "helo", "user@domain",
+			WithRejectPlusAll())
+		if res != c.rej {
+			t.Errorf("%q: expected %v with the option, got %v (%v)",
+				c.txt, c.rej, res, err)
+		}
+		if res == PermError && err != errPlusAll {
+			t.Errorf("%q: unexpected error %v", c.txt, err)
+		}
+	}
+}
+
+func TestExplanation(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	clock := WithClock(func() time.Time { return time.Unix(1234567890, 0) })
+	dns.txt["exp.domain"] = []string{
+		"%{c} is not allowed to send for %{d} (%{l}, %{r}, %{t}) %%%_%-"}
+	dns.txt["exp.target"] = []string{"target says no"}
+	dns.txt["target"] = []string{"v=spf1 -all exp=exp.target"}
+	dns.txt["inc"] = []string{"v=spf1 -all exp=exp.target"}
+	dns.txt["multi"] = []string{"one", "two"}
+
+	cases := []struct {
+		txt string
+		exp string
+	}{
+		{"v=spf1 -all exp=exp.%{d}",
+			"1.1.1.1 is not allowed to send for domain " +
+				"(user, unknown, 1234567890) % %20"},
+
+		// The redirect target's exp is used, but not the include's.
+		{"v=spf1 redirect=target exp=exp.domain", "target says no"},
+		{"v=spf1 -include:target -all", ""},
+		{"v=spf1 include:inc -all", ""},
+
+		// Not a failure.
+		{"v=spf1 ~all exp=exp.domain", ""},
+
+		// Explanations that can't be obtained are ignored.
+		{"v=spf1 -all exp=nothere", ""},
+		{"v=spf1 -all exp=multi", ""},
+		{"v=spf1 -all exp=exp.%{t}", ""},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain",
+			clock)
+		if details.Explanation != c.exp {
+			t.Errorf("%q: expected explanation %q, got %q (%v %v)",
+				c.txt, c.exp, details.Explanation, res, err)
+		}
+	}
+
+	// The t macro is not allowed outside explanations.
+	dns.txt["domain"] = []string{"v=spf1 exists:%{t}.domain -all"}
+	res, err := CheckHost(ip1111, "domain")
+	if res != PermError || err != errInvalidMacro {
+		t.Errorf("expected permerror/invalid macro, got %v (%v)", res, err)
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 redirect=policy"}
+	dns.txt["policy"] = []string{"v=spf1 include:inc -all"}
+	dns.txt["inc"] = []string{"v=spf1 redirect=inc2"}
+	dns.txt["inc2"] = []string{"v=spf1 ip6:2001:db8::/32"}
+	dns.txt["chain"] = []string{"v=spf1 redirect=domain"}
+
+	cases := []struct {
+		ip     net.IP
+		domain string
+		res    Result
+		target string
+	}{
+		// Matched directly, the redirect is not followed.
+		{ip1111, "domain", Pass, ""},
+
+		// Decided by the target; redirects within includes don't count.
+		{ip1110, "domain", Fail, "policy"},
+		{ip6666, "domain", Pass, "policy"},
+
+		// Chained redirects, the last one counts.
+		{ip1110, "chain", Fail, "policy"},
+	}
+	for _, c := range cases {
+		res, details, err := CheckHostDetailed(c.ip, "helo", "a@"+c.domain)
+		if res != c.res || details.RedirectTarget != c.target {
+			t.Errorf("%v %q: expected %v/%q, got %v/%q (%v)",
+				c.ip, c.domain, c.res, c.target, res,
+				details.RedirectTarget, err)
+		}
+	}
+}
+
+func TestMechanismsAfterAll(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	cases := []struct {
+		txt  string
+		res  Result
+		warn []string
+	}{
+		{"v=spf1 ip4:1.1.1.0 -all ip4:1.1.1.1", Fail, []string{
+			`"v=spf1 ip4:1.1.1.0 -all ip4:1.1.1.1": mechanisms after ` +
+				`"all" are never evaluated: ip4:1.1.1.1`}},
+		{"v=spf1 ?all a mx exp=x", Neutral, []string{
+			`"v=spf1 ?all a mx exp=x": mechanisms after "all" are never ` +
+				`evaluated: a mx`}},
+
+		// Only modifiers after all are fine.
+		{"v=spf1 -all exp=x", Fail, nil},
+
+		// Not reached, so there's no warning.
+		{"v=spf1 ip4:1.1.1.1 -all a", Pass, nil},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+		if !reflect.DeepEqual(details.Warnings, c.warn) {
+			t.Errorf("%q: expected warnings %q, got %q",
+				c.txt, c.warn, details.Warnings)
+		}
+	}
+
+	// With +all, both problems are reported.
+	dns.txt["domain"] = []string{"v=spf1 all ip4:192.0.2.1 -all"}
+	_, details, _ := CheckHostDetailed(ip1111, "helo", "user@domain")
+	if len(details.Warnings) != 2 ||
+		!strings.Contains(details.Warnings[0], "ip4:192.0.2.1 -all") {
+		t.Errorf("unexpected warnings: %q", details.Warnings)
+	}
+}
+
+func TestPTRNames(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// "nope." has no addresses, and "other." resolves to a different ip,
+	// so neither is validated.
+	dns.addr["1.1.1.1"] = []string{"nope.", "Mail.Domain.", "other."}
+	dns.ip["mail.domain"] = []net.IP{ip1111}
+	dns.ip["other"] = []net.IP{ip1110}
+	dns.txt["domain"] = []string{"v=spf1 ptr -all"}
+
+	res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+	if res != Pass {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+	expNames := []string{"nope.", "Mail.Domain.", "other."}
+	if !reflect.DeepEqual(details.PTRNames, expNames) {
+		t.Errorf("expected names %q, got %q", expNames, details.PTRNames)
+	}
+	expValidated := []string{"mail.domain."}
+	if !reflect.DeepEqual(details.PTRValidated, expValidated) {
+		t.Errorf("expected validated %q, got %q",
+			expValidated, details.PTRValidated)
+	}
+
+	// No reverse lookup needed.
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 ptr -all"}
+	_, details, _ = CheckHostDetailed(ip1111, "helo", "user@domain")
+	if details.PTRNames != nil || details.PTRValidated != nil {
+		t.Errorf("expected no names, got %q / %q",
+			details.PTRNames, details.PTRValidated)
+	}
+}
+
+// slowResolver wraps a TestResolver, and delays the TXT queries of some
+// domains.
+type slowResolver struct {
+	*TestResolver
+	delays map[string]time.Duration
+}
+
+func (r *slowResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	time.Sleep(r.delays[domain])
+	return r.TestResolver.LookupTXT(ctx, domain)
+}
+
+func TestQueryTimes(t *testing.T) {
+	dns := NewResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 include:fast include:slow mx -all"}
+	dns.txt["fast"] = []string{"v=spf1 ip4:1.2.3.4"}
+	dns.txt["slow"] = []string{"v=spf1 ip4:1.2.3.5"}
+	resolver := &slowResolver{dns, map[string]time.Duration{
+		"domain": 5 * time.Millisecond,
+		"slow":   50 * time.Millisecond,
+	}}
+
+	res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain",
+		WithResolver(resolver), WithQueryTimes())
+	if res != Fail {
+		t.Errorf("expected fail, got %v (%v)", res, err)
+	}
+
+	queries := []string{}
+	for _, q := range details.QueryTimes {
+		queries = append(queries, q.Query)
+	}
+	expQueries := []string{
+		"TXT domain", "TXT fast", "TXT slow", "MX domain"}
+	if !reflect.DeepEqual(queries, expQueries) {
+		t.Fatalf("expected queries %q, got %q", expQueries, queries)
+	}
+	if q := details.QueryTimes[0]; q.Time < 5*time.Millisecond {
+		t.Errorf("%q: expected at least 5ms, got %v", q.Query, q.Time)
+	}
+
+	slowest, ok := details.SlowestQuery()
+	if !ok || slowest.Query != "TXT slow" || slowest.Time < 50*time.Millisecond {
+		t.Errorf("unexpected slowest query: %v %v", slowest, ok)
+	}
+	if details.DNSTime < 55*time.Millisecond {
+		t.Errorf("expected at least 55ms in total, got %v", details.DNSTime)
+	}
+
+	// Not measured without the option.
+	_, details, _ = CheckHostDetailed(ip1111, "helo", "user@domain",
+		WithResolver(resolver))
+	if details.QueryTimes != nil || details.DNSTime != 0 {
+		t.Errorf("unexpected times: %v %v",
+			details.QueryTimes, details.DNSTime)
+	}
+	if _, ok := details.SlowestQuery(); ok {
+		t.Errorf("unexpected slowest query")
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.1.1.1"}
+	dns.txt["incall"] = []string{"v=spf1 +all"}
+	dns.txt["target"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	dns.ip["host"] = []net.IP{ip1111}
+
+	cases := []struct {
+		txt        string
+		res        Result
+		authorized bool
+	}{
+		{"v=spf1 ip4:1.1.1.1 -all", Pass, true},
+		{"v=spf1 a:host -all", Pass, true},
+		{"v=spf1 include:inc -all", Pass, true},
+		{"v=spf1 redirect=target", Pass, true},
+		{"v=spf1 ip4:1.2.3.4 +all", Pass, false},
+		{"v=spf1 include:incall -all", Pass, false},
+		{"v=spf1 ip4:1.2.3.4 -all", Fail, false},
+		{"v=spf1 ip4:1.2.3.4", Neutral, false},
+		{"v=spf1 ?ip4:1.1.1.1 +all", Neutral, false},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+		if res != c.res || details.Authorized != c.authorized {
+			t.Errorf("%q: expected %v/%v, got %v/%v (%v)", c.txt,
+				c.res, c.authorized, res, details.Authorized, err)
+		}
+
+		_, details, _ = CheckRecord(ip1111, c.txt, "helo", "user@domain")
+		if details.Authorized != c.authorized {
+			t.Errorf("%q: record: expected authorized %v, got %v",
+				c.txt, c.authorized, details.Authorized)
+		}
+	}
+
+	// Local policy overrides don't count.
+	dns.txt["domain"] = []string{"v=spf1 -all"}
+	_, trusted, _ := net.ParseCIDR("1.1.1.0/24")
+	res, details, _ := CheckHostDetailed(ip1111, "helo", "user@domain",
+		WithTrustedNetworks([]net.IPNet{*trusted}, Pass))
+	if res != Pass || details.Authorized {
+		t.Errorf("trusted: expected pass/false, got %v/%v",
+			res, details.Authorized)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.2.3.4 -all"}
+	dns.txt["target"] = []string{"v=spf1 ip4:1.2.3.4 ~all"}
+	dns.txt["falls"] = []string{"v=spf1 ip4:1.2.3.4"}
+	dns.ip["host"] = []net.IP{ip1111}
+
+	cases := []struct {
+		txt      string
+		res      Result
+		terminal string
+		tdomain  string
+		fell     bool
+	}{
+		// Fallthrough, with and without mechanisms that are evaluated
+		// through the general loop.
+		{"v=spf1 ip4:1.2.3.4", Neutral, "", "domain", true},
+		{"v=spf1 include:inc a:other", Neutral, "", "domain", true},
+		{"v=spf1 ?all", Neutral, "?all", "domain", false},
+
+		{"v=spf1 ip4:1.2.3.4 ~all", SoftFail, "~all", "domain", false},
+		{"v=spf1 include:inc ~all", SoftFail, "~all", "domain", false},
+		{"v=spf1 a:host -all", Pass, "a:host", "domain", false},
+		{"v=spf1 ip4:1.2.3.4 ip4:1.1.1.1 -all", Pass, "ip4:1.1.1.1",
+			"domain", false},
+		{"v=spf1 include:nonexistent -all", PermError,
+			"include:nonexistent", "domain", false},
+
+		// Redirects report the target's term.
+		{"v=spf1 redirect=target", SoftFail, "~all", "target", false},
+		{"v=spf1 redirect=falls", Neutral, "", "falls", true},
+		{"v=spf1 redirect=nonexistent", PermError,
+			"redirect=nonexistent", "domain", false},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, d, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+		if res != c.res || d.Terminal != c.terminal ||
+			d.TerminalDomain != c.tdomain || d.FellThrough != c.fell {
+			t.Errorf("%q: expected %v %q %q %v, got %v %q %q %v (%v)",
+				c.txt, c.res, c.terminal, c.tdomain, c.fell,
+				res, d.Terminal, d.TerminalDomain, d.FellThrough, err)
+		}
+	}
+}
+
+func TestWhatIf(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.2.3.4 -all"}
+	dns.txt["vendor"] = []string{"v=spf1 ip4:1.1.1.0/24 -all"}
+
+	// The ip fails with the published record, and passes with the new
+	// mechanism.
+	res, _ := CheckHostWithSender(ip1111, "helo", "user@domain")
+	if res != Fail {
+		t.Fatalf("expected fail with the published record, got %v", res)
+	}
+	res, details, err := WhatIf("domain", "ip4:1.1.1.1", ip1111)
+	if res != Pass || err != errMatchedIP {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+	if details.Record != "v=spf1 ip4:1.2.3.4 ip4:1.1.1.1 -all" {
+		t.Errorf("unexpected record %q", details.Record)
+	}
+	res, _, err = WhatIf("domain", "include:vendor", ip1111)
+	if res != Pass || err != errMatchedIP {
+		t.Errorf("include: expected pass, got %v (%v)", res, err)
+	}
+
+	// Nothing is published.
+	if txt := dns.txt["domain"][0]; txt != "v=spf1 ip4:1.2.3.4 -all" {
+		t.Errorf("published record changed: %q", txt)
+	}
+
+	// The new mechanism counts towards the lookup limit.
+	dns.txt["domain"] = []string{
+		"v=spf1 a:1 a:2 a:3 a:4 a:5 a:6 a:7 a:8 a:9 -all"}
+	for i := 1; i <= 9; i++ {
+		dns.ip[fmt.Sprint(i)] = []net.IP{ip1110}
+	}
+	res, _, err = WhatIf("domain", "include:vendor", ip1111)
+	if res != PermError || err != errLookupLimitReached {
+		t.Errorf("expected lookup limit permerror, got %v (%v)", res, err)
+	}
+
+	// Errors.
+	cases := []struct {
+		domain, mech string
+		res          Result
+		err          error
+	}{
+		{"domain", "blah", PermError, errUnknownField},
+		{"domain", "redirect=vendor", PermError, errUnknownField},
+		{"nonexistent", "ip4:1.1.1.1", None, errNoResult},
+	}
+	for _, c := range cases {
+		res, _, err := WhatIf(c.domain, c.mech, ip1111)
+		if res != c.res || !isError(err, c.err) {
+			t.Errorf("%q %q: expected %v/%v, got %v/%v",
+				c.domain, c.mech, c.res, c.err, res, err)
+		}
+	}
+}
+
+func TestInsertMechanism(t *testing.T) {
+	cases := []struct{ txt, out string }{
+		{"v=spf1", "v=spf1 M"},
+		{"v=spf1 -all", "v=spf1 M -all"},
+		{"v=spf1 a ~ALL", "v=spf1 a M ~ALL"},
+		{"v=spf1 a mx", "v=spf1 a mx M"},
+		{"v=spf1 exp=e a redirect=r", "v=spf1 exp=e a M redirect=r"},
+		{"v=spf1 redirect=r", "v=spf1 M redirect=r"},
+		{"v=spf1  a\t-all exp=e", "v=spf1 a M -all exp=e"},
+	}
+	for _, c := range cases {
+		if out := insertMechanism(c.txt, "M"); out != c.out {
+			t.Errorf("%q: expected %q, got %q", c.txt, c.out, out)
+		}
+	}
+}
+
+func TestTXTRecords(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["notxt"] = nil
+	dns.txt["nospf"] = []string{"verification=1234", "other"}
+	dns.txt["spf"] = []string{"verification=1234", "v=spf1 include:inc"}
+	dns.txt["inc"] = []string{"a", "b", "c", "v=spf1 -all"}
+
+	cases := []struct {
+		domain string
+		res    Result
+		ntxt   int
+	}{
+		{"notxt", None, 0},
+		{"nospf", None, 2},
+		{"spf", Neutral, 2},
+	}
+	for _, c := range cases {
+		res, details, err := CheckHostDetailed(ip1111, "helo", "user@"+c.domain)
+		if res != c.res || details.TXTRecords != c.ntxt {
+			t.Errorf("%q: expected %v with %d txt records, got %v with %d (%v)",
+				c.domain, c.res, c.ntxt, res, details.TXTRecords, err)
+		}
+		if res == None && (err != errNoResult || details.Record != "") {
+			t.Errorf("%q: expected no record, got %v %q",
+				c.domain, err, details.Record)
+		}
+	}
+
+	// Only a target without TXT records is a void lookup.
+	for domain, void := range map[string]uint{"notxt": 1, "nospf": 0} {
+		r := newResolution(ip1111, "user@domain", nil)
+		_, err := r.Check(domain)
+		r.checkTargetVoidLookup(err)
+		if r.voidcount != void {
+			t.Errorf("%q: expected %d void lookups, got %d",
+				domain, void, r.voidcount)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package spf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChangeKind is the kind of a Change between two records.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type ChangeKind string
+
+// Kinds of changes.
+const (
+	// The term is only in the new record.
+	ChangeAdded = ChangeKind("added")
+
+	// The term is only in the old record.
+	ChangeRemoved = ChangeKind("removed")
+
+	// The term is in both records, but with differences: for mechanisms,
+	// in the qualifier or the prefix lengths (for example "~all" to
+	// "-all"); for modifiers, in the value.
+	ChangeModified = ChangeKind("modified")
+
+	// The mechanism is in both records, but in a different position
+	// relative to the others. Since mechanisms are evaluated in order, this
+	// can change the result.
+	ChangeMoved = ChangeKind("moved")
+)
+
+// Change is a difference between two records, see DiffRecords.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type Change struct {
+	Kind ChangeKind
+
+	// The term in the old and the new record, in their textual form (see
+	// Mechanism.String and Modifier.String). Old is empty for added terms,
+	// and New for removed ones.
+	Old, New string
+
+	// Positions of the mechanism among the mechanisms of the old and the
+	// new record, or -1 if it is not in it. Both are -1 for modifiers.
+	OldIndex, NewIndex int
+}
+
+// String returns a human-readable description of the change, like
+// "added include:_spf.example.com".
+func (c Change) String() string {
+	switch c.Kind {
+	case ChangeAdded:
+		return "added " + c.New
+	case ChangeRemoved:
+		return "removed " + c.Old
+	case ChangeMoved:
+		return fmt.Sprintf("moved %s (%d -> %d)", c.New, c.OldIndex, c.NewIndex)
+	default:
+		return fmt.Sprintf("%s %s -> %s", c.Kind, c.Old, c.New)
+	}
+}
+
+// DiffRecords parses the two records, and returns the changes from the old
+// one to the new one, without doing any DNS queries. It returns an error if
+// either record is not syntactically valid (see Parse).
+//
+// Mechanisms are matched by their name and value (case-insensitive), so a
+// change in their qualifier or prefix lengths is reported as a
+// modification. Mechanisms which are in both records but were reordered are
+// reported as moved; the moves reported are the fewest needed to go from
+// one order to the other. Modifiers are matched by name, and their order is
+// not relevant.
+//
+// The removed mechanisms come first, in the order of the old record, then
+// the rest of the changes to mechanisms, in the order of the new record,
+// and then the changes to modifiers in the same way.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func DiffRecords(oldTxt, newTxt string) ([]Change, error) {
+	oldRec, err := Parse(oldTxt)
+	if err != nil {
+		return nil, &diffError{"old", err}
+	}
+	newRec, err := Parse(newTxt)
+	if err != nil {
+		return nil, &diffError{"new", err}
+	}
+
+	changes := diffMechanisms(oldRec.Mechanisms, newRec.Mechanisms)
+	changes = append(changes,
+		diffModifiers(oldRec.Modifiers, newRec.Modifiers)...)
+	return changes, nil
+}
+
+// diffError is returned by DiffRecords when one of the records is not
+// valid.
+type diffError struct {
+	// Which record is not valid: "old" or "new".
+	record string
+
+	// Why the record is not valid, as returned by Parse.
+	err error
+}
+
+func (e *diffError) Error() string {
+	return e.record + " record: " + e.err.Error()
+}
+
+// Unwrap returns the reason why the record is not valid.
+func (e *diffError) Unwrap() error {
+	return e.err
+}
+
+// mechanismKey returns the identity of the mechanism, used to match them
+// between records: its name and value, without the qualifier and masks.
+func mechanismKey(m Mechanism) string {
+	return m.Name + ":" + strings.ToLower(m.Value)
+}
+
+func diffMechanisms(olds, news []Mechanism) []Change {
+	// For each mechanism of the new record, the index of the matching one
+	// in the old record, or -1. Identical mechanisms are matched first, so
+	// they are not reported as modified when there are similar ones.
+	match := make([]int, len(news))
+	matched := make([]bool, len(olds))
+	for j := range news {
+		match[j] = -1
+	}
+	for _, same := range []func(a, b Mechanism) bool{
+		func(a, b Mechanism) bool { return a.String() == b.String() },
+		func(a, b Mechanism) bool { return mechanismKey(a) == mechanismKey(b) },
+	} {
+		for j, n := range news {
+			if match[j] >= 0 {
+				continue
+			}
+			for i, o := range olds {
+				if !matched[i] && same(o, n) {
+					match[j], matched[i] = i, true
+					break
+				}
+			}
+		}
+	}
+
+	changes := []Change{}
+	for i, o := range olds {
+		if !matched[i] {
+			changes = append(changes, Change{
+				Kind: ChangeRemoved, Old: o.String(),
+				OldIndex: i, NewIndex: -1})
+		}
+	}
+
+	inOrder := longestIncreasing(match)
+	for j, n := range news {
+		i := match[j]
+		c := Change{New: n.String(), OldIndex: i, NewIndex: j}
+		switch {
+		case i < 0:
+			c.Kind = ChangeAdded
+		case olds[i].String() != c.New:
+			c.Kind, c.Old = ChangeModified, olds[i].String()
+		case !inOrder[j]:
+			c.Kind, c.Old = ChangeMoved, c.New
+		default:
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// longestIncreasing returns which of the elements of s are part of its
+// longest strictly increasing subsequence. Negative elements are ignored.
+// These are the mechanisms that kept their relative order; the rest are the
+// ones that moved.
+func longestIncreasing(s []int) []bool {
+	// length[i] is the length of the longest subsequence ending at i, and
+	// prev[i] the previous element in it. Records are short, so the
+	// quadratic algorithm is fine.
+	// On ties, we prefer the subsequences with the smaller elements, so the
+	// mechanisms which were first in the old record are kept in place.
+	length := make([]int, len(s))
+	prev := make([]int, len(s))
+	better := func(i, j int) bool {
+		return j < 0 || length[i] > length[j] ||
+			length[i] == length[j] && s[i] < s[j]
+	}
+	best := -1
+	for i := range s {
+		prev[i] = -1
+		if s[i] < 0 {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if s[j] >= 0 && s[j] < s[i] && better(j, prev[i]) {
+				prev[i] = j
+			}
+		}
+		length[i] = 1
+		if prev[i] >= 0 {
+			length[i] = length[prev[i]] + 1
+		}
+		if better(i, best) {
+			best = i
+		}
+	}
+
+	in := make([]bool, len(s))
+	for i := best; i >= 0; i = prev[i] {
+		in[i] = true
+	}
+	return in
+}
+
+func diffModifiers(olds, news []Modifier) []Change {
+	changes := []Change{}
+	find := func(mods []Modifier, name string) (Modifier, bool) {
+		for _, m := range mods {
+			if m.Name == name {
+				return m, true
+			}
+		}
+		return Modifier{}, false
+	}
+
+	for _, o := range olds {
+		if _, ok := find(news, o.Name); !ok {
+			changes = append(changes, Change{
+				Kind: ChangeRemoved, Old: o.String(),
+				OldIndex: -1, NewIndex: -1})
+		}
+	}
+	for _, n := range news {
+		c := Change{New: n.String(), OldIndex: -1, NewIndex: -1}
+		o, ok := find(olds, n.Name)
+		switch {
+		case !ok:
+			c.Kind = ChangeAdded
+		case o.Value != n.Value:
+			c.Kind, c.Old = ChangeModified, o.String()
+		default:
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
@@ -0,0 +1,92 @@
+package spf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffRecords(t *testing.T) {
+	cases := []struct {
+		old, new string
+		changes  []string
+	}{
+		{"v=spf1 -all", "v=spf1 -all", nil},
+		{"v=spf1 +a -all", "v=spf1 a -ALL", nil},
+
+		// Additions and removals.
+		{"v=spf1 ip4:192.0.2.0/24 -all",
+			"v=spf1 include:newvendor.example -all",
+			[]string{"removed ip4:192.0.2.0/24",
+				"added include:newvendor.example"}},
+		{"v=spf1 a mx -all", "v=spf1 a -all",
+			[]string{"removed mx"}},
+
+		// Modifications.
+		{"v=spf1 a ~all", "v=spf1 a -all",
+			[]string{"modified ~all -> -all"}},
+		{"v=spf1 a:d/24 -all", "v=spf1 a:d/24//64 -all",
+			[]string{"modified a:d/24 -> a:d/24//64"}},
+		{"v=spf1 ip4:1.2.3.4 ip4:1.2.3.4/24 -all",
+			"v=spf1 ip4:1.2.3.4/24 -all",
+			[]string{"removed ip4:1.2.3.4"}},
+
+		// Order changes.
+		{"v=spf1 a mx ptr -all", "v=spf1 ptr a mx -all",
+			[]string{"moved ptr (2 -> 0)"}},
+		{"v=spf1 a mx -all", "v=spf1 mx a -all",
+			[]string{"moved mx (1 -> 0)"}},
+		{"v=spf1 a mx -all", "v=spf1 -all mx a",
+			[]string{"moved -all (2 -> 0)", "moved mx (1 -> 1)"}},
+		{"v=spf1 a mx ip4:1.2.3.4 -all", "v=spf1 ip4:1.2.3.4 a ~all",
+			[]string{"removed mx", "moved ip4:1.2.3.4 (2 -> 0)",
+				"modified -all -> ~all"}},
+
+		// Modifiers, whose order does not matter.
+		{"v=spf1 a redirect=r1 exp=e1", "v=spf1 exp=e1 a redirect=r2",
+			[]string{"modified redirect=r1 -> redirect=r2"}},
+		{"v=spf1 exp=e1 redirect=r1", "v=spf1 redirect=r1 x=y",
+			[]string{"removed exp=e1", "added x=y"}},
+	}
+	for _, c := range cases {
+		changes, err := DiffRecords(c.old, c.new)
+		if err != nil {
+			t.Errorf("%q -> %q: unexpected error: %v", c.old, c.new, err)
+			continue
+		}
+		got := []string{}
+		for _, ch := range changes {
+			got = append(got, ch.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(c.changes, "\n") {
+			t.Errorf("%q -> %q: expected:\n  %s\ngot:\n  %s", c.old, c.new,
+				strings.Join(c.changes, "\n  "), strings.Join(got, "\n  "))
+		}
+	}
+
+	// Structured details.
+	changes, _ := DiffRecords("v=spf1 a -all", "v=spf1 mx a ~all")
+	expected := []Change{
+		{ChangeAdded, "", "mx", -1, 0},
+		{ChangeModified, "-all", "~all", 1, 2},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("%d: expected %+v, got %+v", i, expected[i], changes[i])
+		}
+	}
+
+	// Invalid records.
+	_, err := DiffRecords("v=spf1 blah", "v=spf1 -all")
+	if !isError(err, errUnknownField) ||
+		err.Error() != "old record: "+errUnknownField.Error() {
+		t.Errorf("invalid old record: unexpected error %v", err)
+	}
+	_, err = DiffRecords("v=spf1 -all", "spf1")
+	if !isError(err, errInvalidVersion) ||
+		err.Error() != "new record: "+errInvalidVersion.Error() {
+		t.Errorf("invalid new record: unexpected error %v", err)
+	}
+}
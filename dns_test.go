@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"strings"
+	"time"
 )
 
 // DNS overrides for testing.
@@ -14,15 +15,22 @@ type TestResolver struct {
 	ip     map[string][]net.IP
 	addr   map[string][]string
 	errors map[string]error
+
+	// Number of lookups performed, by type ("txt", "mx", "ip", "addr").
+	lookups map[string]int
+
+	// Delay to add to each lookup.
+	delay time.Duration
 }
 
 func NewResolver() *TestResolver {
 	return &TestResolver{
-		txt:    map[string][]string{},
-		mx:     map[string][]*net.MX{},
-		ip:     map[string][]net.IP{},
-		addr:   map[string][]string{},
-		errors: map[string]error{},
+		txt:     map[string][]string{},
+		mx:      map[string][]*net.MX{},
+		ip:      map[string][]net.IP{},
+		addr:    map[string][]string{},
+		errors:  map[string]error{},
+		lookups: map[string]int{},
 	}
 }
 
@@ -33,6 +41,8 @@ func NewDefaultResolver() *TestResolver {
 }
 
 func (r *TestResolver) LookupTXT(ctx context.Context, domain string) (txts []string, err error) {
+	r.lookups["txt"]++
+	time.Sleep(r.delay)
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
@@ -42,6 +52,8 @@ func (r *TestResolver) LookupTXT(ctx context.Context, domain string) (txts []str
 }
 
 func (r *TestResolver) LookupMX(ctx context.Context, domain string) (mxs []*net.MX, err error) {
+	r.lookups["mx"]++
+	time.Sleep(r.delay)
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
@@ -51,6 +63,8 @@ func (r *TestResolver) LookupMX(ctx context.Context, domain string) (mxs []*net.
 }
 
 func (r *TestResolver) LookupIPAddr(ctx context.Context, host string) (as []net.IPAddr, err error) {
+	r.lookups["ip"]++
+	time.Sleep(r.delay)
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
@@ -68,6 +82,8 @@ func ipsToAddrs(ips []net.IP) []net.IPAddr {
 }
 
 func (r *TestResolver) LookupAddr(ctx context.Context, host string) (addrs []string, err error) {
+	r.lookups["addr"]++
+	time.Sleep(r.delay)
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
@@ -0,0 +1,136 @@
+package spf_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yeo/spf"
+)
+
+// Use DNS-over-TLS for the queries, by dialing a TLS connection to the
+// server from a net.Resolver.
+func ExampleWithResolver_dnsOverTLS() {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", "1.1.1.1:853")
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(conn,
+				&tls.Config{ServerName: "one.one.one.one"}), nil
+		},
+	}
+
+	res, err := spf.CheckHostWithSender(net.ParseIP("192.0.2.10"),
+		"mail.example.com", "user@example.com", spf.WithResolver(resolver))
+	fmt.Println(res, err)
+}
+
+// dohClient stands in for a DNS-over-HTTPS client library, with answers
+// given in the usual JSON API form. Query returns the data of the answers
+// of the given type.
+type dohClient struct {
+	answers map[string][]string
+}
+
+func (c *dohClient) Query(ctx context.Context, name, qtype string) ([]string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return c.answers[qtype+" "+name], nil
+}
+
+// dohResolver adapts a dohClient to the spf.DNSResolver interface.
+//
+// Errors should be returned as *net.DNSError, setting IsNotFound and
+// IsTemporary as appropriate, since they affect the result of the check.
+type dohResolver struct {
+	client *dohClient
+}
+
+func (r dohResolver) query(ctx context.Context, name, qtype string) ([]string, error) {
+	data, err := r.client.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, &net.DNSError{
+			Err: err.Error(), Name: name, IsTemporary: true}
+	}
+	if len(data) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+	return data, nil
+}
+
+func (r dohResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	data, err := r.query(ctx, name, "TXT")
+	for i, d := range data {
+		if s, err := strconv.Unquote(d); err == nil {
+			data[i] = s
+		}
+	}
+	return data, err
+}
+
+func (r dohResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	data, err := r.query(ctx, name, "MX")
+	mxs := []*net.MX{}
+	for _, d := range data {
+		// The data is in the form "<preference> <host>".
+		var mx net.MX
+		if _, err := fmt.Sscan(d, &mx.Pref, &mx.Host); err == nil {
+			mxs = append(mxs, &mx)
+		}
+	}
+	return mxs, err
+}
+
+func (r dohResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs := []net.IPAddr{}
+	var err error
+	for _, qtype := range []string{"A", "AAAA"} {
+		var data []string
+		data, err = r.query(ctx, host, qtype)
+		for _, d := range data {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(d)})
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	return nil, err
+}
+
+func (r dohResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		// Omitted for brevity: IPv6 reverse names use nibble format.
+		return nil, &net.DNSError{Err: "unsupported", Name: addr}
+	}
+	name := fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip[3], ip[2], ip[1], ip[0])
+	return r.query(ctx, name, "PTR")
+}
+
+// Use a DNS-over-HTTPS client for the queries, by adapting it to the
+// DNSResolver interface.
+func ExampleWithResolver_dnsOverHTTPS() {
+	client := &dohClient{answers: map[string][]string{
+		"TXT example.com":       {`"v=spf1 mx -all"`},
+		"MX example.com":        {"10 mail.example.com."},
+		"A mail.example.com":    {"192.0.2.10"},
+		"AAAA mail.example.com": {"2001:db8::10"},
+	}}
+	opt := spf.WithResolver(dohResolver{client})
+
+	for _, ip := range []string{"192.0.2.10", "2001:db8::10", "192.0.2.11"} {
+		res, _ := spf.CheckHostWithSender(net.ParseIP(ip),
+			"mail.example.com", "user@example.com", opt)
+		fmt.Println(ip, res)
+	}
+	// Output:
+	// 192.0.2.10 pass
+	// 2001:db8::10 pass
+	// 192.0.2.11 fail
+}
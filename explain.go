@@ -0,0 +1,213 @@
+package spf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Step is a single step of the evaluation, see WithEvaluationSteps.
+//
+// There are two kinds of steps: the evaluation of a domain's record (with
+// an empty Term), and the evaluation of one of the terms of that record,
+// which come after it.
+//
+// This is EXPERIMENTAL for now, and the fields are subject to change.
+type Step struct {
+	// Nesting level of the record: 0 for the top-level one, and one more
+	// for each include or redirect.
+	Depth int
+
+	// Domain whose record is being evaluated.
+	Domain string
+
+	// The record, for record steps. Empty if the domain has none.
+	Record string
+
+	// The term being evaluated (with its qualifier, as written), for term
+	// steps.
+	Term string
+
+	// DNS queries done in this step, like "MX example.com".
+	Queries []string
+
+	// Result of the step, if it ended the evaluation of the record (for
+	// term steps, if the term matched, or there was an error).
+	Result Result
+
+	// Error that came with the result, if any.
+	Err error
+}
+
+// WithEvaluationSteps is an option to collect the steps of the evaluation
+// in Details.Steps, which can then be rendered with Explain. It has a small
+// performance cost, so it is meant for diagnostics.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithEvaluationSteps() Option {
+	return func(r *resolution) {
+		r.collectSteps = true
+	}
+}
+
+// addStep adds a step to the details, if we are collecting them, and
+// returns its index; -1 otherwise.
+func (r *resolution) addStep(domain, term string) int {
+	if !r.collectSteps {
+		return -1
+	}
+	r.details.Steps = append(r.details.Steps,
+		Step{Depth: int(r.depth), Domain: domain, Term: term})
+	return len(r.details.Steps) - 1
+}
+
+// endStep sets the result of the step with the given index (if not -1).
+func (r *resolution) endStep(i int, res Result, err error) {
+	if i < 0 {
+		return
+	}
+	r.details.Steps[i].Result = res
+	r.details.Steps[i].Err = err
+}
+
+// QueryTime is the time a DNS query took, see WithQueryTimes.
+//
+// This is EXPERIMENTAL for now, and the fields are subject to change.
+type QueryTime struct {
+	// The query, like "MX example.com".
+	Query string
+
+	// Wall-clock time of the lookup, including any retries.
+	Time time.Duration
+}
+
+// WithQueryTimes is an option to measure the time of each DNS query done
+// during the evaluation, and return them in Details.QueryTimes and
+// Details.DNSTime. This is useful for monitoring, for example to find
+// which of the included domains have slow DNS servers.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithQueryTimes() Option {
+	return func(r *resolution) {
+		r.timeQueries = true
+	}
+}
+
+// addQuery records a DNS query in the latest step, if we are collecting
+// them; and starts measuring its time, if we are doing so. It must be
+// followed by a call to endQuery once the query is done.
+func (r *resolution) addQuery(qtype, name string) {
+	if r.timeQueries {
+		r.query = qtype + " " + name
+		r.queryStart = time.Now()
+	}
+	if !r.collectSteps || len(r.details.Steps) == 0 {
+		return
+	}
+	s := &r.details.Steps[len(r.details.Steps)-1]
+	s.Queries = append(s.Queries, qtype+" "+name)
+}
+
+// endQuery records the time of the query started by addQuery, if we are
+// measuring them.
+func (r *resolution) endQuery() {
+	if !r.timeQueries {
+		return
+	}
+	t := time.Since(r.queryStart)
+	r.details.QueryTimes = append(r.details.QueryTimes,
+		QueryTime{Query: r.query, Time: t})
+	r.details.DNSTime += t
+}
+
+// Explain renders the steps of an evaluation (collected with
+// WithEvaluationSteps) and its result as a human-readable report, like:
+//
+//	example.com: "v=spf1 include:_spf.example.net -all" -> pass
+//	  query TXT example.com
+//	  include:_spf.example.net -> pass
+//	    _spf.example.net: "v=spf1 ip4:192.0.2.0/24 -all" -> pass
+//	      query TXT _spf.example.net
+//	      ip4:192.0.2.0/24 -> pass  <== decision
+//	result: pass
+//
+// Records with more than one level of nesting are indented accordingly.
+// The term that decided the result is marked. Any warnings are included
+// at the end.
+//
+// The output is deterministic, and values that came from DNS are quoted if
+// they contain non-printable characters, so it is safe to log.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func Explain(res Result, details *Details) string {
+	// The term that decided is the last one with a result: the ones that
+	// include it come before it.
+	decision := -1
+	for i, s := range details.Steps {
+		if s.Term != "" && s.Result != "" {
+			decision = i
+		}
+	}
+
+	b := &strings.Builder{}
+	for i, s := range details.Steps {
+		level := 2 * s.Depth
+		if s.Term == "" {
+			line := safeString(s.Domain) + ": "
+			if s.Record == "" {
+				line += "no record"
+			} else {
+				line += fmt.Sprintf("%q", s.Record)
+			}
+			writeLine(b, level, line+stepResult(s))
+		} else {
+			level++
+			line := safeString(s.Term) + stepResult(s)
+			if i == decision {
+				line += "  <== decision"
+			}
+			writeLine(b, level, line)
+		}
+
+		for _, q := range s.Queries {
+			writeLine(b, level+1, "query "+safeString(q))
+		}
+	}
+
+	writeLine(b, 0, "result: "+string(res))
+	for _, w := range details.Warnings {
+		writeLine(b, 0, "warning: "+w)
+	}
+	return b.String()
+}
+
+// stepResult returns the textual result of the step, to be appended to
+// its line.
+func stepResult(s Step) string {
+	if s.Result == "" {
+		return ""
+	}
+	str := " -> " + string(s.Result)
+	if s.Err != nil && (s.Result == PermError || s.Result == TempError ||
+		s.Result == None) {
+		str += fmt.Sprintf(" (%v)", s.Err)
+	}
+	return str
+}
+
+func writeLine(b *strings.Builder, level int, line string) {
+	b.WriteString(strings.Repeat("  ", level))
+	b.WriteString(line)
+	b.WriteString("\n")
+}
+
+// safeString returns s as-is if it only has printable ASCII characters, or
+// quoted otherwise.
+func safeString(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return fmt.Sprintf("%q", s)
+		}
+	}
+	return s
+}
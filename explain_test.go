@@ -0,0 +1,77 @@
+package spf
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update_golden", false,
+	"update the golden files with the current output")
+
+func TestExplain(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 mx:mx include:inc1 -all"}
+	dns.mx["mx"] = []*net.MX{{Host: "mail"}}
+	dns.ip["mail"] = []net.IP{ip1110}
+	dns.txt["inc1"] = []string{"v=spf1 a:host include:inc2 ~all"}
+	dns.ip["host"] = []net.IP{ip6660}
+	dns.txt["inc2"] = []string{
+		"v=spf1 ip6:2001:db8::/32 ip4:1.1.1.0/24 -all"}
+
+	res, details, _ := CheckHostDetailed(ip1111, "helo", "user@domain",
+		WithEvaluationSteps())
+	got := Explain(res, details)
+
+	const fname = "testdata/explain.golden"
+	if *updateGolden {
+		if err := ioutil.WriteFile(fname, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("unexpected output, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExplainErrors(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 include:inc -all"}
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.1.1.1/99"}
+
+	res, details, _ := CheckHostDetailed(ip1111, "helo", "user@domain",
+		WithEvaluationSteps())
+	got := Explain(res, details)
+	want := `domain: "v=spf1 include:inc -all" -> permerror ` +
+		`(in inc: invalid mask "ip4:1.1.1.1/99")
+  query TXT domain
+  include:inc -> permerror (in inc: invalid mask "ip4:1.1.1.1/99")
+    inc: "v=spf1 ip4:1.1.1.1/99" -> permerror ` +
+		`(in inc: invalid mask "ip4:1.1.1.1/99")
+      query TXT inc
+      ip4:1.1.1.1/99 -> permerror ` +
+		`(in inc: invalid mask "ip4:1.1.1.1/99")  <== decision
+result: permerror
+`
+	if got != want {
+		t.Errorf("unexpected output, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Without the option, no steps are collected.
+	res, details, _ = CheckHostDetailed(ip1111, "helo", "user@domain")
+	if len(details.Steps) != 0 {
+		t.Errorf("unexpected steps: %v", details.Steps)
+	}
+	if got := Explain(res, details); got != "result: permerror\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+}
@@ -0,0 +1,65 @@
+//go:build go1.18
+// +build go1.18
+
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+// Zone used by the fuzz tests, which resolves some names so the records can
+// reference them.
+var fuzzZone = Zone{}.
+	TXT("inc", "v=spf1 ip4:1.1.1.1 -all").
+	TXT("redir", "v=spf1 a:d1111 ~all").
+	A("d1111", "1.1.1.1").
+	AAAA("d6666", "2001:db8::68").
+	MX("domain", "d1111", "d6666").
+	PTR("1.1.1.1", "d1111.").
+	PTR("2001:db8::68", "d6666.")
+
+func FuzzCheckRecord(f *testing.F) {
+	// Tracing is too slow for fuzzing.
+	trace = nullTrace
+
+	for _, txt := range []string{
+		"v=spf1 -all",
+		"v=spf1 ip4:1.1.1.1/24 ip6:2001:db8::/32 ~all",
+		"v=spf1 a mx ptr a:d1111/24//64 mx:domain//99 include:inc -all",
+		"v=spf1 exists:%{i}.%{l1r+-}.%{d2} redirect=redir",
+		"v=spf1 ip4:1.1.1.1/99999999999999999999 -",
+		"v=spf1 exp=%{p} foo=bar ?all",
+		"v=spf1 include:%{o}%{v}%{h}%{s}",
+		"V=SPF1 +A:%%%_%- ~MX",
+	} {
+		f.Add(txt)
+	}
+
+	ips := []net.IP{ip1111, ip6666}
+	f.Fuzz(func(t *testing.T, txt string) {
+		rec, err := Parse(txt)
+		if (rec == nil) == (err == nil) {
+			t.Errorf("Parse(%q) = %v, %v", txt, rec, err)
+		}
+		if rec != nil {
+			// The parsed record must be equivalent to its textual form.
+			if _, err := Parse(rec.String()); err != nil {
+				t.Errorf("Parse(%q) = %v (from %q)", rec.String(), err, txt)
+			}
+		}
+
+		for _, ip := range ips {
+			res, _, err := CheckRecord(ip, txt, "helo", "user@domain",
+				WithStubZone(fuzzZone))
+			if res.Severity() < 0 {
+				t.Errorf("CheckRecord(%v, %q) = unknown result %q",
+					ip, txt, res)
+			}
+			if (res == PermError || res == TempError) && err == nil {
+				t.Errorf("CheckRecord(%v, %q) = %v without error",
+					ip, txt, res)
+			}
+		}
+	})
+}
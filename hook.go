@@ -0,0 +1,80 @@
+package spf
+
+// MechanismEvent describes the evaluation of a mechanism, and is given to
+// the hook set with WithEvaluationHook.
+//
+// This is EXPERIMENTAL for now, and the fields are subject to change.
+type MechanismEvent struct {
+	// Domain whose record contains the mechanism.
+	Domain string
+
+	// The mechanism, with its qualifier, as written in the record.
+	Mechanism string
+
+	// Number of lookups done so far in the evaluation, as counted towards
+	// the limit.
+	Lookups uint
+
+	// False if the mechanism is about to be evaluated, true if it has
+	// been evaluated.
+	Done bool
+
+	// Whether the mechanism matched, and the result and error it ended the
+	// evaluation of the record with (only for events with Done set). A
+	// mechanism that results in PermError or TempError doesn't match, but
+	// still ends the evaluation.
+	Matched bool
+	Result  Result
+	Err     error
+}
+
+// WithEvaluationHook is an option to set a function that is called before
+// and after each mechanism is evaluated (including the ones in included
+// records), with structured information about it. It can be used for
+// telemetry, or to implement custom limits.
+//
+// If the hook returns an error, the evaluation is stopped before the next
+// mechanism, and the result is PermError with that error. Errors returned
+// after a mechanism that ended the evaluation are ignored.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithEvaluationHook(hook func(ev MechanismEvent) error) Option {
+	return func(r *resolution) {
+		r.hook = hook
+	}
+}
+
+// hookBefore calls the evaluation hook before evaluating the
+// mechanism.
+func (r *resolution) hookBefore(domain, mechanism string) error {
+	return r.hook(MechanismEvent{
+		Domain:    domain,
+		Mechanism: mechanism,
+		Lookups:   r.count,
+	})
+}
+
+// hookAfter calls the evaluation hook after evaluating the
+// mechanism. An empty result means it didn't end the evaluation.
+func (r *resolution) hookAfter(domain, mechanism string, res Result, err error) error {
+	return r.hook(MechanismEvent{
+		Domain:    domain,
+		Mechanism: mechanism,
+		Lookups:   r.count,
+		Done:      true,
+		Matched:   res != "" && res != PermError && res != TempError,
+		Result:    res,
+		Err:       err,
+	})
+}
+
+// hookNoMatch calls the evaluation hook after the mechanism in *hooked, if
+// any, was evaluated and didn't end the evaluation; and then clears it.
+func (r *resolution) hookNoMatch(domain string, hooked *string) error {
+	if *hooked == "" {
+		return nil
+	}
+	mechanism := *hooked
+	*hooked = ""
+	return r.hookAfter(domain, mechanism, "", nil)
+}
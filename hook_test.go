@@ -0,0 +1,80 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvaluationHook(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{
+		"v=spf1 ip4:1.2.3.4 include:inc a:host exp=blah ~all"}
+	dns.txt["inc"] = []string{"v=spf1 mx -all"}
+	dns.mx["inc"] = []*net.MX{mx("mx", 10)}
+	dns.ip["host"] = []net.IP{ip1111}
+
+	events := []string{}
+	hook := func(ev MechanismEvent) error {
+		s := fmt.Sprintf("%s %s %d", ev.Domain, ev.Mechanism, ev.Lookups)
+		if ev.Done {
+			s += fmt.Sprintf(" -> %v %v %v", ev.Matched, ev.Result, ev.Err)
+		}
+		events = append(events, s)
+		return nil
+	}
+
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithEvaluationHook(hook))
+	if res != Pass || err != errMatchedA {
+		t.Errorf("expected pass/matched a, got %v/%v", res, err)
+	}
+
+	expected := []string{
+		"domain ip4:1.2.3.4 1",
+		"domain ip4:1.2.3.4 1 -> false  <nil>",
+		"domain include:inc 1",
+		"inc mx 2",
+		"inc mx 3 -> false  <nil>",
+		"inc -all 3",
+		"inc -all 3 -> true fail matched 'all'",
+		"domain include:inc 3 -> false  <nil>",
+		"domain a:host 3",
+		"domain a:host 4 -> true pass matched 'a'",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events:\n%s\nexpected:\n%s",
+			strings.Join(events, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// An error from the hook aborts the evaluation.
+	events = []string{}
+	limit := func(ev MechanismEvent) error {
+		hook(ev)
+		if !ev.Done && ev.Domain != "domain" {
+			return errLoop
+		}
+		return nil
+	}
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithEvaluationHook(limit))
+	if res != PermError || err != errLoop {
+		t.Errorf("expected permerror/loop, got %v/%v", res, err)
+	}
+	if n := len(events); n != 5 {
+		t.Errorf("expected 5 events, got %d: %q", n, events)
+	}
+
+	// Records with only ips also get the events.
+	events = []string{}
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	res, _ = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithEvaluationHook(hook))
+	if res != Pass || len(events) != 2 {
+		t.Errorf("expected pass and 2 events, got %v %q", res, events)
+	}
+}
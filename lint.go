@@ -0,0 +1,293 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Report contains the problems found in an SPF record, see Lint and
+// ValidateDomain.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type Report struct {
+	// Domain the record was fetched from (only set by ValidateDomain).
+	Domain string
+
+	// The SPF record that was checked.
+	Record string
+
+	// Is the record syntactically valid? If it is not, the record will
+	// result in PermError when evaluated.
+	Valid bool
+
+	// Number of DNS lookups needed to evaluate the record, as counted for
+	// the lookup limit. Lint only counts the mechanisms in the record
+	// itself, ValidateDomain also follows includes and redirects.
+	Lookups uint
+
+	// Errors and warnings found, as human-readable messages.
+	Errors   []string
+	Warnings []string
+}
+
+func (rep *Report) errorf(format string, a ...interface{}) {
+	rep.Errors = append(rep.Errors, fmt.Sprintf(format, a...))
+}
+
+func (rep *Report) warnf(format string, a ...interface{}) {
+	rep.Warnings = append(rep.Warnings, fmt.Sprintf(format, a...))
+}
+
+// Lint checks the given SPF record for problems, without doing any DNS
+// queries.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func Lint(txt string) *Report {
+	rep := &Report{Record: txt}
+	lintSize(rep, txt)
+
+	fields := strings.Fields(txt)
+	if len(fields) == 0 || strings.ToLower(fields[0]) != "v=spf1" {
+		rep.errorf("%v", errInvalidVersion)
+		return rep
+	}
+
+	// Fields that cause DNS lookups.
+	lookups := []string{}
+	seenAll := false
+
+	// Mechanisms that can be evaluated (the ones before "all").
+	mechs := []*Mechanism{}
+	for _, field := range fields[1:] {
+		mech, mod, err := parseTerm(field)
+		if err != nil {
+			rep.errorf("%q: %v", field, err)
+			continue
+		}
+
+		// Mechanisms after "all" are never evaluated.
+		// https://tools.ietf.org/html/rfc7208#section-5.1
+		if mech != nil && seenAll {
+			rep.warnf("%q: mechanism after \"all\", it will never be "+
+				"evaluated", field)
+		}
+		if mech != nil && !seenAll {
+			mechs = append(mechs, mech)
+		}
+		if mech != nil && mech.Name == "all" {
+			seenAll = true
+		}
+
+		if mod != nil {
+			if mod.Name == "redirect" {
+				lookups = append(lookups, field)
+			} else if mod.Name != "exp" {
+				rep.warnf("%q: unknown modifier, it will be ignored", field)
+			}
+			continue
+		}
+
+		switch mech.Name {
+		case "ptr":
+			rep.warnf("%q: the ptr mechanism should not be used", field)
+			lookups = append(lookups, field)
+		case "include", "a", "mx", "exists":
+			lookups = append(lookups, field)
+		}
+	}
+
+	if len(txt) <= maxRecordLength {
+		lintOverlaps(rep, mechs)
+	}
+
+	// Too many lookups in the record itself, regardless of what the
+	// referenced records contain, will result in PermError.
+	// https://tools.ietf.org/html/rfc7208#section-4.6.4
+	rep.Lookups = uint(len(lookups))
+	if rep.Lookups > defaultMaxLookups {
+		rep.errorf("too many DNS lookups in the record itself (%d), "+
+			"the limit is %d, it will result in PermError: %s",
+			rep.Lookups, defaultMaxLookups, strings.Join(lookups, " "))
+	}
+
+	rep.Valid = len(rep.Errors) == 0
+	return rep
+}
+
+// lintOverlaps warns about ip4 and ip6 mechanisms whose range is contained
+// in the one of another, so they can be removed without changing the
+// result. That is the case if the other one comes before it, or if it comes
+// after it with the same qualifier, and there are no other qualifiers in
+// between. See CoalesceIPs to remove them.
+func lintOverlaps(rep *Report, mechs []*Mechanism) {
+	nets := make([]*net.IPNet, len(mechs))
+	for i, m := range mechs {
+		if m.Name == "ip4" || m.Name == "ip6" {
+			nets[i] = m.ipNet()
+		}
+	}
+
+	for i, m := range mechs {
+		if nets[i] == nil {
+			continue
+		}
+		for j, o := range mechs {
+			if i == j || o.Name != m.Name || !netContains(nets[j], nets[i]) {
+				continue
+			}
+			// A later range only makes this one redundant if nothing in
+			// between can give a different result. If they are the same
+			// range, the later one is the redundant one.
+			if j > i && (o.Qualifier != m.Qualifier ||
+				mixedQualifiers(mechs[i:j+1]) ||
+				netContains(nets[i], nets[j])) {
+				continue
+			}
+			rep.warnf("%q: range is contained in %q, it is redundant",
+				m.String(), o.String())
+			break
+		}
+	}
+}
+
+// mixedQualifiers returns true if the mechanisms don't all have the same
+// qualifier.
+func mixedQualifiers(mechs []*Mechanism) bool {
+	for _, m := range mechs {
+		if m.Qualifier != mechs[0].Qualifier {
+			return true
+		}
+	}
+	return false
+}
+
+// Size limits for records, see lintSize.
+const (
+	// Maximum length of a TXT character-string.
+	// https://tools.ietf.org/html/rfc1035#section-3.3.14
+	maxTXTStringLength = 255
+
+	// Recommended maximum length of a record, so the answer fits in a
+	// 512-byte UDP response and there is no need to fall back to TCP.
+	// https://tools.ietf.org/html/rfc7208#section-3.4
+	recommendedRecordLength = 450
+)
+
+// lintSize checks the size of the record against the DNS limits.
+func lintSize(rep *Report, txt string) {
+	if len(txt) > maxRecordLength {
+		rep.errorf("record is too long (%d bytes), the limit is %d",
+			len(txt), maxRecordLength)
+		return
+	}
+	if len(txt) > maxTXTStringLength {
+		rep.warnf("record is longer than %d bytes (%d bytes), it needs "+
+			"to be published as multiple strings",
+			maxTXTStringLength, len(txt))
+	}
+	if len(txt) > recommendedRecordLength {
+		rep.warnf("record is longer than the recommended %d bytes "+
+			"(%d bytes), it may not fit in a UDP response",
+			recommendedRecordLength, len(txt))
+	}
+}
+
+// ValidateDomain fetches the SPF record of the given domain and checks it
+// for problems, without evaluating it against any IP address. The records
+// of includes and redirects are fetched and checked too, and they are taken
+// into account for the lookup count.
+//
+// An error is returned if the domain's record could not be fetched.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func ValidateDomain(domain string, opts ...Option) (*Report, error) {
+	r := newResolution(nil, "@"+domain, opts)
+	txt, err := r.getDNSRecord(domain)
+	if err != nil {
+		return nil, err
+	}
+	if txt == "" {
+		return nil, errNoResult
+	}
+
+	rep := Lint(txt)
+	rep.Domain = domain
+	overLimit := rep.Lookups > defaultMaxLookups
+	if rep.Valid {
+		r.validateReferenced(rep, txt, "", map[string]bool{domain: true})
+	}
+
+	// Lint already reports it as an error if the record alone is over the
+	// limit.
+	if rep.Lookups > r.maxcount && !overLimit {
+		rep.warnf("too many DNS lookups (%d), the limit is %d",
+			rep.Lookups, r.maxcount)
+	}
+	rep.Valid = len(rep.Errors) == 0
+	return rep, nil
+}
+
+// validateReferenced fetches and checks the records referenced by the given
+// one via include and redirect, recursively, adding the problems and the
+// lookups to the report. The messages are prefixed with the given prefix,
+// which describes the chain of references that lead to this record.
+func (r *resolution) validateReferenced(rep *Report, txt, prefix string, seen map[string]bool) {
+	rec, err := Parse(txt)
+	if err != nil {
+		return
+	}
+
+	// Fields referencing other records, and their targets.
+	fields, targets := []string{}, []string{}
+	for _, m := range rec.Mechanisms {
+		if m.Name == "include" {
+			fields = append(fields, m.String())
+			targets = append(targets, m.Value)
+		}
+	}
+	for _, m := range rec.Modifiers {
+		if m.Name == "redirect" {
+			fields = append(fields, m.String())
+			targets = append(targets, m.Value)
+		}
+	}
+
+	for i, target := range targets {
+		fprefix := fmt.Sprintf("%s%q: ", prefix, fields[i])
+		if strings.Contains(target, "%") {
+			rep.warnf("%starget has macros, can't be checked statically",
+				fprefix)
+			continue
+		}
+		if seen[strings.ToLower(target)] {
+			rep.errorf("%sloop in the record references", fprefix)
+			continue
+		}
+
+		txt, err := r.getDNSRecord(target)
+		if err != nil {
+			rep.errorf("%serror fetching record: %v", fprefix, err)
+			continue
+		}
+		if txt == "" {
+			rep.errorf("%s%v", fprefix, errNoResult)
+			continue
+		}
+
+		sub := Lint(txt)
+		for _, e := range sub.Errors {
+			rep.errorf("%s%s", fprefix, e)
+		}
+		for _, w := range sub.Warnings {
+			rep.warnf("%s%s", fprefix, w)
+		}
+		rep.Lookups += sub.Lookups
+
+		if sub.Valid {
+			seen[strings.ToLower(target)] = true
+			r.validateReferenced(rep, txt, fprefix, seen)
+			delete(seen, strings.ToLower(target))
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package spf
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	rep := Lint("v=spf1 include:d1 ip4:1.2.3.4/40 ptr blah foo=bar -all")
+	exp := &Report{
+		Record:  "v=spf1 include:d1 ip4:1.2.3.4/40 ptr blah foo=bar -all",
+		Valid:   false,
+		Lookups: 2,
+		Errors: []string{
+			`"ip4:1.2.3.4/40": invalid mask`,
+			`"blah": unknown field`,
+		},
+		Warnings: []string{
+			`"ptr": the ptr mechanism should not be used`,
+			`"foo=bar": unknown modifier, it will be ignored`,
+		},
+	}
+	if !reflect.DeepEqual(rep, exp) {
+		t.Errorf("expected %+v, got %+v", exp, rep)
+	}
+
+	rep = Lint("v=spf1 a mx -all")
+	if !rep.Valid || rep.Lookups != 2 || rep.Errors != nil || rep.Warnings != nil {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+
+	rep = Lint("v=spf1 a -all mx exp=x ~all")
+	exp = &Report{
+		Record:  "v=spf1 a -all mx exp=x ~all",
+		Valid:   true,
+		Lookups: 2,
+		Warnings: []string{
+			`"mx": mechanism after "all", it will never be evaluated`,
+			`"~all": mechanism after "all", it will never be evaluated`,
+		},
+	}
+	if !reflect.DeepEqual(rep, exp) {
+		t.Errorf("expected %+v, got %+v", exp, rep)
+	}
+
+	rep = Lint("lalala")
+	if rep.Valid || len(rep.Errors) != 1 {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+}
+
+func TestValidateDomain(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 include:d1 a redirect=d2"}
+	dns.txt["d1"] = []string{"v=spf1 mx include:%{d}.d1 -all"}
+	dns.txt["d2"] = []string{"v=spf1 include:d3 include:nospf"}
+	dns.txt["d3"] = []string{"v=spf1 include:d1 include:domain ip4:1.2.3.4/99"}
+
+	rep, err := ValidateDomain("domain")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := &Report{
+		Domain:  "domain",
+		Record:  "v=spf1 include:d1 a redirect=d2",
+		Valid:   false,
+		Lookups: 9,
+		Errors: []string{
+			`"redirect=d2": "include:d3": "ip4:1.2.3.4/99": invalid mask`,
+			`"redirect=d2": "include:nospf": no DNS record found`,
+		},
+		Warnings: []string{
+			`"include:d1": "include:%{d}.d1": target has macros, ` +
+				`can't be checked statically`,
+		},
+	}
+	if !reflect.DeepEqual(rep, exp) {
+		t.Errorf("expected %+v, got %+v", exp, rep)
+	}
+
+	// A loop, and too many lookups.
+	dns.txt["domain"] = []string{"v=spf1 include:d1 include:d1 " +
+		"a a a a a a a a"}
+	dns.txt["d1"] = []string{"v=spf1 include:domain"}
+	rep, err = ValidateDomain("domain")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp = &Report{
+		Domain:  "domain",
+		Record:  "v=spf1 include:d1 include:d1 a a a a a a a a",
+		Valid:   false,
+		Lookups: 12,
+		Errors: []string{
+			`"include:d1": "include:domain": loop in the record references`,
+			`"include:d1": "include:domain": loop in the record references`,
+		},
+		Warnings: []string{
+			"too many DNS lookups (12), the limit is 10",
+		},
+	}
+	if !reflect.DeepEqual(rep, exp) {
+		t.Errorf("expected %+v, got %+v", exp, rep)
+	}
+
+	// Domains without records, or errors.
+	dns.errors["broken"] = fmt.Errorf("test error")
+	for _, domain := range []string{"nospf", "broken"} {
+		rep, err = ValidateDomain(domain)
+		if rep != nil || err == nil {
+			t.Errorf("%q: expected error, got %+v / %v", domain, rep, err)
+		}
+	}
+}
+
+func TestLintStaticLookupLimit(t *testing.T) {
+	txt := "v=spf1 include:d1 include:d2 include:d3 a mx exists:d9 exists:d4 " +
+		"a:d5 mx:d6 include:d7 ip4:1.2.3.4 redirect=d8"
+	rep := Lint(txt)
+	exp := []string{
+		"too many DNS lookups in the record itself (11), the limit is 10, " +
+			"it will result in PermError: include:d1 include:d2 include:d3 " +
+			"a mx exists:d9 exists:d4 a:d5 mx:d6 include:d7 redirect=d8",
+	}
+	if rep.Valid || rep.Lookups != 11 || !reflect.DeepEqual(rep.Errors, exp) {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+
+	// Exactly at the limit is fine.
+	rep = Lint("v=spf1 a a a a a a a a a a -all")
+	if !rep.Valid || rep.Lookups != 10 || rep.Errors != nil {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+
+	// ValidateDomain reports it only once.
+	dns := NewDefaultResolver()
+	dns.txt["domain"] = []string{txt}
+	rep, err := ValidateDomain("domain")
+	if err != nil || !reflect.DeepEqual(rep.Errors, exp) ||
+		rep.Warnings != nil {
+		t.Errorf("unexpected report: %+v (%v)", rep, err)
+	}
+}
+
+func TestLintSize(t *testing.T) {
+	record := func(n int) string {
+		// Use different addresses, so they're not redundant.
+		txt := "v=spf1 ip4:1.2.3.4"
+		for i := 0; len(txt)+12 <= n-5; i++ {
+			txt += fmt.Sprintf(" ip6:1::%04x", i)
+		}
+		return txt + strings.Repeat(" ", n-5-len(txt)) + " -all"
+	}
+
+	cases := []struct {
+		len    int
+		valid  bool
+		nwarns int
+	}{
+		{255, true, 0},
+		{256, true, 1},
+		{450, true, 1},
+		{451, true, 2},
+		{65536, false, 0},
+	}
+	for _, c := range cases {
+		txt := record(c.len)
+		if len(txt) != c.len {
+			t.Fatalf("bad test record length: %d != %d", len(txt), c.len)
+		}
+		rep := Lint(txt)
+		if rep.Valid != c.valid || len(rep.Warnings) != c.nwarns {
+			t.Errorf("%d: unexpected report: %v %q %q",
+				c.len, rep.Valid, rep.Errors, rep.Warnings)
+		}
+	}
+
+	rep := Lint(record(500))
+	exp := []string{
+		"record is longer than 255 bytes (500 bytes), it needs to be " +
+			"published as multiple strings",
+		"record is longer than the recommended 450 bytes (500 bytes), " +
+			"it may not fit in a UDP response",
+	}
+	if !reflect.DeepEqual(rep.Warnings, exp) {
+		t.Errorf("expected warnings %q, got %q", exp, rep.Warnings)
+	}
+}
+
+func TestLintOverlaps(t *testing.T) {
+	cases := []struct {
+		txt      string
+		warnings []string
+	}{
+		// Contained.
+		{"v=spf1 ip4:192.0.2.0/24 ip4:192.0.2.128/25 -all", []string{
+			`"ip4:192.0.2.128/25": range is contained in ` +
+				`"ip4:192.0.2.0/24", it is redundant`}},
+		{"v=spf1 ip4:192.0.2.128/25 ip4:192.0.2.0/24 -all", []string{
+			`"ip4:192.0.2.128/25": range is contained in ` +
+				`"ip4:192.0.2.0/24", it is redundant`}},
+		{"v=spf1 ip4:192.0.2.1 ip4:192.0.2.1 -all", []string{
+			`"ip4:192.0.2.1": range is contained in ` +
+				`"ip4:192.0.2.1", it is redundant`}},
+		{"v=spf1 ip6:2001:db8::/32 ip6:2001:db8::1 -all", []string{
+			`"ip6:2001:db8::1": range is contained in ` +
+				`"ip6:2001:db8::/32", it is redundant`}},
+		{"v=spf1 -ip4:192.0.2.0/24 ip4:192.0.2.1 -all", []string{
+			`"ip4:192.0.2.1": range is contained in ` +
+				`"-ip4:192.0.2.0/24", it is redundant`}},
+
+		// Contained, but not redundant: the smaller range is an exception
+		// to the larger one.
+		{"v=spf1 -ip4:192.0.2.1 ip4:192.0.2.0/24 -all", nil},
+		{"v=spf1 ip4:192.0.2.1 -a ip4:192.0.2.0/24 -all", nil},
+
+		// Adjacent.
+		{"v=spf1 ip4:192.0.2.0/25 ip4:192.0.2.128/25 -all", nil},
+
+		// Disjoint.
+		{"v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 -all", nil},
+		{"v=spf1 ip4:0.0.0.0/0 ip6:::/0 -all", nil},
+
+		// After "all", they are reported as never evaluated instead.
+		{"v=spf1 ip4:192.0.2.0/24 -all ip4:192.0.2.1", []string{
+			`"ip4:192.0.2.1": mechanism after "all", it will never be ` +
+				`evaluated`}},
+	}
+	for _, c := range cases {
+		rep := Lint(c.txt)
+		if !rep.Valid || !reflect.DeepEqual(rep.Warnings, c.warnings) {
+			t.Errorf("%q: expected warnings %q, got %+v",
+				c.txt, c.warnings, rep)
+		}
+	}
+}
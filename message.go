@@ -0,0 +1,68 @@
+package spf
+
+import "net"
+
+// MessageResult contains the results of checking both identities of a
+// message, see CheckMessage.
+//
+// This is EXPERIMENTAL for now, and the fields are subject to change.
+type MessageResult struct {
+	// Result of checking the HELO identity, and the associated error.
+	HeloResult Result
+	HeloErr    error
+
+	// Result of checking the MAIL FROM identity, and the associated error.
+	MailFromResult Result
+	MailFromErr    error
+
+	// Recommended decision: the HELO result if it is a definitive one (Pass,
+	// Fail or SoftFail), and the MAIL FROM result otherwise.
+	// https://tools.ietf.org/html/rfc7208#section-2.3
+	Combined Result
+}
+
+// CheckMessage checks both the HELO and the MAIL FROM identities of a
+// message coming from `ip`, as recommended by the RFC, and returns both
+// results, and a combined one (see MessageResult.Combined).
+//
+// If `mailFrom` is empty (the null sender), the MAIL FROM identity is
+// "postmaster@" + `helo`. If it has no domain part, `helo` is used as the
+// domain.
+//
+// The DNS answers are shared between both checks, so common queries are only
+// done once.
+//
+// https://tools.ietf.org/html/rfc7208#section-2.3
+// https://tools.ietf.org/html/rfc7208#section-2.4
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CheckMessage(ip net.IP, helo, mailFrom string, opts ...Option) *MessageResult {
+	var cache DNSResolver
+	check := func(sender, domain string) (Result, error) {
+		trace("check message %q %q %q", ip, sender, domain)
+		r := newResolution(ip, sender, opts)
+		if cache == nil {
+			cache = newCachingResolver(r.resolver)
+		}
+		r.resolver = cache
+		return r.checkTopLevel(domain)
+	}
+
+	if mailFrom == "" {
+		mailFrom = "postmaster@" + helo
+	}
+	_, domain := split(mailFrom)
+	if domain == "" {
+		domain = helo
+	}
+
+	mr := &MessageResult{}
+	mr.HeloResult, mr.HeloErr = check("postmaster@"+helo, helo)
+	mr.MailFromResult, mr.MailFromErr = check(mailFrom, domain)
+	mr.Combined = mr.MailFromResult
+	switch mr.HeloResult {
+	case Pass, Fail, SoftFail:
+		mr.Combined = mr.HeloResult
+	}
+	return mr
+}
@@ -0,0 +1,51 @@
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckMessage(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["helo"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.0 ~all"}
+
+	cases := []struct {
+		ip                string
+		helo, mailFrom    string
+		heloRes, mfromRes Result
+		combined          Result
+	}{
+		// Null sender: both identities are the HELO one.
+		{"1.1.1.1", "helo", "", Pass, Pass, Pass},
+
+		// A HELO result of Pass, Fail or SoftFail is definitive.
+		{"1.1.1.1", "helo", "user@domain", Pass, SoftFail, Pass},
+		{"1.1.1.0", "helo", "user@domain", Fail, Pass, Fail},
+
+		// No domain part in the MAIL FROM.
+		{"1.1.1.1", "helo", "postmaster", Pass, Pass, Pass},
+
+		// HELO has no record, so the MAIL FROM result is used.
+		{"1.1.1.1", "nospf", "user@helo", None, Pass, Pass},
+		{"1.1.1.2", "nospf", "user@domain", None, SoftFail, SoftFail},
+	}
+	for _, c := range cases {
+		dns.lookups = map[string]int{}
+		mr := CheckMessage(net.ParseIP(c.ip), c.helo, c.mailFrom)
+		if mr.HeloResult != c.heloRes || mr.MailFromResult != c.mfromRes ||
+			mr.Combined != c.combined {
+			t.Errorf("%s %q %q: expected %v/%v/%v, got %+v", c.ip, c.helo,
+				c.mailFrom, c.heloRes, c.mfromRes, c.combined, mr)
+		}
+	}
+
+	// The null sender case only looks up the record once.
+	dns.lookups = map[string]int{}
+	CheckMessage(ip1111, "helo", "")
+	if n := dns.lookups["txt"]; n != 1 {
+		t.Errorf("expected 1 txt lookup, got %d", n)
+	}
+}
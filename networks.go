@@ -0,0 +1,235 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	errNotStatic = fmt.Errorf(
+		"depends on the sender or the ip, can't be resolved statically")
+	errLoop = fmt.Errorf("loop in the record references")
+)
+
+// AuthorizedNetworks returns the networks that the domain's SPF policy
+// authorizes, that is, the ones for which the check would result in Pass.
+// The records referenced via include and redirect are followed, and the a
+// and mx mechanisms are resolved, so this is like flattening the record
+// into a list of networks. They are returned coalesced and sorted.
+//
+// Only the mechanisms that result in Pass add to the networks; the others
+// (like "-all") are ignored. Note that mechanisms with other qualifiers are
+// not subtracted either, so if one comes first and overlaps (like in
+// "v=spf1 -ip4:192.0.2.1 ip4:192.0.2.0/24"), the result includes addresses
+// that would not pass.
+//
+// An error is returned if the policy can't be represented as networks,
+// because it uses ptr, exists or macros; and also if the record can't be
+// fetched or parsed, there are loops, or it goes over the lookup limit.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func AuthorizedNetworks(domain string, opts ...Option) ([]net.IPNet, error) {
+	r := newResolution(nil, "@"+domain, opts)
+	nets := []*net.IPNet{}
+	_, err := r.walkNets(domain, map[string]bool{}, func(n *net.IPNet) bool {
+		nets = append(nets, n)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := []string{}
+	out := []net.IPNet{}
+	for _, n := range coalesceNets(nets, &report) {
+		out = append(out, *n)
+	}
+	return out, nil
+}
+
+// WalkAuthorizedNetworks is like AuthorizedNetworks, but instead of
+// returning the networks, it calls fn with each of them as they are found.
+// If fn returns false, the walk stops, and no more DNS queries are done.
+// This is useful for very large policies, to process the networks without
+// holding all of them in memory.
+//
+// The networks are given in the order they appear in the records (with
+// includes and redirects expanded in place), and they are not coalesced,
+// so they can overlap. If there is an error, fn may have been called with
+// some networks already; they should be discarded, since the policy can't
+// be represented as networks.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WalkAuthorizedNetworks(domain string, fn func(n net.IPNet) bool, opts ...Option) error {
+	r := newResolution(nil, "@"+domain, opts)
+	_, err := r.walkNets(domain, map[string]bool{}, func(n *net.IPNet) bool {
+		return fn(*n)
+	})
+	return err
+}
+
+// walkNets calls yield with the networks authorized by the domain's record,
+// see WalkAuthorizedNetworks. The seen map contains the domains being
+// evaluated, to detect loops. It returns false if yield stopped the walk.
+func (r *resolution) walkNets(domain string, seen map[string]bool, yield func(*net.IPNet) bool) (bool, error) {
+	ldomain := strings.ToLower(domain)
+	if seen[ldomain] {
+		return false, errLoop
+	}
+	seen[ldomain] = true
+	defer delete(seen, ldomain)
+
+	txt, err := r.getDNSRecord(domain)
+	if err != nil {
+		return false, err
+	}
+	if txt == "" {
+		return false, errNoResult
+	}
+	rec, err := Parse(txt)
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range rec.Mechanisms {
+		if m.Name == "all" {
+			// Nothing after "all" is evaluated, including redirect.
+			if m.Qualifier == Pass {
+				all4 := &net.IPNet{
+					IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+				all6 := &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+				return yield(all4) && yield(all6), nil
+			}
+			return true, nil
+		}
+		if m.Qualifier != Pass {
+			continue
+		}
+
+		cont, err := r.mechanismNets(domain, m, seen, yield)
+		if err != nil {
+			return false, &FieldError{domain, m.String(), err}
+		}
+		if !cont {
+			return false, nil
+		}
+	}
+
+	if target, ok := rec.Modifier("redirect"); ok {
+		if strings.Contains(target, "%") {
+			return false, &FieldError{domain, "redirect=" + target, errNotStatic}
+		}
+		err := r.countLookup()
+		cont := false
+		if err == nil {
+			cont, err = r.walkNets(target, seen, yield)
+		}
+		if err != nil {
+			return false, &FieldError{domain, "redirect=" + target, err}
+		}
+		return cont, nil
+	}
+
+	return true, nil
+}
+
+// mechanismNets calls yield with the networks that the mechanism (of the
+// domain's record) matches. It returns false if yield stopped the walk.
+func (r *resolution) mechanismNets(domain string, m Mechanism, seen map[string]bool, yield func(*net.IPNet) bool) (bool, error) {
+	if strings.Contains(m.Value, "%") {
+		return false, errNotStatic
+	}
+	target := m.Value
+	if target == "" {
+		target = domain
+	}
+
+	if m.Name == "ip4" || m.Name == "ip6" {
+		return yield(m.ipNet()), nil
+	}
+	if err := r.countLookup(); err != nil {
+		return false, err
+	}
+
+	switch m.Name {
+	case "include":
+		return r.walkNets(target, seen, yield)
+	case "a":
+		return r.yieldHostNets(target, m, yield)
+	case "mx":
+		mxs, err := r.resolver.LookupMX(r.ctx, target)
+		if err != nil && r.temporary(err) {
+			return false, err
+		}
+		if r.tooManyAnswers(len(mxs)) {
+			return false, errTooManyAnswers
+		}
+		if len(mxs) > 10 {
+			return false, errTooManyMXRecords
+		}
+
+		// The address lookups don't count towards the limit, see mxField.
+		for _, mx := range byPreference(mxs) {
+			cont, err := r.yieldHostNets(mx.Host, m, yield)
+			if err != nil || !cont {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	// ptr and exists.
+	return false, errNotStatic
+}
+
+// yieldHostNets calls yield with each of the networks of hostNets. It
+// returns false if yield stopped the walk.
+func (r *resolution) yieldHostNets(host string, m Mechanism, yield func(*net.IPNet) bool) (bool, error) {
+	nets, err := r.hostNets(host, m)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range nets {
+		if !yield(n) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// hostNets returns the networks of the host's addresses, with the masks of
+// the given a or mx mechanism.
+func (r *resolution) hostNets(host string, m Mechanism) ([]*net.IPNet, error) {
+	addrs, err := r.resolver.LookupIPAddr(r.ctx, host)
+	if err != nil && r.temporary(err) {
+		return nil, err
+	}
+	if r.tooManyAnswers(len(addrs)) {
+		return nil, errTooManyAnswers
+	}
+
+	nets := []*net.IPNet{}
+	for _, addr := range addrs {
+		ip, mask, bits := addr.IP.To4(), m.Mask4, 32
+		if ip == nil {
+			ip, mask, bits = addr.IP, m.Mask6, 128
+		}
+		if mask < 0 {
+			mask = bits
+		}
+		cidr := net.CIDRMask(mask, bits)
+		nets = append(nets, &net.IPNet{IP: ip.Mask(cidr), Mask: cidr})
+	}
+	return nets, nil
+}
+
+// countLookup counts a DNS lookup for a mechanism or modifier, and returns
+// an error if it goes over the limit.
+func (r *resolution) countLookup() error {
+	r.count++
+	if r.count > r.maxcount {
+		return errLookupLimitReached
+	}
+	return nil
+}
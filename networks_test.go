@@ -0,0 +1,169 @@
+package spf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAuthorizedNetworks(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{
+		"v=spf1 ip4:192.0.2.0/25 a a:host/24 -ip4:198.51.100.0/24 " +
+			"include:inc ~mx:other mx//64 -all ip4:203.0.113.1"}
+	dns.ip["domain"] = []net.IP{net.ParseIP("192.0.2.200")}
+	dns.ip["host"] = []net.IP{
+		net.ParseIP("192.0.2.130"), net.ParseIP("2001:db8::1")}
+	dns.txt["inc"] = []string{"v=spf1 ip4:192.0.2.128/26 redirect=red"}
+	dns.txt["red"] = []string{"v=spf1 ip6:2001:db8:1::/48"}
+	dns.mx["domain"] = []*net.MX{{Host: "mail"}, {Host: "nothing"}}
+	dns.ip["mail"] = []net.IP{net.ParseIP("2001:db8:2::1")}
+
+	nets, err := AuthorizedNetworks("domain")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := []string{}
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	exp := []string{
+		// 192.0.2.0/25, 192.0.2.128/26 and 192.0.2.200 are coalesced
+		// into the /24 from "a:host/24".
+		"192.0.2.0/24",
+		"2001:db8::1/128",
+		"2001:db8:1::/48",
+		"2001:db8:2::/64",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %q, got %q", exp, got)
+	}
+
+	// +all authorizes everything.
+	dns.txt["domain"] = []string{"v=spf1 ip4:192.0.2.1 +all"}
+	nets, err = AuthorizedNetworks("domain")
+	if err != nil || len(nets) != 2 || nets[0].String() != "0.0.0.0/0" ||
+		nets[1].String() != "::/0" {
+		t.Errorf("unexpected result: %v %v", nets, err)
+	}
+}
+
+func TestWalkAuthorizedNetworks(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{
+		"v=spf1 ip4:192.0.2.0/25 a:host include:inc mx -all"}
+	dns.ip["host"] = []net.IP{
+		net.ParseIP("192.0.2.130"), net.ParseIP("2001:db8::1")}
+	dns.txt["inc"] = []string{"v=spf1 ip4:192.0.2.128/26 redirect=red"}
+	dns.txt["red"] = []string{"v=spf1 ip6:2001:db8:1::/48"}
+	dns.mx["domain"] = []*net.MX{{Host: "mail"}}
+	dns.ip["mail"] = []net.IP{net.ParseIP("2001:db8:2::1")}
+
+	// All the networks, in the order they are found, without coalescing.
+	all := []string{
+		"192.0.2.0/25",
+		"192.0.2.130/32",
+		"2001:db8::1/128",
+		"192.0.2.128/26",
+		"2001:db8:1::/48",
+		"2001:db8:2::1/128",
+	}
+	got := []string{}
+	err := WalkAuthorizedNetworks("domain", func(n net.IPNet) bool {
+		got = append(got, n.String())
+		return true
+	})
+	if err != nil || !reflect.DeepEqual(got, all) {
+		t.Errorf("expected %q, got %q (%v)", all, got, err)
+	}
+
+	// Stopping early, at each of the networks: no more DNS queries are
+	// done after that.
+	lookups := []int{1, 2, 2, 3, 4, 6}
+	for i := range all {
+		dns.lookups = map[string]int{}
+		got = []string{}
+		err := WalkAuthorizedNetworks("domain", func(n net.IPNet) bool {
+			got = append(got, n.String())
+			return len(got) <= i
+		})
+		if err != nil || !reflect.DeepEqual(got, all[:i+1]) {
+			t.Errorf("%d: expected %q, got %q (%v)", i, all[:i+1], got, err)
+		}
+		n := 0
+		for _, c := range dns.lookups {
+			n += c
+		}
+		if n != lookups[i] {
+			t.Errorf("%d: expected %d lookups, got %d %v",
+				i, lookups[i], n, dns.lookups)
+		}
+	}
+
+	// Errors after some networks were found.
+	dns.txt["domain"] = []string{"v=spf1 ip4:192.0.2.0/25 ptr -all"}
+	got = []string{}
+	err = WalkAuthorizedNetworks("domain", func(n net.IPNet) bool {
+		got = append(got, n.String())
+		return true
+	})
+	if !isError(err, errNotStatic) || len(got) != 1 {
+		t.Errorf("expected not static error, got %q (%v)", got, err)
+	}
+}
+
+func TestAuthorizedNetworksErrors(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["loop"] = []string{"v=spf1 include:loop2"}
+	dns.txt["loop2"] = []string{"v=spf1 ip4:192.0.2.1 redirect=loop"}
+	dns.txt["ptr"] = []string{"v=spf1 ptr -all"}
+	dns.txt["exists"] = []string{"v=spf1 include:ptr exists:x -all"}
+	dns.txt["macro"] = []string{"v=spf1 a:%{l}.example -all"}
+	dns.txt["nsinc"] = []string{"v=spf1 include:nonexistent -all"}
+	dns.txt["toomany"] = []string{
+		"v=spf1 a:1 a:2 a:3 a:4 a:5 a:6 a:7 a:8 a:9 a:10 a:11 -all"}
+	dns.errors["temp"] = &net.DNSError{Err: "temp", IsTemporary: true}
+	dns.txt["tempa"] = []string{"v=spf1 a:temp -all"}
+
+	cases := []struct {
+		domain string
+		err    error
+	}{
+		{"loop", errLoop},
+		{"ptr", errNotStatic},
+		{"exists", errNotStatic},
+		{"macro", errNotStatic},
+		{"nsinc", errNoResult},
+		{"toomany", errLookupLimitReached},
+		{"tempa", dns.errors["temp"]},
+		{"nonexistent", errNoResult},
+	}
+	for _, c := range cases {
+		nets, err := AuthorizedNetworks(c.domain)
+		if nets != nil || !isError(err, c.err) {
+			t.Errorf("%q: expected error %v, got %v / %v",
+				c.domain, c.err, nets, err)
+		}
+	}
+
+	// Too many answers.
+	dns.txt["bigmx"] = []string{"v=spf1 mx -all"}
+	dns.mx["bigmx"] = []*net.MX{mx("a", 1), mx("b", 2), mx("c", 3)}
+	_, err := AuthorizedNetworks("bigmx", WithMaxAnswersPerLookup(2))
+	if !isError(err, errTooManyAnswers) {
+		t.Errorf("expected too many answers, got %v", err)
+	}
+
+	// Mechanisms that don't result in Pass are not followed.
+	dns.txt["domain"] = []string{"v=spf1 -ptr ~exists:x ?include:loop -all"}
+	nets, err := AuthorizedNetworks("domain")
+	if len(nets) != 0 || err != nil {
+		t.Errorf("expected no networks, got %v / %v", nets, err)
+	}
+}
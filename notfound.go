@@ -0,0 +1,18 @@
+//go:build go1.13
+// +build go1.13
+
+package spf
+
+import "net"
+
+// isNotFound returns true if the error is for a name that doesn't exist.
+func isNotFound(err error) bool {
+	derr, ok := err.(*net.DNSError)
+	return ok && (derr.IsNotFound || derr.Err == noSuchHost)
+}
+
+// notFoundError returns the error for a name that doesn't exist, like
+// *net.Resolver does.
+func notFoundError(name string) *net.DNSError {
+	return &net.DNSError{Err: noSuchHost, Name: name, IsNotFound: true}
+}
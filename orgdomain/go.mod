@@ -0,0 +1,5 @@
+module github.com/yeo/spf/orgdomain
+
+go 1.14
+
+require golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
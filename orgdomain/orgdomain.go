@@ -0,0 +1,41 @@
+// Package orgdomain finds the organizational (registrable) domain of a name,
+// using the Public Suffix List.
+//
+// It is a separate module (github.com/yeo/spf/orgdomain), so users of the
+// main spf package do not depend on the list unless they need it. It is useful to decide if two domains belong to
+// the same organization, for example for DMARC alignment, or to tell if an
+// include target is managed by the same organization as the domain.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+package orgdomain
+
+import (
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Of returns the organizational domain of the given name, that is, the
+// public suffix plus one label (for example, "example.co.uk" for
+// "mail.example.co.uk"). The result is in lower case, without the trailing
+// dot.
+//
+// It returns an error if the name is a public suffix itself, or is not
+// valid.
+func Of(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return publicsuffix.EffectiveTLDPlusOne(name)
+}
+
+// Same returns true if both names have the same organizational domain.
+func Same(a, b string) bool {
+	oa, err := Of(a)
+	if err != nil {
+		return false
+	}
+	ob, err := Of(b)
+	if err != nil {
+		return false
+	}
+	return oa == ob
+}
@@ -0,0 +1,48 @@
+package orgdomain
+
+import "testing"
+
+func TestOf(t *testing.T) {
+	cases := []struct {
+		name, org string
+	}{
+		{"example.com", "example.com"},
+		{"mail.example.com", "example.com"},
+		{"a.b.c.Example.COM.", "example.com"},
+		{"example.co.uk", "example.co.uk"},
+		{"mail.example.co.uk", "example.co.uk"},
+		{"_spf.mail.example.com.au", "example.com.au"},
+		{"foo.blogspot.com", "foo.blogspot.com"},
+	}
+	for _, c := range cases {
+		org, err := Of(c.name)
+		if org != c.org || err != nil {
+			t.Errorf("%q: expected %q, got %q (%v)", c.name, c.org, org, err)
+		}
+	}
+
+	for _, name := range []string{"com", "co.uk", "", "."} {
+		org, err := Of(name)
+		if err == nil {
+			t.Errorf("%q: expected error, got %q", name, org)
+		}
+	}
+}
+
+func TestSame(t *testing.T) {
+	cases := []struct {
+		a, b string
+		same bool
+	}{
+		{"example.com", "mail.example.com", true},
+		{"_spf.example.co.uk", "bounces.EXAMPLE.co.uk.", true},
+		{"example.co.uk", "other.co.uk", false},
+		{"a.blogspot.com", "b.blogspot.com", false},
+		{"co.uk", "co.uk", false},
+	}
+	for _, c := range cases {
+		if same := Same(c.a, c.b); same != c.same {
+			t.Errorf("%q %q: expected %v, got %v", c.a, c.b, c.same, same)
+		}
+	}
+}
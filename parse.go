@@ -0,0 +1,320 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidVersion = fmt.Errorf("missing or invalid version")
+	errInvalidFamily  = fmt.Errorf("ip address of the wrong family")
+)
+
+// Record is a parsed SPF record.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type Record struct {
+	// Mechanisms, in the order they appear in the record.
+	Mechanisms []Mechanism
+
+	// Modifiers, in the order they appear in the record.
+	Modifiers []Modifier
+}
+
+// Mechanism is a parsed SPF mechanism, like "-ip4:192.0.2.0/24".
+type Mechanism struct {
+	// Result of the mechanism when it matches, as given by its qualifier
+	// (Pass if there is none).
+	Qualifier Result
+
+	// Name of the mechanism, in lower case: "all", "include", "a", "mx",
+	// "ptr", "ip4", "ip6" or "exists".
+	Name string
+
+	// Value of the mechanism: the domain-spec, or the IP address for ip4 and
+	// ip6 (without the prefix length). Empty if not given.
+	Value string
+
+	// Prefix lengths for IPv4 and IPv6, or -1 if not given.
+	Mask4, Mask6 int
+}
+
+// Modifier is a parsed SPF modifier, like "redirect=_spf.example.com".
+type Modifier struct {
+	// Name of the modifier, in lower case.
+	Name string
+
+	// Value of the modifier.
+	Value string
+}
+
+// Parse the given SPF record, without doing any DNS queries. It returns an
+// error if the record is not syntactically valid.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func Parse(txt string) (*Record, error) {
+	if len(txt) > maxRecordLength {
+		return nil, errRecordTooLong
+	}
+
+	fields := strings.Fields(txt)
+	if len(fields) == 0 || strings.ToLower(fields[0]) != "v=spf1" {
+		return nil, errInvalidVersion
+	}
+
+	rec := &Record{}
+	for _, field := range fields[1:] {
+		mech, mod, err := parseTerm(field)
+		if err != nil {
+			return nil, err
+		}
+		if mod != nil && (mod.Name == "redirect" || mod.Name == "exp") {
+			if _, dup := rec.Modifier(mod.Name); dup {
+				return nil, errDuplicateModifier
+			}
+		}
+		if mod != nil {
+			rec.Modifiers = append(rec.Modifiers, *mod)
+		} else {
+			rec.Mechanisms = append(rec.Mechanisms, *mech)
+		}
+	}
+	return rec, nil
+}
+
+// ParseMechanism parses a single mechanism (like "-ip4:192.0.2.0/24"), and
+// validates it in isolation, without doing any DNS queries. It returns an
+// error if the mechanism is not valid, or if the token is not a mechanism
+// (for example, a modifier).
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func ParseMechanism(token string) (Mechanism, error) {
+	mech, err := parseMechanism(token)
+	if err != nil {
+		return Mechanism{}, err
+	}
+	return *mech, nil
+}
+
+// parseTerm parses a single term, returning either a mechanism or a modifier.
+// https://tools.ietf.org/html/rfc7208#section-12
+func parseTerm(field string) (*Mechanism, *Modifier, error) {
+	if isModifier(field) {
+		i := strings.Index(field, "=")
+		mod, err := parseModifier(field[:i], field[i+1:])
+		return nil, mod, err
+	}
+
+	mech, err := parseMechanism(field)
+	return mech, nil, err
+}
+
+// isModifier returns true if the term is a modifier instead of a mechanism.
+// Modifiers are of the form "name=value", and the name can't contain ":" or
+// "/", which would make it a mechanism (like "exists:a=b").
+func isModifier(term string) bool {
+	i := strings.Index(term, "=")
+	return i > 0 && !strings.ContainsAny(term[:i], ":/")
+}
+
+func parseModifier(name, value string) (*Modifier, error) {
+	mod := &Modifier{Name: strings.ToLower(name), Value: value}
+	for _, c := range mod.Name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return nil, errUnknownField
+		}
+	}
+
+	if mod.Name == "redirect" || mod.Name == "exp" {
+		if err := checkDomainSpec(value); err != nil {
+			return nil, err
+		}
+	}
+	return mod, nil
+}
+
+func parseMechanism(field string) (*Mechanism, error) {
+	mech := &Mechanism{Qualifier: Pass, Mask4: -1, Mask6: -1}
+	if field == "" {
+		return nil, errUnknownField
+	}
+	if q, ok := qualToResult[field[0]]; ok {
+		mech.Qualifier = q
+		field = field[1:]
+	}
+
+	lfield := strings.ToLower(field)
+	var err error
+	switch {
+	case lfield == "all":
+		mech.Name = "all"
+	case strings.HasPrefix(lfield, "include:"):
+		mech.Name = "include"
+		mech.Value = field[len("include:"):]
+		err = checkDomainSpec(mech.Value)
+	case strings.HasPrefix(lfield, "exists:"):
+		mech.Name = "exists"
+		mech.Value = field[len("exists:"):]
+		err = checkDomainSpec(mech.Value)
+	case aField.MatchString(lfield):
+		mech.Name = "a"
+		err = mech.parseDomainAndMask(field)
+	case mxField.MatchString(lfield):
+		mech.Name = "mx"
+		err = mech.parseDomainAndMask(field)
+	case ptrField.MatchString(lfield):
+		mech.Name = "ptr"
+		if len(field) > 3 {
+			mech.Value = field[4:]
+			err = checkDomainSpec(mech.Value)
+		}
+	case strings.HasPrefix(lfield, "ip4:") || strings.HasPrefix(lfield, "ip6:"):
+		mech.Name = lfield[:3]
+		err = mech.parseIP(field[4:])
+	default:
+		err = errUnknownField
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return mech, nil
+}
+
+// parseDomainAndMask parses the domain and masks of "a" and "mx" mechanisms.
+func (m *Mechanism) parseDomainAndMask(field string) error {
+	if _, _, _, ok := splitDomainAndMask(m.Name, field); !ok {
+		return errInvalidDomain
+	}
+	domain, masks, err := domainAndMask(m.Name, field, "")
+	if err != nil {
+		return err
+	}
+	if domain != "" {
+		if err := checkDomainSpec(domain); err != nil {
+			return err
+		}
+	}
+	m.Value = domain
+	m.Mask4, m.Mask6 = masks.v4, masks.v6
+	return nil
+}
+
+// parseIP parses the value of "ip4" and "ip6" mechanisms.
+func (m *Mechanism) parseIP(value string) error {
+	ipS, maskS := value, ""
+	if i := strings.Index(value, "/"); i >= 0 {
+		ipS, maskS = value[:i], value[i+1:]
+	}
+
+	ip := net.ParseIP(ipS)
+	if ip == nil {
+		return errInvalidIP
+	}
+	isV4 := strings.Contains(ipS, ".") && !strings.Contains(ipS, ":")
+	if (m.Name == "ip4") != isV4 {
+		return errInvalidFamily
+	}
+	m.Value = ipS
+
+	if maskS != "" || strings.Contains(value, "/") {
+		max := 128
+		if m.Name == "ip4" {
+			max = 32
+		}
+		mask, err := strconv.Atoi(maskS)
+		if err != nil || mask > max || strings.Trim(maskS, "0123456789") != "" {
+			return errInvalidMask
+		}
+		if m.Name == "ip4" {
+			m.Mask4 = mask
+		} else {
+			m.Mask6 = mask
+		}
+	}
+	return nil
+}
+
+// checkDomainSpec checks that the domain-spec is valid, including its
+// macros (which are not expanded).
+func checkDomainSpec(spec string) error {
+	if spec == "" {
+		return errInvalidDomain
+	}
+
+	// Expand the macros with placeholder values, just to validate them.
+	// The ip names are set so the "p" macro doesn't trigger any lookups.
+	r := &resolution{ip: net.IPv4zero, sender: "postmaster@domain",
+		ipNames: []string{}}
+	_, err := r.expandMacros(spec, "domain")
+	return err
+}
+
+// String returns the mechanism in its textual form. The "+" qualifier is
+// omitted, as it is the default.
+func (m Mechanism) String() string {
+	s := ""
+	for q, res := range qualToResult {
+		if res == m.Qualifier && q != '+' {
+			s = string(q)
+		}
+	}
+
+	s += m.Name
+	if m.Value != "" {
+		s += ":" + m.Value
+	}
+	if m.Mask4 >= 0 {
+		s += "/" + strconv.Itoa(m.Mask4)
+	}
+	if m.Mask6 >= 0 {
+		if m.Name != "ip6" {
+			s += "/"
+		}
+		s += "/" + strconv.Itoa(m.Mask6)
+	}
+	return s
+}
+
+// String returns the modifier in its textual form.
+func (m Modifier) String() string {
+	return m.Name + "=" + m.Value
+}
+
+// String returns the record in its textual form. Modifiers are placed after
+// all the mechanisms.
+func (rec *Record) String() string {
+	s := "v=spf1"
+	for _, m := range rec.Mechanisms {
+		s += " " + m.String()
+	}
+	for _, m := range rec.Modifiers {
+		s += " " + m.String()
+	}
+	return s
+}
+
+// Modifier returns the value of the first modifier with the given name
+// (case-insensitive), like "redirect" or "exp", and whether it was found.
+func (rec *Record) Modifier(name string) (string, bool) {
+	for _, m := range rec.Modifiers {
+		if strings.EqualFold(m.Name, name) {
+			return m.Value, true
+		}
+	}
+	return "", false
+}
+
+// All returns the first "all" mechanism of the record, and whether there is
+// one. Mechanisms after it are never evaluated.
+func (rec *Record) All() (Mechanism, bool) {
+	for _, m := range rec.Mechanisms {
+		if m.Name == "all" {
+			return m, true
+		}
+	}
+	return Mechanism{}, false
+}
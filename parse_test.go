@@ -0,0 +1,198 @@
+package spf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		txt string
+		rec *Record
+	}{
+		{"v=spf1", &Record{}},
+		{"V=SPF1 -ALL", &Record{
+			Mechanisms: []Mechanism{{Fail, "all", "", -1, -1}},
+		}},
+		{"v=spf1 a ~mx:d1/24 ?a//64 ptr:d2 ip4:1.2.3.0/24 ip6:2001:db8::1 " +
+			"include:d3 exists:%{i}.d4 redirect=d5 exp=d6 foo=bar",
+			&Record{
+				Mechanisms: []Mechanism{
+					{Pass, "a", "", -1, -1},
+					{SoftFail, "mx", "d1", 24, -1},
+					{Neutral, "a", "", -1, 64},
+					{Pass, "ptr", "d2", -1, -1},
+					{Pass, "ip4", "1.2.3.0", 24, -1},
+					{Pass, "ip6", "2001:db8::1", -1, -1},
+					{Pass, "include", "d3", -1, -1},
+					{Pass, "exists", "%{i}.d4", -1, -1},
+				},
+				Modifiers: []Modifier{
+					{"redirect", "d5"},
+					{"exp", "d6"},
+					{"foo", "bar"},
+				},
+			}},
+	}
+
+	for _, c := range cases {
+		rec, err := Parse(c.txt)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.txt, err)
+			continue
+		}
+		if !reflect.DeepEqual(rec, c.rec) {
+			t.Errorf("%q: expected %+v, got %+v", c.txt, c.rec, rec)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		txt string
+		err error
+	}{
+		{"", errInvalidVersion},
+		{"v=spf2 -all", errInvalidVersion},
+		{"v=spf1 -", errUnknownField},
+		{"v=spf1 blah", errUnknownField},
+		{"v=spf1 include:", errInvalidDomain},
+		{"v=spf1 a:d1/99", errInvalidMask},
+		{"v=spf1 a:", errInvalidDomain},
+		{"v=spf1 ip4:1.2.3.4/33", errInvalidMask},
+		{"v=spf1 ip4:1.2.3.4/", errInvalidMask},
+		{"v=spf1 ip4:lala", errInvalidIP},
+		{"v=spf1 ip4:2001:db8::1", errInvalidFamily},
+		{"v=spf1 ip6:1.2.3.4", errInvalidFamily},
+		{"v=spf1 exists:%{x}", errInvalidMacro},
+		{"v=spf1 redirect=", errInvalidDomain},
+		{"v=spf1 fo,o=bar", errUnknownField},
+		{"v=spf1 redirect=a redirect=b", errDuplicateModifier},
+		{"v=spf1 exp=a -all EXP=b", errDuplicateModifier},
+	}
+
+	for _, c := range cases {
+		_, err := Parse(c.txt)
+		if err != c.err {
+			t.Errorf("%q: expected error %v, got %v", c.txt, c.err, err)
+		}
+	}
+}
+
+func TestRecordString(t *testing.T) {
+	cases := []struct{ txt, str string }{
+		{"v=spf1", "v=spf1"},
+		{"v=spf1 +a -mx:d1/24//64 ~IP6:2001:db8::/32 redirect=d2 ?all",
+			"v=spf1 a -mx:d1/24//64 ~ip6:2001:db8::/32 ?all redirect=d2"},
+	}
+	for _, c := range cases {
+		rec, err := Parse(c.txt)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", c.txt, err)
+		}
+		if s := rec.String(); s != c.str {
+			t.Errorf("%q: expected %q, got %q", c.txt, c.str, s)
+		}
+	}
+}
+
+func TestParseMechanism(t *testing.T) {
+	cases := []struct {
+		token string
+		mech  Mechanism
+		err   error
+	}{
+		{"all", Mechanism{Pass, "all", "", -1, -1}, nil},
+		{"-ALL", Mechanism{Fail, "all", "", -1, -1}, nil},
+		{"~include:_spf.d1", Mechanism{SoftFail, "include", "_spf.d1", -1, -1}, nil},
+		{"a", Mechanism{Pass, "a", "", -1, -1}, nil},
+		{"?a:d1/24//64", Mechanism{Neutral, "a", "d1", 24, 64}, nil},
+		{"mx//64", Mechanism{Pass, "mx", "", -1, 64}, nil},
+		{"+mx:%{d}.d1", Mechanism{Pass, "mx", "%{d}.d1", -1, -1}, nil},
+		{"ptr", Mechanism{Pass, "ptr", "", -1, -1}, nil},
+		{"ptr:d1", Mechanism{Pass, "ptr", "d1", -1, -1}, nil},
+		{"ip4:1.2.3.0/24", Mechanism{Pass, "ip4", "1.2.3.0", 24, -1}, nil},
+		{"-ip6:2001:db8::/32", Mechanism{Fail, "ip6", "2001:db8::", -1, 32}, nil},
+		{"exists:%{ir}.d1", Mechanism{Pass, "exists", "%{ir}.d1", -1, -1}, nil},
+
+		// Unknown mechanisms, and things that are not mechanisms.
+		{"", Mechanism{}, errUnknownField},
+		{"-", Mechanism{}, errUnknownField},
+		{"blah", Mechanism{}, errUnknownField},
+		{"redirect=d1", Mechanism{}, errUnknownField},
+		{"v=spf1", Mechanism{}, errUnknownField},
+
+		// Bad CIDRs.
+		{"a/33", Mechanism{}, errInvalidMask},
+		{"mx:d1//129", Mechanism{}, errInvalidMask},
+		{"ip4:1.2.3.4/", Mechanism{}, errInvalidMask},
+		{"ip6:2001:db8::/lala", Mechanism{}, errInvalidMask},
+
+		// Other invalid values.
+		{"ip4:lala", Mechanism{}, errInvalidIP},
+		{"ip6:1.2.3.4", Mechanism{}, errInvalidFamily},
+		{"include:", Mechanism{}, errInvalidDomain},
+
+		// Disallowed macros.
+		{"exists:%{x}", Mechanism{}, errInvalidMacro},
+		{"include:%{c}.d1", Mechanism{}, errInvalidMacro},
+		{"a:%{i0}.d1", Mechanism{}, errInvalidMacro},
+		{"ptr:%z", Mechanism{}, errInvalidMacro},
+	}
+
+	for _, c := range cases {
+		mech, err := ParseMechanism(c.token)
+		if mech != c.mech || err != c.err {
+			t.Errorf("%q: expected %+v/%v, got %+v/%v",
+				c.token, c.mech, c.err, mech, err)
+		}
+	}
+}
+
+func TestRecordAccessors(t *testing.T) {
+	txt := "v=spf1 -ip4:192.0.2.0/24 mx:mx.%{d}/24//64 ?include:_spf.%{o} " +
+		"ip6:2001:db8::/32 a//96 ~ALL exists:x Redirect=r.example " +
+		"exp=explain.%{d} other=1"
+	rec, err := Parse(txt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := &Record{
+		Mechanisms: []Mechanism{
+			{Fail, "ip4", "192.0.2.0", 24, -1},
+			{Pass, "mx", "mx.%{d}", 24, 64},
+			{Neutral, "include", "_spf.%{o}", -1, -1},
+			{Pass, "ip6", "2001:db8::", -1, 32},
+			{Pass, "a", "", -1, 96},
+			{SoftFail, "all", "", -1, -1},
+			{Pass, "exists", "x", -1, -1},
+		},
+		Modifiers: []Modifier{
+			{"redirect", "r.example"},
+			{"exp", "explain.%{d}"},
+			{"other", "1"},
+		},
+	}
+	if !reflect.DeepEqual(rec, exp) {
+		t.Errorf("expected %+v, got %+v", exp, rec)
+	}
+
+	if v, ok := rec.Modifier("REDIRECT"); !ok || v != "r.example" {
+		t.Errorf("unexpected redirect: %q %v", v, ok)
+	}
+	if v, ok := rec.Modifier("exp"); !ok || v != "explain.%{d}" {
+		t.Errorf("unexpected exp: %q %v", v, ok)
+	}
+	if v, ok := rec.Modifier("missing"); ok || v != "" {
+		t.Errorf("unexpected modifier: %q %v", v, ok)
+	}
+	if m, ok := rec.All(); !ok || m.Qualifier != SoftFail {
+		t.Errorf("unexpected all: %v %v", m, ok)
+	}
+
+	rec, _ = Parse("v=spf1 a")
+	if m, ok := rec.All(); ok {
+		t.Errorf("unexpected all: %v", m)
+	}
+}
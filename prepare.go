@@ -0,0 +1,78 @@
+package spf
+
+import (
+	"net"
+)
+
+// PreparedPolicy is the SPF policy of a domain, fetched once to be used for
+// checking many IPs over time. See Prepare.
+//
+// It is safe for concurrent use.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type PreparedPolicy struct {
+	domain string
+	record string
+	opts   []Option
+	cache  DNSResolver
+}
+
+// Prepare fetches the SPF record of the domain, and returns a policy that
+// can be used to check IPs against it, as CheckHost would.
+//
+// The DNS answers needed by the checks, starting with the record itself,
+// are cached in the policy, so the ip-independent ones (like the records of
+// include targets, or the addresses of the MX hosts) are only fetched once.
+// They are kept for as long as the policy is used, regardless of their TTL:
+// the caller decides when the policy is stale, and calls Prepare again.
+// Failed queries are not cached, so a check after a temporary failure (like
+// a timeout) queries again.
+//
+// An error is returned if the record could not be fetched, including when
+// the domain doesn't have one, or has more than one. The given options are
+// applied to each check.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func Prepare(domain string, opts ...Option) (*PreparedPolicy, error) {
+	if !isValidDomain(domain) {
+		return nil, errInvalidIdentity
+	}
+
+	r := newResolution(net.IPv4zero, "@"+domain, opts)
+	p := &PreparedPolicy{
+		domain: domain,
+		opts:   opts,
+		cache:  newCachingResolver(r.resolver),
+	}
+	r.resolver = p.cache
+
+	txt, err := r.getDNSRecord(domain)
+	if err != nil {
+		return nil, err
+	}
+	if txt == "" {
+		return nil, errNoResult
+	}
+	p.record = txt
+	return p, nil
+}
+
+// Domain returns the domain of the policy.
+func (p *PreparedPolicy) Domain() string {
+	return p.domain
+}
+
+// Record returns the SPF record of the domain.
+func (p *PreparedPolicy) Record() string {
+	return p.record
+}
+
+// Check evaluates the policy to determine if `ip` is permitted to send mail
+// for the domain. The result is the same as CheckHost's, with the DNS
+// answers taken from the policy's cache when possible.
+func (p *PreparedPolicy) Check(ip net.IP) (Result, error) {
+	trace("prepared check %q %q", ip, p.domain)
+	r := newResolution(ip, "@"+p.domain, p.opts)
+	r.resolver = p.cache
+	return r.checkTopLevel(p.domain)
+}
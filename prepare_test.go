@@ -0,0 +1,120 @@
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPrepare(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 include:inc mx -all"}
+	dns.txt["inc"] = []string{"v=spf1 ip6:2001:db8::/32"}
+	dns.mx["domain"] = []*net.MX{{Host: "mail"}}
+	dns.ip["mail"] = []net.IP{ip1110}
+
+	p, err := Prepare("domain")
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	if p.Domain() != "domain" || p.Record() != dns.txt["domain"][0] {
+		t.Errorf("unexpected policy: %q %q", p.Domain(), p.Record())
+	}
+
+	cases := []struct {
+		ip  string
+		res Result
+		err error
+	}{
+		{"1.1.1.1", Pass, errMatchedIP},
+		{"2001:db8::1", Pass, errMatchedIP},
+		{"1.1.1.0", Pass, errMatchedMX},
+		{"1.1.1.2", Fail, errMatchedAll},
+		{"2001:db9::1", Fail, errMatchedAll},
+	}
+	for i := 0; i < 2; i++ {
+		for _, c := range cases {
+			res, err := p.Check(net.ParseIP(c.ip))
+			if res != c.res || err != c.err {
+				t.Errorf("%s: expected %v/%v, got %v/%v",
+					c.ip, c.res, c.err, res, err)
+			}
+		}
+	}
+
+	// Each query was done only once.
+	if dns.lookups["txt"] != 2 || dns.lookups["mx"] != 1 ||
+		dns.lookups["ip"] != 1 {
+		t.Errorf("unexpected lookups: %v", dns.lookups)
+	}
+
+	// The results are the same as CheckHost's.
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		res, _ := p.Check(ip)
+		if res2, _ := CheckHost(ip, "domain"); res2 != res {
+			t.Errorf("%s: CheckHost returned %v, prepared %v",
+				c.ip, res2, res)
+		}
+	}
+
+	// Options are applied to each check.
+	p, err = Prepare("domain", WithDefaultQualifier(Neutral))
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	if res, err := p.Check(ip1111); res != Neutral || err != errMatchedIP {
+		t.Errorf("expected neutral/matched ip, got %v (%v)", res, err)
+	}
+}
+
+func TestPrepareTempError(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 include:inc -all"}
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.1.1.1"}
+
+	p, err := Prepare("domain")
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+
+	// A temporary error is not cached, so the next check queries again.
+	dns.errors["inc"] = &net.DNSError{Err: "temp", IsTemporary: true}
+	if res, err := p.Check(ip1111); res != TempError {
+		t.Errorf("expected temperror, got %v (%v)", res, err)
+	}
+	delete(dns.errors, "inc")
+	if res, err := p.Check(ip1111); res != Pass || err != errMatchedIP {
+		t.Errorf("expected pass/matched ip, got %v (%v)", res, err)
+	}
+}
+
+func TestPrepareErrors(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 -all", "v=spf1 +all"}
+	dns.txt["nospf"] = []string{"something else"}
+	dns.errors["temp"] = &net.DNSError{Err: "temp", IsTemporary: true}
+
+	cases := []struct {
+		domain string
+		err    error
+	}{
+		{"domain", errMultipleRecords},
+		{"nospf", errNoResult},
+		{"nonexistent", errNoResult},
+		{"temp", dns.errors["temp"]},
+		{"in..valid", errInvalidIdentity},
+	}
+	for _, c := range cases {
+		p, err := Prepare(c.domain)
+		if p != nil || err != c.err {
+			t.Errorf("%q: expected error %v, got %v / %v",
+				c.domain, c.err, p, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// WithRetry is an option to retry DNS queries that fail with a temporary
+// error (like SERVFAIL or a timeout, see also WithErrorClassifier), up to
+// `attempts` more times, before
+// giving up with TempError. The first retry is done after waiting for
+// `backoff`, and the wait is doubled for each of the next ones.
+//
+// Retries are not done if they would go past the deadline of the context,
+// or the maximum duration given with WithMaxDuration. Permanent errors
+// (like the domain not existing) are never retried.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(r *resolution) {
+		r.retries = attempts
+		r.backoff = backoff
+	}
+}
+
+// retryingResolver wraps a DNSResolver, and retries the queries that fail
+// with a temporary error. See WithRetry.
+type retryingResolver struct {
+	resolver DNSResolver
+	retries  int
+	backoff  time.Duration
+
+	// Time after which we don't retry anymore, if not zero.
+	deadline time.Time
+
+	// Tells if an error is temporary, and the query can be retried.
+	temporary func(err error) bool
+}
+
+// retryingFamilyResolver is a retryingResolver for resolvers which can
+// look up addresses of a single family (see familyResolver).
+type retryingFamilyResolver struct {
+	*retryingResolver
+}
+
+// newRetryingResolver returns a resolver that wraps the given one, to retry
+// its queries. It implements familyResolver if the given one does.
+func newRetryingResolver(resolver DNSResolver, retries int, backoff time.Duration, deadline time.Time, temporary func(error) bool) DNSResolver {
+	rr := &retryingResolver{
+		resolver:  resolver,
+		retries:   retries,
+		backoff:   backoff,
+		deadline:  deadline,
+		temporary: temporary,
+	}
+	if _, ok := resolver.(familyResolver); ok {
+		return retryingFamilyResolver{rr}
+	}
+	return rr
+}
+
+// retry calls f until it returns nil or a non-temporary error, or we run
+// out of retries or time. It returns the last error.
+func (rr *retryingResolver) retry(ctx context.Context, name string, f func() error) error {
+	wait := rr.backoff
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || !rr.temporary(err) || i >= rr.retries {
+			return err
+		}
+
+		next := time.Now().Add(wait)
+		if d, ok := ctx.Deadline(); ok && next.After(d) {
+			return err
+		}
+		if !rr.deadline.IsZero() && next.After(rr.deadline) {
+			return err
+		}
+
+		trace("temporary error for %q, retrying in %v: %v", name, wait, err)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		wait *= 2
+	}
+}
+
+func (rr *retryingResolver) LookupTXT(ctx context.Context, name string) (txts []string, err error) {
+	err = rr.retry(ctx, name, func() error {
+		txts, err = rr.resolver.LookupTXT(ctx, name)
+		return err
+	})
+	return txts, err
+}
+
+func (rr *retryingResolver) LookupMX(ctx context.Context, name string) (mxs []*net.MX, err error) {
+	err = rr.retry(ctx, name, func() error {
+		mxs, err = rr.resolver.LookupMX(ctx, name)
+		return err
+	})
+	return mxs, err
+}
+
+func (rr *retryingResolver) LookupIPAddr(ctx context.Context, host string) (as []net.IPAddr, err error) {
+	err = rr.retry(ctx, host, func() error {
+		as, err = rr.resolver.LookupIPAddr(ctx, host)
+		return err
+	})
+	return as, err
+}
+
+func (rr *retryingResolver) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
+	err = rr.retry(ctx, addr, func() error {
+		names, err = rr.resolver.LookupAddr(ctx, addr)
+		return err
+	})
+	return names, err
+}
+
+func (rr retryingFamilyResolver) LookupIP(ctx context.Context, network, host string) (ips []net.IP, err error) {
+	fr := rr.resolver.(familyResolver)
+	err = rr.retry(ctx, host, func() error {
+		ips, err = fr.LookupIP(ctx, network, host)
+		return err
+	})
+	return ips, err
+}
@@ -0,0 +1,126 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// flakyResolver wraps a TestResolver, and fails the first queries for each
+// name with the given error.
+type flakyResolver struct {
+	*TestResolver
+	fails int
+	err   error
+	seen  map[string]int
+}
+
+func (r *flakyResolver) fail(name string) bool {
+	r.seen[name]++
+	return r.seen[name] <= r.fails
+}
+
+func (r *flakyResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	if r.fail("txt " + domain) {
+		return nil, r.err
+	}
+	return r.TestResolver.LookupTXT(ctx, domain)
+}
+
+func (r *flakyResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r.fail("ip " + host) {
+		return nil, r.err
+	}
+	return r.TestResolver.LookupIPAddr(ctx, host)
+}
+
+func TestRetry(t *testing.T) {
+	trace = t.Logf
+	dns := NewResolver()
+	dns.txt["domain"] = []string{"v=spf1 a:host -all"}
+	dns.ip["host"] = []net.IP{ip1111}
+
+	tmpErr := &net.DNSError{Err: "temporary error for testing",
+		IsTemporary: true}
+	flaky := func(fails int, err error) *flakyResolver {
+		return &flakyResolver{dns, fails, err, map[string]int{}}
+	}
+
+	// Fail once, then succeed.
+	fr := flaky(1, tmpErr)
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithResolver(fr), WithRetry(2, time.Millisecond))
+	if res != Pass || err != errMatchedA {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+	if fr.seen["txt domain"] != 2 || fr.seen["ip host"] != 2 {
+		t.Errorf("expected 2 queries each, got %v", fr.seen)
+	}
+
+	// Without retries, it is a TempError.
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithResolver(flaky(1, tmpErr)))
+	if res != TempError {
+		t.Errorf("expected temperror without retries, got %v (%v)",
+			res, err)
+	}
+
+	// Run out of retries.
+	fr = flaky(3, tmpErr)
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithResolver(fr), WithRetry(2, time.Millisecond))
+	if res != TempError || err != tmpErr {
+		t.Errorf("expected temperror, got %v (%v)", res, err)
+	}
+	if n := fr.seen["txt domain"]; n != 3 {
+		t.Errorf("expected 3 queries, got %d", n)
+	}
+
+	// Permanent errors are not retried.
+	fr = flaky(1, &net.DNSError{Err: "permanent error for testing"})
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithResolver(fr), WithRetry(2, time.Millisecond))
+	if res != None {
+		t.Errorf("expected none, got %v (%v)", res, err)
+	}
+	if n := fr.seen["txt domain"]; n != 1 {
+		t.Errorf("expected 1 query, got %d", n)
+	}
+
+	// Don't wait past the deadlines.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	for _, opt := range []Option{WithContext(ctx), WithMaxDuration(time.Second)} {
+		fr = flaky(1, tmpErr)
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+			WithResolver(fr), WithRetry(2, time.Hour), opt)
+		if res != TempError || err != tmpErr {
+			t.Errorf("expected temperror, got %v (%v)", res, err)
+		}
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("waited past the deadline: %v", d)
+	}
+
+	// The family lookups are retried too.
+	ffr := &familyFlakyResolver{flaky(1, tmpErr)}
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithResolver(ffr), WithRetry(1, time.Millisecond))
+	if res != Pass || ffr.seen["ip4 host"] != 2 {
+		t.Errorf("expected pass after 2 queries, got %v (%v) %v",
+			res, err, ffr.seen)
+	}
+}
+
+type familyFlakyResolver struct {
+	*flakyResolver
+}
+
+func (r *familyFlakyResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if r.fail(network + " " + host) {
+		return nil, r.err
+	}
+	return r.TestResolver.ip[host], nil
+}
@@ -0,0 +1,75 @@
+package spf
+
+import (
+	"net"
+	"sync"
+)
+
+// Session caches the results of the SPF checks done for a single SMTP
+// connection, where the client ip doesn't change. Checking the same HELO and
+// sender again (for example, for each message of a connection that sends
+// many) returns the previous result, without doing any DNS queries.
+//
+// Unlike caching DNS answers, there is no expiration: a Session is meant to
+// live only as long as the connection. Use Invalidate to discard the results
+// before that, if needed.
+//
+// It is safe for concurrent use.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type Session struct {
+	ip   net.IP
+	opts []Option
+
+	mu      sync.Mutex
+	results map[sessionKey]CheckResult
+}
+
+type sessionKey struct {
+	helo, sender string
+}
+
+// NewSession returns a new Session for connections from the given ip. The
+// options are used for all the checks done with it.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func NewSession(ip net.IP, opts ...Option) *Session {
+	return &Session{
+		ip:      ip,
+		opts:    opts,
+		results: map[sessionKey]CheckResult{},
+	}
+}
+
+// Check is like CheckHostWithSender for the session's ip, but the result is
+// taken from the session if the same helo and sender were checked before.
+// TempError results are not kept, so checking again after one queries DNS
+// again.
+func (s *Session) Check(helo, sender string) (Result, error) {
+	key := sessionKey{helo, sender}
+	s.mu.Lock()
+	cr, ok := s.results[key]
+	s.mu.Unlock()
+	if ok {
+		trace("session result for %q %q: %v", helo, sender, cr.Result)
+		return cr.Result, cr.Err
+	}
+
+	res, err := CheckHostWithSender(s.ip, helo, sender, s.opts...)
+	if res == TempError {
+		// The client is expected to retry, so don't keep the result.
+		return res, err
+	}
+	s.mu.Lock()
+	s.results[key] = CheckResult{res, err}
+	s.mu.Unlock()
+	return res, err
+}
+
+// Invalidate discards all the results in the session, so the next checks
+// are evaluated again.
+func (s *Session) Invalidate() {
+	s.mu.Lock()
+	s.results = map[sessionKey]CheckResult{}
+	s.mu.Unlock()
+}
@@ -0,0 +1,78 @@
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	trace = t.Logf
+	dns := NewResolver()
+	dns.txt["domain"] = []string{"v=spf1 mx a:host -all"}
+	dns.txt["other"] = []string{"v=spf1 -all"}
+	dns.mx["domain"] = []*net.MX{mx("mx", 10)}
+	dns.ip["host"] = []net.IP{ip1111}
+
+	queries := func() int {
+		n := 0
+		for _, c := range dns.lookups {
+			n += c
+		}
+		return n
+	}
+
+	s := NewSession(ip1111, WithResolver(dns))
+	res, err := s.Check("helo", "user@domain")
+	if res != Pass || err != errMatchedA {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+	first := queries()
+	if first == 0 {
+		t.Fatalf("no queries done for the first check")
+	}
+
+	// The second check for the same sender does no queries.
+	res, err = s.Check("helo", "user@domain")
+	if res != Pass || err != errMatchedA || queries() != first {
+		t.Errorf("expected cached pass, got %v (%v), %d queries",
+			res, err, queries()-first)
+	}
+
+	// A different sender is evaluated.
+	res, err = s.Check("helo", "user@other")
+	if res != Fail || err != errMatchedAll || queries() == first {
+		t.Errorf("expected evaluated fail, got %v (%v), %d queries",
+			res, err, queries()-first)
+	}
+
+	// After invalidating, the records are queried again, and changes are
+	// seen.
+	dns.txt["domain"] = []string{"v=spf1 ~all"}
+	before := queries()
+	s.Invalidate()
+	res, err = s.Check("helo", "user@domain")
+	if res != SoftFail || err != errMatchedAll || queries() == before {
+		t.Errorf("expected evaluated softfail, got %v (%v), %d queries",
+			res, err, queries()-before)
+	}
+}
+
+func TestSessionTempError(t *testing.T) {
+	trace = t.Logf
+	dns := NewResolver()
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	dns.errors["domain"] = &net.DNSError{Err: "temp", IsTemporary: true}
+
+	s := NewSession(ip1111, WithResolver(dns))
+	res, err := s.Check("helo", "user@domain")
+	if res != TempError {
+		t.Errorf("expected temperror, got %v (%v)", res, err)
+	}
+
+	// The TempError was not kept, so the retry is evaluated again.
+	delete(dns.errors, "domain")
+	res, err = s.Check("helo", "user@domain")
+	if res != Pass || err != errMatchedIP {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+}
@@ -8,6 +8,10 @@
 // This package is intended to be used by SMTP servers to implement SPF
 // validation.
 //
+// All functions are safe for concurrent use. Each check keeps its own state,
+// and options (like WithResolver) only apply to the call they are given to,
+// so concurrent checks with different options don't affect each other.
+//
 // All mechanisms and modifiers are supported:
 //   all
 //   include
@@ -18,7 +22,7 @@
 //   ip6
 //   exists
 //   redirect
-//   exp (ignored)
+//   exp (only in CheckHostDetailed)
 //   Macros
 //
 // References:
@@ -32,8 +36,12 @@ import (
 	"net"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Functions that we can override for testing purposes.
@@ -47,7 +55,7 @@ var (
 type Result string
 
 // Valid results.
-var (
+const (
 	// https://tools.ietf.org/html/rfc7208#section-8.1
 	// Not able to reach any conclusion.
 	None = Result("none")
@@ -77,6 +85,80 @@ var (
 	PermError = Result("permerror")
 )
 
+// Severity ordering of the results, from the least to the most severe.
+// This is not defined by the RFC, it is a local policy (see CombineResults).
+var severityOrder = []Result{
+	Pass, None, Neutral, PermError, TempError, SoftFail, Fail,
+}
+
+// Severity of the result, as an integer that can be used to compare results:
+// the higher, the more severe. Unknown results have severity -1.
+//
+// The ordering, from the least to the most severe, is:
+// Pass, None, Neutral, PermError, TempError, SoftFail, Fail.
+// The definite negative results (Fail and SoftFail) dominate over the
+// errors, and TempError is considered more severe than PermError, since the
+// sender should retry.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func (r Result) Severity() int {
+	for i, res := range severityOrder {
+		if r == res {
+			return i
+		}
+	}
+	return -1
+}
+
+// CombineResults returns the most severe of the two results, according to
+// Result.Severity. It is useful to get a single decision when checking
+// multiple identities (for example, HELO and MAIL FROM).
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CombineResults(a, b Result) Result {
+	if b.Severity() > a.Severity() {
+		return b
+	}
+	return a
+}
+
+// ScoreTable maps results to numeric scores, for use in composite scoring
+// systems (like spam filters). See Result.Score.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type ScoreTable map[Result]float64
+
+// DefaultScoreTable returns a new table with the default scores, which are
+// based on the ones SpamAssassin uses for the SPF results of the sender:
+// positive scores make the message more likely to be considered spam, and
+// negative ones less likely. The values are only a starting point, and
+// callers can adjust them on the returned table.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func DefaultScoreTable() ScoreTable {
+	return ScoreTable{
+		Pass:      -0.001,
+		None:      0.001,
+		Neutral:   0.652,
+		SoftFail:  0.665,
+		Fail:      0.919,
+		TempError: 0.01,
+		PermError: 0.01,
+	}
+}
+
+// Score of the result according to the given table, or to
+// DefaultScoreTable if it is nil. Results which are not in the table score
+// 0.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func (r Result) Score(table ScoreTable) float64 {
+	if table == nil {
+		table = DefaultScoreTable()
+	}
+	return table[r]
+}
+
 var qualToResult = map[byte]Result{
 	'+': Pass,
 	'-': Fail,
@@ -85,29 +167,139 @@ var qualToResult = map[byte]Result{
 }
 
 var (
-	errLookupLimitReached = fmt.Errorf("lookup limit reached")
-	errUnknownField       = fmt.Errorf("unknown field")
-	errInvalidIP          = fmt.Errorf("invalid ipX value")
-	errInvalidMask        = fmt.Errorf("invalid mask")
-	errInvalidMacro       = fmt.Errorf("invalid macro")
-	errInvalidDomain      = fmt.Errorf("invalid domain")
-	errNoResult           = fmt.Errorf("no DNS record found")
-	errMultipleRecords    = fmt.Errorf("multiple matching DNS records")
-	errTooManyMXRecords   = fmt.Errorf("too many MX records")
-
-	errMatchedAll    = fmt.Errorf("matched 'all'")
-	errMatchedA      = fmt.Errorf("matched 'a'")
-	errMatchedIP     = fmt.Errorf("matched 'ip'")
-	errMatchedMX     = fmt.Errorf("matched 'mx'")
-	errMatchedPTR    = fmt.Errorf("matched 'ptr'")
-	errMatchedExists = fmt.Errorf("matched 'exists'")
+	errLookupLimitReached     = fmt.Errorf("lookup limit reached")
+	errUnknownField           = fmt.Errorf("unknown field")
+	errInvalidIP              = fmt.Errorf("invalid ipX value")
+	errInvalidMask            = fmt.Errorf("invalid mask")
+	errInvalidMacro           = fmt.Errorf("invalid macro")
+	errInvalidDomain          = fmt.Errorf("invalid domain")
+	errNoResult               = fmt.Errorf("no DNS record found")
+	errMultipleRecords        = fmt.Errorf("multiple matching DNS records")
+	errTooManyMXRecords       = fmt.Errorf("too many MX records")
+	errInvalidSeparator       = fmt.Errorf("invalid field separator")
+	errInvalidIdentity        = fmt.Errorf("invalid identity domain")
+	errAddressLiteral         = fmt.Errorf("identity domain is an address literal")
+	errPtrDisabled            = fmt.Errorf("ptr mechanism disabled")
+	errTrustedNetwork         = fmt.Errorf("ip is in a trusted network")
+	errNearMissRecord         = fmt.Errorf("found a malformed SPF record")
+	errNearMissOnly           = fmt.Errorf("no SPF record found, only a malformed one")
+	errVoidLookupLimitReached = fmt.Errorf("void lookup limit reached")
+	errRedirectNoRecord       = fmt.Errorf("redirect target has no SPF record")
+	errLocalAddress           = fmt.Errorf("ip is a local address")
+	errPrivateAddress         = fmt.Errorf("ip is a private or reserved address")
+	errMaxDurationExceeded    = fmt.Errorf("maximum duration exceeded")
+	errRecordTooLong          = fmt.Errorf("record too long")
+	errPlusAll                = fmt.Errorf("+all is not allowed")
+	errTargetNotAllowed       = fmt.Errorf("target domain not allowed")
+	errNoExplanation          = fmt.Errorf("no explanation record found")
+	errMaxDepthExceeded       = fmt.Errorf("maximum include/redirect depth exceeded")
+	errMaxTermsExceeded       = fmt.Errorf("maximum number of terms exceeded")
+	errInvalidClientIP        = fmt.Errorf("invalid client ip address")
+	errDuplicateModifier      = fmt.Errorf("modifier appears more than once")
+	errTooManyAnswers         = fmt.Errorf("too many answers in a DNS response")
+
+	errMatchedAll     = fmt.Errorf("matched 'all'")
+	errMatchedA       = fmt.Errorf("matched 'a'")
+	errMatchedIP      = fmt.Errorf("matched 'ip'")
+	errMatchedMX      = fmt.Errorf("matched 'mx'")
+	errMatchedPTR     = fmt.Errorf("matched 'ptr'")
+	errMatchedExists  = fmt.Errorf("matched 'exists'")
+	errMatchedHandler = fmt.Errorf("matched by the unknown field handler")
 )
 
+// FieldError is returned when a record contains a field that is not valid,
+// like an unknown mechanism or an ip4 with an invalid mask. It indicates
+// which field it is, and in which domain's record (which can be a nested
+// one, like the target of an include).
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type FieldError struct {
+	// Domain whose record contains the field.
+	Domain string
+
+	// The field, without its qualifier (unless the field is only a
+	// qualifier).
+	Field string
+
+	// Reason why the field is not valid.
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("in %s: %v %q", e.Domain, e.Err, e.Field)
+}
+
+// Unwrap returns the reason why the field is not valid.
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// isError returns true if err is target, or wraps it (like FieldError does).
+// It is like errors.Is, which we can't use because it needs Go 1.13.
+func isError(err, target error) bool {
+	for err != target {
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return true
+}
+
+// RedirectError is returned when the target of a redirect has no SPF record,
+// which results in PermError. This is usually because the target's record
+// was removed or is misconfigured.
+// https://tools.ietf.org/html/rfc7208#section-6.1
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type RedirectError struct {
+	// Domain whose record contains the redirect.
+	Domain string
+
+	// Target of the redirect, with the macros expanded.
+	Target string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("in %s: redirect target %s has no SPF record",
+		e.Domain, e.Target)
+}
+
+// Unwrap returns the generic error for redirects without a record.
+func (e *RedirectError) Unwrap() error {
+	return errRedirectNoRecord
+}
+
 // Default value for the maximum number of DNS lookups while resolving SPF.
 // RFC is quite clear 10 must be the maximum allowed.
 // https://tools.ietf.org/html/rfc7208#section-4.6.4
 const defaultMaxLookups = 10
 
+// Maximum number of names from the reverse lookup to consider when
+// evaluating ptr.
+// https://tools.ietf.org/html/rfc7208#section-4.6.4
+const maxPTRNames = 10
+
+// Default value for the maximum number of "void lookups" (lookups that return
+// no answers) while resolving SPF.
+// https://tools.ietf.org/html/rfc7208#section-4.6.4
+const defaultMaxVoidLookups = 2
+
+// Default value for the maximum number of answers processed from a single
+// DNS query. Real answers are nowhere near this, it is only meant to bound
+// the work done with unreasonably large ones.
+const defaultMaxAnswers = 1000
+
+// Maximum length of a record. Records come from untrusted sources, so we
+// bound their size; this is the maximum size of a DNS message, so no real
+// record can be longer.
+const maxRecordLength = 65535
+
+// Maximum length of a domain name resulting from macro expansion.
+// https://tools.ietf.org/html/rfc7208#section-7.3
+const maxDomainLength = 253
+
 // Option type, for setting options. Users are expected to treat this as an
 // opaque type and not rely on the implementation, which is subject to change.
 type Option func(*resolution)
@@ -123,14 +315,8 @@ type Option func(*resolution)
 // Deprecated: use CheckHostWithSender instead.
 func CheckHost(ip net.IP, domain string) (Result, error) {
 	trace("check host %q %q", ip, domain)
-	r := &resolution{
-		ip:       ip,
-		maxcount: defaultMaxLookups,
-		sender:   "@" + domain,
-		ctx:      context.TODO(),
-		resolver: defaultResolver,
-	}
-	return r.Check(domain)
+	r := newResolution(ip, "@"+domain, nil)
+	return r.checkTopLevel(domain)
 }
 
 // CheckHostWithSender fetches SPF records for `sender`'s domain, parses them,
@@ -140,28 +326,38 @@ func CheckHost(ip net.IP, domain string) (Result, error) {
 // The `opts` optional parameter can be used to adjust some specific
 // behaviours, such as the maximum number of DNS lookups allowed.
 //
+// If `ip` is not valid (for example, nil because net.ParseIP failed), the
+// result is None with an error, and no queries are done. The same happens
+// if the domain to check is not well-formed, or is an address literal (like
+// a HELO of "[192.0.2.1]").
+//
 // Reference: https://tools.ietf.org/html/rfc7208#section-4
 func CheckHostWithSender(ip net.IP, helo, sender string, opts ...Option) (Result, error) {
-	_, domain := split(sender)
-	if domain == "" {
-		domain = helo
-	}
-
-	trace("check host with sender %q %q %q (%q)", ip, helo, sender, domain)
-	r := &resolution{
-		ip:       ip,
-		maxcount: defaultMaxLookups,
-		sender:   sender,
-		ctx:      context.TODO(),
-		//resolver: defaultResolver,
-		resolver: net.DefaultResolver,
-	}
+	res, _, err := CheckHostDetailed(ip, helo, sender, opts...)
+	return res, err
+}
 
-	for _, opt := range opts {
-		opt(r)
+// CheckMany evaluates the SPF records for `domain` against each of the given
+// `ips`, and returns the results in the same order.
+//
+// It is equivalent to calling CheckHost for each ip, but the DNS answers are
+// shared across the batch, so the records (and other ip-independent queries
+// like the ones needed for include, a and mx) are only fetched once.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func CheckMany(ips []net.IP, domain string, opts ...Option) []Result {
+	var cache DNSResolver
+	results := make([]Result, len(ips))
+	for i, ip := range ips {
+		trace("check many %q %q", ip, domain)
+		r := newResolution(ip, "@"+domain, opts)
+		if cache == nil {
+			cache = newCachingResolver(r.resolver)
+		}
+		r.resolver = cache
+		results[i], _ = r.checkTopLevel(domain)
 	}
-
-	return r.Check(domain)
+	return results
 }
 
 // OverrideLookupLimit overrides the maximum number of DNS lookups allowed
@@ -176,6 +372,21 @@ func OverrideLookupLimit(limit uint) Option {
 	}
 }
 
+// WithMaxVoidLookups is an option to set the maximum number of void lookups
+// (lookups that return no answers) allowed during SPF evaluation. Going over
+// it results in PermError. The default is 2, as the RFC suggests.
+// https://tools.ietf.org/html/rfc7208#section-4.6.4
+//
+// A higher value can be used to relax the limit for known-good records, and
+// 0 makes any void lookup an error.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithMaxVoidLookups(n uint) Option {
+	return func(r *resolution) {
+		r.maxvoid = n
+	}
+}
+
 // WithContext is an option to set the context for this operation, which will
 // be passed along to the resolver functions and other external calls if
 // needed.
@@ -187,8 +398,421 @@ func WithContext(ctx context.Context) Option {
 	}
 }
 
+// WithPermErrorResult is an option to replace a PermError outcome with the
+// given result (commonly Fail or None). Only the final result is affected:
+// PermErrors within include and redirect are still handled as the RFC
+// specifies. The error returned is not changed.
+//
+// This is a local policy knob, and not an RFC-compliance change; it is
+// equivalent to the caller remapping the result after the check.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithPermErrorResult(result Result) Option {
+	return func(r *resolution) {
+		r.permErrorResult = result
+	}
+}
+
+// WithNoRecordResult is an option to replace the None outcome when the
+// domain has no SPF record (or it doesn't exist) with the given result, like
+// Neutral. None results caused by the inputs (like an invalid domain) are
+// not affected. The error returned is not changed.
+//
+// This is a local policy knob, like WithPermErrorResult. By default, and as
+// the RFC specifies, the result is None.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithNoRecordResult(result Result) Option {
+	return func(r *resolution) {
+		r.noRecordResult = result
+	}
+}
+
+// WithUnknownMechanism is an option to replace the result when the domain's
+// evaluation ends in PermError because of an unknown mechanism (or a
+// mechanism that could not be parsed as such), with the given result, like
+// Fail to treat records we don't understand conservatively.
+//
+// As with WithPermErrorResult, only the final result is affected, and
+// within include and redirect the PermError is still handled as the RFC
+// specifies. This takes precedence over WithPermErrorResult.
+//
+// This is a local policy knob, and deviates from the RFC, which requires
+// PermError in this case.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithUnknownMechanism(result Result) Option {
+	return func(r *resolution) {
+		r.unknownResult = result
+	}
+}
+
+// WithStrictParsing is an option to parse the records strictly, following the
+// syntax in RFC 7208 section 12, and return PermError for records that don't
+// conform to it. TXT records that look like SPF but are not valid (like
+// "spf1 -all") are also a PermError, instead of being ignored, and so are
+// records with the version not in lowercase (like "v=SPF1 -all").
+//
+// By default, parsing is lenient: for example, fields can be separated by any
+// whitespace, not just spaces, and "a" and "mx" mechanisms with an empty
+// domain after the ":" (like "a:") or a trailing ":" (like
+// "a:example.com:") are tolerated. The strict mode is useful for zone operators
+// to catch subtly malformed records.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithStrictParsing() Option {
+	return func(r *resolution) {
+		r.strict = true
+	}
+}
+
+// WithPtrDisabled is an option to refuse evaluating "ptr" mechanisms, which
+// are deprecated, expensive in terms of DNS queries, and can be abused.
+// If permError is true, finding a ptr mechanism results in PermError.
+// Otherwise, ptr mechanisms are skipped (as if they did not match), and the
+// evaluation continues.
+//
+// By default, ptr mechanisms are evaluated, as the RFC requires.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithPtrDisabled(permError bool) Option {
+	return func(r *resolution) {
+		r.ptrDisabled = true
+		r.ptrPermError = permError
+	}
+}
+
+// WithTrustedNetworks is an option to skip the check for IPs within the given
+// networks, and return the given result instead (typically Pass), without
+// consulting the records.
+//
+// This is a local policy override, not part of SPF semantics. It is useful to
+// avoid false failures on mail coming from trusted forwarders, where the
+// connecting IP is the forwarder's and not the origin's.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithTrustedNetworks(nets []net.IPNet, result Result) Option {
+	return func(r *resolution) {
+		r.trustedNets = nets
+		r.trustedResult = result
+	}
+}
+
+// WithLocalAddressesNone is an option to return None for link-local and
+// IPv6 unique-local source addresses, without consulting the records.
+// SPF is meaningless for them, as they can't be listed in public records.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithLocalAddressesNone() Option {
+	return func(r *resolution) {
+		r.localNone = true
+	}
+}
+
+// WithSkipPrivateIPs is an option to return the given result (None if
+// empty) for source addresses within the given networks, without
+// consulting the records. If nets is nil, the ones returned by
+// PrivateNetworks are used.
+//
+// SPF can't be meaningfully checked for private or reserved addresses (for
+// example, mail from internal relays), so this avoids doing pointless
+// lookups, and clearly signals that SPF is not applicable.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithSkipPrivateIPs(result Result, nets []net.IPNet) Option {
+	if result == "" {
+		result = None
+	}
+	if nets == nil {
+		nets = PrivateNetworks()
+	}
+	return func(r *resolution) {
+		r.privateNets = nets
+		r.privateResult = result
+	}
+}
+
+// Networks returned by PrivateNetworks.
+// https://www.iana.org/assignments/iana-ipv4-special-registry/
+// https://www.iana.org/assignments/iana-ipv6-special-registry/
+var privateNetworks = []string{
+	"0.0.0.0/8",       // "This network".
+	"10.0.0.0/8",      // Private-use, RFC 1918.
+	"100.64.0.0/10",   // Shared address space (CGNAT).
+	"127.0.0.0/8",     // Loopback.
+	"169.254.0.0/16",  // Link-local.
+	"172.16.0.0/12",   // Private-use, RFC 1918.
+	"192.0.0.0/24",    // IETF protocol assignments.
+	"192.0.2.0/24",    // Documentation (TEST-NET-1).
+	"192.168.0.0/16",  // Private-use, RFC 1918.
+	"198.18.0.0/15",   // Benchmarking.
+	"198.51.100.0/24", // Documentation (TEST-NET-2).
+	"203.0.113.0/24",  // Documentation (TEST-NET-3).
+	"224.0.0.0/4",     // Multicast.
+	"240.0.0.0/4",     // Reserved, and limited broadcast.
+	"::/128",          // Unspecified.
+	"::1/128",         // Loopback.
+	"100::/64",        // Discard-only.
+	"2001:db8::/32",   // Documentation.
+	"fc00::/7",        // Unique-local.
+	"fe80::/10",       // Link-local.
+	"ff00::/8",        // Multicast.
+}
+
+// PrivateNetworks returns the private and reserved networks used by default
+// by WithSkipPrivateIPs: the ones of the IANA special-purpose address
+// registries which are not globally reachable, and multicast.
+// The returned slice is new on every call, so it can be modified (for
+// example, to add or remove networks) and then given to WithSkipPrivateIPs.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func PrivateNetworks() []net.IPNet {
+	nets := make([]net.IPNet, 0, len(privateNetworks))
+	for _, s := range privateNetworks {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+// WithDomainFallback is an option to check the given domains, in order, when
+// the domain being checked results in None (for example, because it has no
+// SPF record). The first result other than None is returned.
+//
+// This is useful for organizations that only publish SPF records for their
+// organizational domain, which can be found with the orgdomain package.
+// Note this is a local policy extension, and deviates from the RFC: the
+// result is not the one that the domain owner published.
+//
+// Each fallback domain is checked as a separate evaluation, with its own
+// lookup limits. Details.Record and Details.Identity refer to the domain
+// that gave the result.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithDomainFallback(domains ...string) Option {
+	return func(r *resolution) {
+		r.fallbackDomains = domains
+	}
+}
+
+// WithDefaultQualifier is an option to set the result of mechanisms that
+// don't have an explicit qualifier, instead of Pass. For example, with
+// SoftFail an "a" mechanism that matches results in SoftFail, while "+a"
+// still results in Pass.
+//
+// This is meant for diagnostics and testing ("what if"), and deviates from
+// the RFC, which specifies that the default qualifier is "+".
+// https://tools.ietf.org/html/rfc7208#section-4.6.2
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithDefaultQualifier(result Result) Option {
+	return func(r *resolution) {
+		r.defaultQualifier = result
+	}
+}
+
+// WithMaxDuration is an option to limit the total time the evaluation can
+// take, starting when the check function is called. If it is exceeded, the
+// evaluation stops and TempError is returned.
+//
+// This is checked between mechanisms, and before each DNS query, so it
+// bounds the total time regardless of how many queries are needed. A single
+// slow query can still take longer; use WithContext to bound that.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithMaxDuration(d time.Duration) Option {
+	return func(r *resolution) {
+		r.deadline = time.Now().Add(d)
+	}
+}
+
+// WithMaxDepth is an option to limit how deeply include and redirect can be
+// nested, independently of the lookup limit. If a record would be evaluated
+// beyond that depth, PermError is returned. The top-level record has depth
+// 0, so with a maximum of 1 the records it includes or redirects to cannot
+// include or redirect any further. Zero (the default) means no limit.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithMaxDepth(n uint) Option {
+	return func(r *resolution) {
+		r.maxDepth = n
+	}
+}
+
+// WithEarlyAbort is an option to limit the number of terms (mechanisms and
+// modifiers, including the ones in included records) that the evaluation
+// can go through, independently of the lookup limit. If it is exceeded, the
+// evaluation stops and the given result is returned, which should be
+// TempError or PermError (the latter if empty). Zero means no limit.
+//
+// This bounds the work done for records that are expensive to evaluate even
+// when the DNS answers are cached, like long chains of includes.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithEarlyAbort(maxTerms uint, result Result) Option {
+	if result == "" {
+		result = PermError
+	}
+	return func(r *resolution) {
+		r.maxTerms = maxTerms
+		r.abortResult = result
+	}
+}
+
+// WithErrorClassifier is an option to set the function used to tell if an
+// error returned by the resolver is temporary (like a timeout, which results
+// in TempError) or permanent (which usually means the name can't be used,
+// and results in None or no match).
+//
+// By default, only *net.DNSError errors can be temporary, as reported by
+// their Temporary method. Custom resolvers (see WithResolver) which return
+// other error types should use this option, so their transient errors are
+// not taken as permanent. The function replaces the default entirely, so it
+// has to handle *net.DNSError too if they are possible.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithErrorClassifier(classify func(err error) (temporary bool)) Option {
+	return func(r *resolution) {
+		r.classifyError = classify
+	}
+}
+
+// WithMaxAnswersPerLookup is an option to set the maximum number of answers
+// (TXT records, MX hosts, addresses or names) processed from a single DNS
+// query. If a query returns more than that, the result is PermError.
+//
+// This protects against resolvers (or attackers, via cache poisoning) that
+// return enormous responses. It is independent of the limits on MX and
+// PTR names from the RFC. The default is 1000; 0 means no limit.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithMaxAnswersPerLookup(n int) Option {
+	return func(r *resolution) {
+		r.maxAnswers = n
+	}
+}
+
+// WithRejectPlusAll is an option to return PermError when a "+all" mechanism
+// (or an "all" without qualifier) is reached, instead of Pass.
+//
+// Such records authorize every host on the internet, which is valid but
+// almost always a misconfiguration; this option makes it possible to treat
+// them as such. A warning is added to the details in either case.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithRejectPlusAll() Option {
+	return func(r *resolution) {
+		r.rejectPlusAll = true
+	}
+}
+
+// WithAllowedIncludes is an option to only allow include and redirect
+// targets within the given domains (or their subdomains). A record with an
+// include or redirect to any other domain results in PermError, with a
+// FieldError indicating the target.
+//
+// This is a local policy, useful to make sure records of controlled domains
+// only reference approved third parties. The default (nil) allows all
+// targets.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithAllowedIncludes(domains []string) Option {
+	return func(r *resolution) {
+		if domains == nil {
+			r.allowedTargets = nil
+			return
+		}
+		r.allowedTargets = []string{}
+		for _, d := range domains {
+			r.allowedTargets = append(r.allowedTargets,
+				strings.ToLower(strings.TrimSuffix(d, ".")))
+		}
+	}
+}
+
+// WithClock is an option to set the function used to get the current time,
+// which is used when expanding the "t" macro in explanations. The default
+// is time.Now. It is useful to get deterministic explanations, for example
+// in tests.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithClock(now func() time.Time) Option {
+	return func(r *resolution) {
+		r.now = now
+	}
+}
+
+// WithUnsupportedHandler is an option to set a function to handle fields
+// that are not known to this package, like custom or experimental
+// mechanisms, instead of returning PermError.
+//
+// The handler is given the whole field, including its qualifier. If it
+// returns false, the field is not known to the handler either, and the
+// result is PermError as usual. Otherwise, if the returned result is not
+// empty, the evaluation ends with that result; if it is empty, the field
+// didn't match and the evaluation continues with the next one.
+//
+// Note this deviates from the RFC, which specifies that unknown mechanisms
+// result in PermError.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithUnsupportedHandler(handler func(field string) (Result, bool)) Option {
+	return func(r *resolution) {
+		r.unknownHandler = handler
+	}
+}
+
+// ParseIP is like net.ParseIP, but it also accepts IPv6 addresses with a
+// zone (like "fe80::1%eth0"), which is discarded since it is not relevant
+// for SPF. This is useful to parse addresses of incoming connections before
+// passing them to the check functions. It returns nil if the address is not
+// valid.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func ParseIP(s string) net.IP {
+	if i := strings.LastIndex(s, "%"); i > 0 && strings.Contains(s, ":") {
+		if i == len(s)-1 {
+			return nil
+		}
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// WithFailClosed is an option to return TempError when the lookup of a
+// record fails with an unexpected error, instead of None.
+//
+// By default, and as the RFC specifies, errors that are not temporary are
+// handled as if the domain had no record, resulting in None. With this
+// option, only errors that clearly indicate that the domain does not exist
+// do so; the rest result in TempError, so the sender retries later instead
+// of the mail going through unchecked. Note this deviates from the RFC.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithFailClosed() Option {
+	return func(r *resolution) {
+		r.failClosed = true
+	}
+}
+
 // DNSResolver implements the methods we use to resolve DNS queries.
 // It is intentionally compatible with *net.Resolver.
+//
+// Other resolvers, like DNS-over-HTTPS clients, can be used by adapting
+// them to this interface (see the WithResolver examples). Their errors
+// should be *net.DNSError, with IsTemporary set as appropriate, and Err set
+// to "no such host" for names that don't exist (IsNotFound can be set
+// instead, with Go 1.13 or newer), since they affect the results.
+//
+// If the resolver also has a method
+// LookupIP(ctx context.Context, network, host string) ([]net.IP, error),
+// like *net.Resolver does, it is used for the "a" and "mx" mechanisms to
+// only look up the addresses of the family of the ip being checked (A for
+// IPv4, AAAA for IPv6), as the RFC specifies. That way, errors looking up
+// the other family don't affect the result.
 type DNSResolver interface {
 	LookupTXT(ctx context.Context, name string) ([]string, error)
 	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
@@ -196,6 +820,14 @@ type DNSResolver interface {
 	LookupAddr(ctx context.Context, addr string) (names []string, err error)
 }
 
+// familyResolver is implemented by resolvers which can look up addresses of
+// a single family. See DNSResolver.
+type familyResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// Resolver used when none is given with WithResolver. It is only replaced
+// by tests, never modified at runtime.
 var defaultResolver DNSResolver = net.DefaultResolver
 
 // WithResolver sets the resolver to use for DNS lookups. It can be useful for
@@ -226,6 +858,10 @@ type resolution struct {
 	count    uint
 	maxcount uint
 
+	// Number of void lookups, and the maximum allowed.
+	voidcount uint
+	maxvoid   uint
+
 	sender string
 
 	// Result of doing a reverse lookup for ip (so we only do it once).
@@ -236,31 +872,290 @@ type resolution struct {
 
 	// DNS resolver to use.
 	resolver DNSResolver
-}
 
-var aField = regexp.MustCompile(`^(a$|a:|a/)`)
+	// Result to return instead of PermError, if not empty.
+	permErrorResult Result
+
+	// Result to return instead of None when there's no record, if not
+	// empty.
+	noRecordResult Result
+
+	// Result to return instead of PermError caused by an unknown
+	// mechanism, if not empty.
+	unknownResult Result
+
+	// Parse records strictly.
+	strict bool
+
+	// Do not evaluate ptr mechanisms; if ptrPermError is set, return
+	// PermError when finding them, otherwise skip them.
+	ptrDisabled  bool
+	ptrPermError bool
+
+	// Return TempError on unexpected lookup errors, instead of None.
+	failClosed bool
+
+	// Trusted networks, and the result to return for IPs within them.
+	trustedNets   []net.IPNet
+	trustedResult Result
+
+	// Private networks, and the result to return for IPs within them.
+	privateNets   []net.IPNet
+	privateResult Result
+
+	// Return None for link-local and unique-local IPs.
+	localNone bool
+
+	// Domains to check, in order, if the domain results in None.
+	fallbackDomains []string
+
+	// Result of mechanisms without an explicit qualifier.
+	defaultQualifier Result
+
+	// Time by which the evaluation must be completed, if not zero.
+	deadline time.Time
+
+	// Return PermError when "+all" matches.
+	rejectPlusAll bool
+
+	// Domains allowed as include and redirect targets; nil means all.
+	allowedTargets []string
+
+	// Handler for fields we don't know about, if any.
+	unknownHandler func(field string) (Result, bool)
+
+	// Function returning the current time, used for the "t" macro.
+	now func() time.Time
+
+	// The "exp" modifier of the record that determines the domain's
+	// policy, and the domain of that record.
+	expSpec   string
+	expDomain string
+
+	// Nesting level of the include being evaluated; 0 means we are
+	// evaluating the domain's policy (directly or via redirect).
+	includeDepth uint
+
+	// Nesting level of include and redirect, and the maximum allowed (0
+	// means no limit).
+	depth    uint
+	maxDepth uint
+
+	// Number of times to retry DNS queries with temporary errors, and the
+	// initial wait between them.
+	retries int
+	backoff time.Duration
+
+	// Number of terms evaluated, the maximum allowed (0 means no limit),
+	// and the result to return if it is exceeded.
+	terms       uint
+	maxTerms    uint
+	abortResult Result
+
+	// Number of TXT records returned by the last query for SPF records.
+	txtCount int
+
+	// Function to tell if a DNS error is temporary, if not the default.
+	classifyError func(err error) bool
+
+	// Maximum number of answers processed from a single query (0 means no
+	// limit), and whether a query went over it.
+	maxAnswers      int
+	answersExceeded bool
+
+	// Collect the evaluation steps in the details.
+	collectSteps bool
+
+	// Measure the time of the DNS queries, and the query being measured
+	// and when it started.
+	timeQueries bool
+	query       string
+	queryStart  time.Time
+
+	// Hook to call before and after evaluating each mechanism, if any.
+	hook func(ev MechanismEvent) error
+
+	// Details about the resolution, returned by CheckHostDetailed.
+	details Details
+}
+
+// newResolution returns a new resolution for the given ip and sender, with
+// the default values and the given options applied.
+func newResolution(ip net.IP, sender string, opts []Option) *resolution {
+	r := &resolution{
+		ip:       normalizeIP(ip),
+		maxcount: defaultMaxLookups,
+		maxvoid:  defaultMaxVoidLookups,
+		sender:   sender,
+		ctx:      context.TODO(),
+		resolver: defaultResolver,
+
+		defaultQualifier: Pass,
+		maxAnswers:       defaultMaxAnswers,
+		now:              time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.retries > 0 {
+		r.resolver = newRetryingResolver(
+			r.resolver, r.retries, r.backoff, r.deadline, r.temporary)
+	}
+
+	return r
+}
+
+// normalizeIP returns the ip in its 4-byte form if it is an IPv4 address
+// (including IPv4-mapped IPv6 ones), or its 16-byte form otherwise, so
+// comparisons are consistent. It returns nil if the ip is not valid.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+var aField = regexp.MustCompile(`^(a$|a:|a/)`)
 var mxField = regexp.MustCompile(`^(mx$|mx:|mx/)`)
 var ptrField = regexp.MustCompile(`^(ptr$|ptr:)`)
 
-func (r *resolution) Check(domain string) (Result, error) {
+// validIP returns an error if the client ip is nil or malformed.
+func (r *resolution) validIP() error {
+	if r.ip == nil {
+		trace("invalid client ip")
+		return errInvalidClientIP
+	}
+	return nil
+}
+
+// checkTopLevel runs the check for the top-level domain, and applies the
+// local policy adjustments to the final result.
+func (r *resolution) checkTopLevel(domain string) (Result, error) {
+	// An invalid ip (usually from a failed net.ParseIP) results in None, as
+	// there's nothing to check; see validIP.
+	if err := r.validIP(); err != nil {
+		return None, err
+	}
+
+	for _, n := range r.trustedNets {
+		if n.Contains(r.ip) {
+			trace("ip %v in trusted network %v", r.ip, n.String())
+			return r.trustedResult, errTrustedNetwork
+		}
+	}
+
+	for _, n := range r.privateNets {
+		if n.Contains(r.ip) {
+			trace("ip %v in private network %v", r.ip, n.String())
+			return r.privateResult, errPrivateAddress
+		}
+	}
+
+	if r.localNone && isLocalIP(r.ip) {
+		trace("ip %v is a local address", r.ip)
+		return None, errLocalAddress
+	}
+
+	// A malformed domain results in None, without doing any queries.
+	// https://tools.ietf.org/html/rfc7208#section-4.3
+	if !isValidDomain(domain) {
+		trace("invalid identity domain %q", domain)
+		return None, errInvalidIdentity
+	}
+
+	// The HELO can be an address literal (like "[192.0.2.1]"), which can't
+	// be checked.
+	// https://tools.ietf.org/html/rfc7208#section-2.3
+	if isAddressLiteral(domain) {
+		trace("identity domain %q is an address literal", domain)
+		return None, errAddressLiteral
+	}
+
+	res, err := r.Check(domain)
+	for _, fd := range r.fallbackDomains {
+		if res != None {
+			break
+		}
+		if !isValidDomain(fd) {
+			trace("invalid fallback domain %q", fd)
+			continue
+		}
+		trace("%v for %q, falling back to %q", res, domain, fd)
+		domain = fd
+		r.count, r.voidcount = 0, 0
+		res, err = r.Check(domain)
+	}
+	r.details.setRecord(r.details.Records[domain])
+	if res == Pass {
+		r.details.Identity = domain
+		r.details.Authorized = isPositiveMatch(err)
+	}
+	if res == Fail {
+		r.details.Explanation, _ = r.explanation()
+	}
+	if res == None && r.noRecordResult != "" {
+		trace("no record, result remapped to %v", r.noRecordResult)
+		res = r.noRecordResult
+	}
+	if res == PermError && r.unknownResult != "" &&
+		isError(err, errUnknownField) {
+		trace("unknown mechanism permerror remapped to %v", r.unknownResult)
+		res = r.unknownResult
+	}
+	if res == PermError && r.permErrorResult != "" {
+		trace("permerror remapped to %v", r.permErrorResult)
+		res = r.permErrorResult
+	}
+	return res, err
+}
+
+func (r *resolution) Check(domain string) (res Result, err error) {
+	step := r.addStep(domain, "")
+	defer func() { r.endStep(step, res, err) }()
+
 	r.count++
 	trace("check %s %d", domain, r.count)
+	if r.expired() {
+		trace("maximum duration exceeded")
+		return TempError, errMaxDurationExceeded
+	}
 	txt, err := r.getDNSRecord(domain)
+	if r.depth == 0 {
+		r.details.TXTRecords = r.txtCount
+	}
+	if r.answersExceeded {
+		trace("permerror: %v", errTooManyAnswers)
+		return PermError, errTooManyAnswers
+	}
 	if err != nil {
-		if isTemporary(err) {
+		if r.temporary(err) {
 			trace("dns temp error: %v", err)
 			return TempError, err
 		}
-		if err == errMultipleRecords {
-			trace("multiple dns records")
+		if err == errMultipleRecords || err == errNearMissRecord {
+			trace("permerror: %v", err)
 			return PermError, err
 		}
+		if err == errNearMissOnly {
+			// Like having no record, but with a more specific error.
+			trace("only near-miss records")
+			return None, err
+		}
+		if r.failClosed && !isNotFound(err) {
+			trace("dns error, failing closed: %v", err)
+			return TempError, err
+		}
 		// Could not resolve the name, it may be missing the record.
 		// https://tools.ietf.org/html/rfc7208#section-2.6.1
 		trace("dns perm error: %v", err)
 		return None, err
 	}
 	trace("dns record %q", txt)
+	if step >= 0 {
+		r.details.Steps[step].Record = txt
+	}
 
 	if txt == "" {
 		// No record => None.
@@ -268,7 +1163,64 @@ func (r *resolution) Check(domain string) (Result, error) {
 		return None, errNoResult
 	}
 
-	fields := strings.Split(txt, " ")
+	return r.checkRecord(domain, txt)
+}
+
+// checkRecord evaluates the given SPF record, which was published for the
+// domain.
+func (r *resolution) checkRecord(domain, txt string) (res Result, err error) {
+	// The current term, for the evaluation steps.
+	step := -1
+	defer func() { r.endStep(step, res, err) }()
+
+	// The mechanism being evaluated, for the evaluation hook; if we return
+	// while it is set, it ended the evaluation.
+	hooked := ""
+	defer func() {
+		if hooked != "" {
+			r.hookAfter(domain, hooked, res, err)
+		}
+	}()
+
+	// The term being evaluated; if we return while it is set, it ended the
+	// evaluation.
+	term := ""
+	defer func() {
+		if term != "" {
+			r.setTerminal(domain, term)
+		}
+	}()
+
+	// A query with too many answers invalidates whatever the mechanism
+	// that made it decided.
+	defer func() {
+		if r.answersExceeded {
+			res, err = PermError, errTooManyAnswers
+		}
+	}()
+
+	if len(txt) > maxRecordLength {
+		trace("permerror, record too long (%d)", len(txt))
+		return PermError, errRecordTooLong
+	}
+
+	if r.details.Records == nil {
+		r.details.Records = map[string]string{}
+	}
+	r.details.Records[domain] = txt
+
+	fields, err := r.splitFields(txt)
+	if err != nil {
+		trace("permerror, %v", err)
+		return PermError, err
+	}
+
+	// The redirect and exp modifiers can appear at most once.
+	// https://tools.ietf.org/html/rfc7208#section-6
+	if field := duplicateModifier(fields); field != "" {
+		trace("permerror, duplicate modifier %q", field)
+		return PermError, &FieldError{domain, field, errDuplicateModifier}
+	}
 
 	// redirects must be handled after the rest; instead of having two loops,
 	// we just move them to the end.
@@ -280,14 +1232,21 @@ func (r *resolution) Check(domain string) (Result, error) {
 			newfields = append(newfields, field)
 		}
 	}
-	if len(redirects) > 1 {
-		// At most a single redirect is allowed.
-		// https://tools.ietf.org/html/rfc7208#section-6
-		return PermError, errInvalidDomain
-	}
 	fields = append(newfields, redirects...)
 
-	for _, field := range fields {
+	if r.includeDepth == 0 {
+		// This record determines the policy for the domain (it is either
+		// the top-level one, or the target of a redirect from it).
+		r.details.AllQualifier = allQualifier(fields, r.defaultQualifier)
+		r.expSpec, r.expDomain = expModifier(fields), domain
+	}
+
+	if ok, res, err := r.ipsOnly(fields, domain); ok {
+		trace("ips only, %v %v", res, err)
+		return res, err
+	}
+
+	for i, field := range fields {
 		if field == "" {
 			continue
 		}
@@ -299,77 +1258,413 @@ func (r *resolution) Check(domain string) (Result, error) {
 			continue
 		}
 
-		// Limit the number of resolutions.
-		// https://tools.ietf.org/html/rfc7208#section-4.6.4
-		if r.count > r.maxcount {
-			trace("lookup limit reached")
-			return PermError, errLookupLimitReached
-		}
+		term = ""
+		if err := r.hookNoMatch(domain, &hooked); err != nil {
+			trace("permerror, evaluation hook: %v", err)
+			return PermError, err
+		}
+
+		// Limit the number of resolutions.
+		// https://tools.ietf.org/html/rfc7208#section-4.6.4
+		if r.count > r.maxcount {
+			trace("lookup limit reached")
+			return PermError, errLookupLimitReached
+		}
+		if r.voidcount > r.maxvoid {
+			trace("void lookup limit reached")
+			return PermError, errVoidLookupLimitReached
+		}
+		if r.answersExceeded {
+			trace("too many answers")
+			return PermError, errTooManyAnswers
+		}
+		if r.expired() {
+			trace("maximum duration exceeded")
+			return TempError, errMaxDurationExceeded
+		}
+		if err := r.ctx.Err(); err != nil {
+			trace("context done: %v", err)
+			return TempError, err
+		}
+		r.terms++
+		if r.maxTerms > 0 && r.terms > r.maxTerms {
+			trace("maximum terms (%d) exceeded", r.maxTerms)
+			return r.abortResult, errMaxTermsExceeded
+		}
+
+		// See if we have a qualifier, defaulting to + (pass).
+		// https://tools.ietf.org/html/rfc7208#section-4.6.2
+		token := field
+		term = token
+		step = r.addStep(domain, token)
+		if r.hook != nil && !isModifier(token) {
+			if err := r.hookBefore(domain, token); err != nil {
+				trace("permerror, evaluation hook: %v", err)
+				return PermError, err
+			}
+			hooked = token
+		}
+		result, ok := qualToResult[field[0]]
+		if ok {
+			if len(field) == 1 {
+				// A qualifier without a mechanism.
+				trace("permerror, bare qualifier")
+				return PermError, &FieldError{domain, field, errUnknownField}
+			}
+			field = field[1:]
+		} else {
+			result = r.defaultQualifier
+		}
+
+		// Mechanism and modifier names are case-insensitive.
+		// https://tools.ietf.org/html/rfc7208#section-4.6.1
+		lfield := strings.ToLower(field)
+
+		if lfield == "all" {
+			// https://tools.ietf.org/html/rfc7208#section-5.1
+			trace("%v matched all", result)
+			if after := mechanisms(fields[i+1:]); len(after) > 0 {
+				r.warnf("%q: mechanisms after \"all\" are never "+
+					"evaluated: %s", txt, strings.Join(after, " "))
+			}
+			if result == Pass {
+				r.warnf("%q: +all authorizes every host on the internet",
+					txt)
+				if r.rejectPlusAll {
+					return PermError, errPlusAll
+				}
+			}
+			return result, errMatchedAll
+		} else if strings.HasPrefix(lfield, "include:") {
+			if ok, res, err := r.includeField(result, field, domain); ok {
+				trace("include ok, %v %v", res, err)
+				return res, err
+			}
+		} else if aField.MatchString(lfield) {
+			if ok, res, err := r.aField(result, field, domain); ok {
+				trace("a ok, %v %v", res, err)
+				return res, err
+			}
+		} else if mxField.MatchString(lfield) {
+			if ok, res, err := r.mxField(result, field, domain); ok {
+				trace("mx ok, %v %v", res, err)
+				return res, err
+			}
+		} else if strings.HasPrefix(lfield, "ip4:") || strings.HasPrefix(lfield, "ip6:") {
+			if ok, res, err := r.ipField(result, field, domain); ok {
+				trace("ip ok, %v %v", res, err)
+				return res, err
+			}
+		} else if ptrField.MatchString(lfield) {
+			if ok, res, err := r.ptrField(result, field, domain); ok {
+				trace("ptr ok, %v %v", res, err)
+				return res, err
+			}
+		} else if strings.HasPrefix(lfield, "exists:") {
+			if ok, res, err := r.existsField(result, field, domain); ok {
+				trace("exists ok, %v %v", res, err)
+				return res, err
+			}
+		} else if strings.HasPrefix(lfield, "exp=") {
+			trace("exp= not used, skipping")
+			continue
+		} else if strings.HasPrefix(lfield, "redirect=") {
+			trace("redirect, %q", field)
+			return r.redirectField(field, domain)
+		} else if r.unknownHandler != nil {
+			res, ok := r.unknownHandler(token)
+			trace("unknown field %q handled: %v %v", token, res, ok)
+			if !ok {
+				return PermError, &FieldError{domain, field, errUnknownField}
+			} else if res != "" {
+				return res, errMatchedHandler
+			}
+		} else {
+			// http://www.openspf.org/SPF_Record_Syntax
+			trace("permerror, unknown field")
+			return PermError, &FieldError{domain, field, errUnknownField}
+		}
+	}
+
+	term = ""
+	if err := r.hookNoMatch(domain, &hooked); err != nil {
+		trace("permerror, evaluation hook: %v", err)
+		return PermError, err
+	}
+
+	// The last mechanism may have gone over the void lookup limit.
+	if r.voidcount > r.maxvoid {
+		trace("void lookup limit reached")
+		return PermError, errVoidLookupLimitReached
+	}
+
+	// Got to the end of the evaluation without a result => Neutral.
+	// This includes records without any mechanisms, like a bare "v=spf1",
+	// which are valid and behave as "?all" (and not as having no record).
+	// https://tools.ietf.org/html/rfc7208#section-4.7
+	trace("fallback to neutral")
+	r.setFellThrough(domain)
+	return Neutral, nil
+}
+
+// setTerminal records the term that ended the evaluation of the policy
+// record in the details. Terms in included records are not recorded, since
+// the include is the one that ends the evaluation. A redirect is only
+// recorded if its target's record didn't end the evaluation itself (for
+// example, because it has none).
+func (r *resolution) setTerminal(domain, term string) {
+	if r.includeDepth > 0 {
+		return
+	}
+	if strings.HasPrefix(term, "redirect=") && (r.details.Terminal != "" || r.details.FellThrough) {
+		return
+	}
+	r.details.Terminal, r.details.TerminalDomain = term, domain
+	r.details.FellThrough = false
+}
+
+// setFellThrough records in the details that the evaluation of the policy
+// record got to its end without any term matching.
+func (r *resolution) setFellThrough(domain string) {
+	if r.includeDepth > 0 {
+		return
+	}
+	r.details.Terminal, r.details.TerminalDomain = "", domain
+	r.details.FellThrough = true
+}
+
+// ipsOnly evaluates records that consist only of ip4, ip6 and all
+// mechanisms, which are common for high-volume senders (for example, with
+// flattened records), without going through the general loop.
+// It returns false if the record has any other terms, or needs special
+// handling, in which case it must be evaluated by the general loop instead.
+// Since it does no lookups and has no side effects, the results are the
+// same either way.
+func (r *resolution) ipsOnly(fields []string, domain string) (bool, Result, error) {
+	if r.count > r.maxcount || r.voidcount > r.maxvoid || r.expired() ||
+		r.answersExceeded || r.collectSteps || r.hook != nil || r.maxTerms > 0 {
+		return false, "", nil
+	}
+
+	for _, field := range fields {
+		if field == "" || strings.HasPrefix(field, "v=") ||
+			strings.HasPrefix(field, "V=") {
+			continue
+		}
+		if _, ok := qualToResult[field[0]]; ok {
+			field = field[1:]
+		}
+		if len(field) < 3 {
+			return false, "", nil
+		}
+		switch strings.ToLower(field[:3]) {
+		case "ip4", "ip6":
+			if len(field) < 4 || field[3] != ':' {
+				return false, "", nil
+			}
+		case "all":
+			if len(field) != 3 {
+				return false, "", nil
+			}
+		case "exp":
+			if len(field) < 4 || field[3] != '=' {
+				return false, "", nil
+			}
+		default:
+			return false, "", nil
+		}
+	}
+
+	for i, field := range fields {
+		if field == "" || strings.HasPrefix(field, "v=") ||
+			strings.HasPrefix(field, "V=") {
+			continue
+		}
+
+		term := field
+		result, ok := qualToResult[field[0]]
+		if ok {
+			field = field[1:]
+		} else {
+			result = r.defaultQualifier
+		}
+
+		switch strings.ToLower(field[:3]) {
+		case "all":
+			if result == Pass || len(mechanisms(fields[i+1:])) > 0 {
+				// Leave the warnings to the general loop.
+				return false, "", nil
+			}
+			r.setTerminal(domain, term)
+			return true, result, errMatchedAll
+		case "exp":
+			continue
+		}
+
+		if ok, res, err := r.ipField(result, field, domain); ok {
+			r.setTerminal(domain, term)
+			return true, res, err
+		}
+	}
+
+	r.setFellThrough(domain)
+	return true, Neutral, nil
+}
+
+// duplicateModifier returns the first redirect or exp modifier among the
+// given fields that appears after another one of the same kind, or "" if
+// there is none.
+func duplicateModifier(fields []string) string {
+	seen := map[string]bool{}
+	for _, field := range fields {
+		lfield := strings.ToLower(field)
+		for _, name := range []string{"redirect=", "exp="} {
+			if !strings.HasPrefix(lfield, name) {
+				continue
+			}
+			if seen[name] {
+				return field
+			}
+			seen[name] = true
+		}
+	}
+	return ""
+}
+
+// mechanisms returns the mechanisms among the given fields (that is, the
+// ones which are not modifiers).
+func mechanisms(fields []string) []string {
+	mechs := []string{}
+	for _, field := range fields {
+		if field != "" && !isModifier(field) {
+			mechs = append(mechs, field)
+		}
+	}
+	return mechs
+}
+
+// splitFields splits the record into its fields.
+// In lenient mode, any whitespace is a separator. In strict mode, only spaces
+// are separators, and other whitespace is an error.
+// https://tools.ietf.org/html/rfc7208#section-12
+func (r *resolution) splitFields(txt string) ([]string, error) {
+	if !r.strict {
+		return strings.Fields(txt), nil
+	}
+
+	fields := strings.Split(txt, " ")
+	for _, field := range fields {
+		if strings.IndexFunc(field, unicode.IsSpace) >= 0 {
+			return nil, errInvalidSeparator
+		}
+	}
+	return fields, nil
+}
+
+// warnf adds a warning to the resolution details.
+func (r *resolution) warnf(format string, a ...interface{}) {
+	r.details.Warnings = append(r.details.Warnings, fmt.Sprintf(format, a...))
+}
+
+// allQualifier returns the result of the "all" mechanism in the given fields,
+// or "" if there is none. The default qualifier is used if "all" has none.
+func allQualifier(fields []string, defaultQualifier Result) Result {
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+		result, ok := qualToResult[field[0]]
+		if ok {
+			field = field[1:]
+		} else {
+			result = defaultQualifier
+		}
+		if strings.ToLower(field) == "all" {
+			return result
+		}
+	}
+	return ""
+}
+
+// isLocalIP returns true if the ip is link-local, or an IPv6 unique-local
+// address (fc00::/7).
+// https://tools.ietf.org/html/rfc4193
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() {
+		return true
+	}
+	return ip.To4() == nil && len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+// expModifier returns the value of the "exp" modifier in the given fields,
+// or "" if there is none.
+func expModifier(fields []string) string {
+	for _, field := range fields {
+		if strings.HasPrefix(strings.ToLower(field), "exp=") {
+			return field[len("exp="):]
+		}
+	}
+	return ""
+}
+
+// explanation returns the explanation for a Fail result, as given by the
+// "exp" modifier of the record that determined the domain's policy.
+// https://tools.ietf.org/html/rfc7208#section-6.2
+func (r *resolution) explanation() (string, error) {
+	if r.expSpec == "" {
+		return "", nil
+	}
+
+	domain, err := r.expandMacros(r.expSpec, r.expDomain)
+	if err != nil {
+		return "", err
+	}
+
+	// This lookup does not count towards the limit.
+	r.addQuery("TXT", domain)
+	txts, err := r.resolver.LookupTXT(r.ctx, domain)
+	r.endQuery()
+	if err != nil {
+		return "", err
+	}
+	if len(txts) != 1 {
+		return "", errNoExplanation
+	}
+
+	return r.expandExplanation(txts[0], r.expDomain)
+}
 
-		// See if we have a qualifier, defaulting to + (pass).
-		// https://tools.ietf.org/html/rfc7208#section-4.6.2
-		result, ok := qualToResult[field[0]]
-		if ok {
-			field = field[1:]
-		} else {
-			result = Pass
-		}
+// isValidDomain checks if the domain is a plausible DNS name: not empty,
+// within the length limits, and without empty labels or whitespace.
+// https://tools.ietf.org/html/rfc7208#section-4.3
+// https://tools.ietf.org/html/rfc1035#section-2.3.4
+func isValidDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
 
-		// Mechanism and modifier names are case-insensitive.
-		// https://tools.ietf.org/html/rfc7208#section-4.6.1
-		lfield := strings.ToLower(field)
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
 
-		if lfield == "all" {
-			// https://tools.ietf.org/html/rfc7208#section-5.1
-			trace("%v matched all", result)
-			return result, errMatchedAll
-		} else if strings.HasPrefix(lfield, "include:") {
-			if ok, res, err := r.includeField(result, field, domain); ok {
-				trace("include ok, %v %v", res, err)
-				return res, err
-			}
-		} else if aField.MatchString(lfield) {
-			if ok, res, err := r.aField(result, field, domain); ok {
-				trace("a ok, %v %v", res, err)
-				return res, err
-			}
-		} else if mxField.MatchString(lfield) {
-			if ok, res, err := r.mxField(result, field, domain); ok {
-				trace("mx ok, %v %v", res, err)
-				return res, err
-			}
-		} else if strings.HasPrefix(lfield, "ip4:") || strings.HasPrefix(lfield, "ip6:") {
-			if ok, res, err := r.ipField(result, field); ok {
-				trace("ip ok, %v %v", res, err)
-				return res, err
-			}
-		} else if ptrField.MatchString(lfield) {
-			if ok, res, err := r.ptrField(result, field, domain); ok {
-				trace("ptr ok, %v %v", res, err)
-				return res, err
-			}
-		} else if strings.HasPrefix(lfield, "exists:") {
-			if ok, res, err := r.existsField(result, field, domain); ok {
-				trace("exists ok, %v %v", res, err)
-				return res, err
-			}
-		} else if strings.HasPrefix(lfield, "exp=") {
-			trace("exp= not used, skipping")
-			continue
-		} else if strings.HasPrefix(lfield, "redirect=") {
-			trace("redirect, %q", field)
-			return r.redirectField(field, domain)
-		} else {
-			// http://www.openspf.org/SPF_Record_Syntax
-			trace("permerror, unknown field")
-			return PermError, errUnknownField
+	for _, c := range domain {
+		if c <= ' ' || c == 0x7f || unicode.IsSpace(c) {
+			return false
 		}
 	}
+	return true
+}
 
-	// Got to the end of the evaluation without a result => Neutral.
-	// https://tools.ietf.org/html/rfc7208#section-4.7
-	trace("fallback to neutral")
-	return Neutral, nil
+// isAddressLiteral returns true if the domain is an address literal, like
+// "[192.0.2.1]", or a bare IP address.
+func isAddressLiteral(domain string) bool {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		return true
+	}
+	return net.ParseIP(strings.TrimSuffix(domain, ".")) != nil
 }
 
 // getDNSRecord gets TXT records from the given domain, and returns the SPF
@@ -378,24 +1673,42 @@ func (r *resolution) Check(domain string) (Result, error) {
 // https://tools.ietf.org/html/rfc7208#section-3.2
 // https://tools.ietf.org/html/rfc7208#section-4.5
 func (r *resolution) getDNSRecord(domain string) (string, error) {
+	r.addQuery("TXT", domain)
 	txts, err := r.resolver.LookupTXT(r.ctx, domain)
+	r.endQuery()
+	r.txtCount = len(txts)
 	if err != nil {
 		return "", err
 	}
+	if r.tooManyAnswers(len(txts)) {
+		return "", errTooManyAnswers
+	}
 
 	records := []string{}
+	nearMiss := false
 	for _, txt := range txts {
-		// The version check should be case-insensitive (it's a
-		// case-insensitive constant in the standard).
-		// https://tools.ietf.org/html/rfc7208#section-12
-		if strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+		txt = joinTXT(txt)
+
+		if isSPFRecord(txt) {
 			records = append(records, txt)
+		} else if isNearMissRecord(txt) {
+			trace("near-miss record %q", txt)
+			r.warnf("%q: record looks like SPF but is not valid", txt)
+			nearMiss = true
+			continue
+		} else {
+			continue
 		}
 
-		// An empty record is explicitly allowed:
-		// https://tools.ietf.org/html/rfc7208#section-4.5
-		if strings.ToLower(txt) == "v=spf1" {
-			records = append(records, txt)
+		if !strings.HasPrefix(txt, "v=spf1") {
+			r.warnf("%q: version should be written as \"v=spf1\"", txt)
+
+			// The version is case-insensitive, but other casings are
+			// usually typos, which strict mode surfaces.
+			if r.strict {
+				trace("strict: version not in lowercase %q", txt)
+				return "", errNearMissRecord
+			}
 		}
 	}
 
@@ -405,35 +1718,190 @@ func (r *resolution) getDNSRecord(domain string) (string, error) {
 	// https://tools.ietf.org/html/rfc7208#section-4.5
 	l := len(records)
 	if l == 0 {
+		// Records that look like SPF but are not valid (like "v=spf1;")
+		// are treated as no record, but with a specific error; in strict
+		// mode they are a permanent error, so the misconfiguration doesn't
+		// go unnoticed.
+		if nearMiss && r.strict {
+			return "", errNearMissRecord
+		}
+		if nearMiss {
+			return "", errNearMissOnly
+		}
 		return "", nil
 	} else if l == 1 {
 		return records[0], nil
 	}
+
+	if r.details.ConflictingRecords == nil {
+		r.details.ConflictingRecords = map[string][]string{}
+	}
+	r.details.ConflictingRecords[domain] = records
 	return "", errMultipleRecords
 }
 
+// isSPFRecord returns true if the TXT record is an SPF record, that is, it
+// starts with the version followed by whitespace, or is only the version.
+// An empty record is explicitly allowed:
+// https://tools.ietf.org/html/rfc7208#section-4.5
+//
+// The version check is case-insensitive (it's a case-insensitive constant
+// in the standard).
+// https://tools.ietf.org/html/rfc7208#section-12
+//
+// The standard only allows spaces as separators, but we accept any
+// whitespace after the version, so records using other separators (like
+// tabs) are not silently ignored. In strict mode, they will be rejected
+// when splitting the fields.
+func isSPFRecord(txt string) bool {
+	if len(txt) < 6 || !strings.EqualFold(txt[:6], "v=spf1") {
+		return false
+	}
+	if len(txt) == 6 {
+		return true
+	}
+	c, _ := utf8.DecodeRuneInString(txt[6:])
+	return unicode.IsSpace(c)
+}
+
+// unquote removes a single layer of double quotes surrounding the TXT record,
+// which some DNS libraries and zone exports leave in. Records with quotes
+// inside are left alone.
+func unquote(txt string) string {
+	if len(txt) >= 2 && txt[0] == '"' && txt[len(txt)-1] == '"' &&
+		!strings.Contains(txt[1:len(txt)-1], `"`) {
+		return txt[1 : len(txt)-1]
+	}
+	return txt
+}
+
+// joinTXT returns the TXT record made of the given character-strings, which
+// are concatenated without adding spaces (removing any quotes left around
+// them, see unquote).
+// https://tools.ietf.org/html/rfc7208#section-3.3
+func joinTXT(strs ...string) string {
+	if len(strs) == 1 {
+		return unquote(strs[0])
+	}
+	var b strings.Builder
+	for _, s := range strs {
+		b.WriteString(unquote(s))
+	}
+	return b.String()
+}
+
+// isNearMissRecord returns true if the given TXT record looks like an
+// attempt to write an SPF record, but is not a valid one (for example,
+// "spf1 -all" or "v=spf1;-all").
+func isNearMissRecord(txt string) bool {
+	norm := strings.ToLower(strings.Join(strings.Fields(txt), ""))
+	return strings.HasPrefix(norm, "v=spf1") ||
+		strings.HasPrefix(norm, "spf1") ||
+		strings.HasPrefix(norm, "v:spf1")
+}
+
+// temporary returns true if the error is temporary, according to the
+// classifier set with WithErrorClassifier, or to isTemporary by default.
+func (r *resolution) temporary(err error) bool {
+	if r.classifyError != nil {
+		return r.classifyError(err)
+	}
+	return isTemporary(err)
+}
+
+// Message of the errors for names that don't exist, as set by net (see
+// isNotFound).
+const noSuchHost = "no such host"
+
 func isTemporary(err error) bool {
 	derr, ok := err.(*net.DNSError)
 	return ok && derr.Temporary()
 }
 
+// expired returns true if the maximum duration of the evaluation was
+// exceeded.
+func (r *resolution) expired() bool {
+	return !r.deadline.IsZero() && time.Now().After(r.deadline)
+}
+
+// targetAllowed returns true if the domain can be used as an include or
+// redirect target, as per WithAllowedIncludes.
+func (r *resolution) targetAllowed(target string) bool {
+	if r.allowedTargets == nil {
+		return true
+	}
+
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for _, d := range r.allowedTargets {
+		if target == d || strings.HasSuffix(target, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// byPreference returns the MX records sorted by preference, lowest first,
+// keeping the order of the ones with the same preference. All of them are
+// considered by the mx mechanism regardless of preference, but this way the
+// lookups are done in a predictable order, starting with the most relevant
+// hosts. The given slice is not modified.
+func byPreference(mxs []*net.MX) []*net.MX {
+	sorted := append([]*net.MX(nil), mxs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Pref < sorted[j].Pref
+	})
+	return sorted
+}
+
+// checkVoidLookup counts the lookup as void if it returned no answers, either
+// because there were none or because the name does not exist.
+// https://tools.ietf.org/html/rfc7208#section-4.6.4
+func (r *resolution) checkVoidLookup(nanswers int, err error) {
+	if nanswers == 0 && (err == nil || isNotFound(err)) {
+		r.voidcount++
+		trace("void lookup, count %d", r.voidcount)
+	}
+}
+
+// checkTargetVoidLookup counts the record lookup of an include or redirect
+// target as void, if it was the cause of the given error. A target with TXT
+// records, but none for SPF, is not a void lookup: the query had answers.
+// https://tools.ietf.org/html/rfc7208#section-4.6.4
+func (r *resolution) checkTargetVoidLookup(err error) {
+	if (err == errNoResult && r.txtCount == 0) || isNotFound(err) {
+		r.voidcount++
+		trace("void lookup, count %d", r.voidcount)
+	}
+}
+
+// fieldError wraps the error in a FieldError for the given field, if it is
+// about the field not being valid; other errors are returned as-is.
+func fieldError(domain, field string, err error) error {
+	if err == errInvalidMask || err == errInvalidIP || err == errUnknownField ||
+		err == errInvalidDomain {
+		return &FieldError{domain, field, err}
+	}
+	return err
+}
+
 // ipField processes an "ip" field.
-func (r *resolution) ipField(res Result, field string) (bool, Result, error) {
+func (r *resolution) ipField(res Result, field, domain string) (bool, Result, error) {
 	fip := field[4:]
+	sameFamily := familyMatches(field[:3], r.ip)
 	if strings.Contains(fip, "/") {
 		_, ipnet, err := net.ParseCIDR(fip)
 		if err != nil {
-			return true, PermError, errInvalidMask
+			return true, PermError, &FieldError{domain, field, errInvalidMask}
 		}
-		if ipnet.Contains(r.ip) {
+		if sameFamily && ipnet.Contains(r.ip) {
 			return true, res, errMatchedIP
 		}
 	} else {
 		ip := net.ParseIP(fip)
 		if ip == nil {
-			return true, PermError, errInvalidIP
+			return true, PermError, &FieldError{domain, field, errInvalidIP}
 		}
-		if ip.Equal(r.ip) {
+		if sameFamily && ip.Equal(r.ip) {
 			return true, res, errMatchedIP
 		}
 	}
@@ -441,8 +1909,26 @@ func (r *resolution) ipField(res Result, field string) (bool, Result, error) {
 	return false, "", nil
 }
 
+// familyMatches returns true if the ip is of the family of the given ip4 or
+// ip6 mechanism name (case-insensitive). IPv4-mapped IPv6 addresses are
+// IPv4, so they never match ip6 mechanisms, even those written in the mixed
+// notation (like "ip6:::ffff:192.0.2.0/120"), which net.IPNet.Contains
+// would otherwise match.
+// https://tools.ietf.org/html/rfc7208#section-5
+func familyMatches(name string, ip net.IP) bool {
+	return strings.EqualFold(name, "ip4") == (ip.To4() != nil)
+}
+
 // ptrField processes a "ptr" field.
 func (r *resolution) ptrField(res Result, field, domain string) (bool, Result, error) {
+	if r.ptrDisabled {
+		trace("ptr disabled, permerror: %v", r.ptrPermError)
+		if r.ptrPermError {
+			return true, PermError, errPtrDisabled
+		}
+		return false, "", nil
+	}
+
 	// Extract the domain if the field is in the form "ptr:domain".
 	ptrDomain := domain
 	if len(field) >= 4 {
@@ -458,37 +1944,9 @@ func (r *resolution) ptrField(res Result, field, domain string) (bool, Result, e
 		return true, PermError, errInvalidDomain
 	}
 
-	if r.ipNames == nil {
-		r.ipNames = []string{}
-		r.count++
-		ns, err := r.resolver.LookupAddr(r.ctx, r.ip.String())
-		if err != nil {
-			// https://tools.ietf.org/html/rfc7208#section-5
-			if isTemporary(err) {
-				return true, TempError, err
-			}
-			return false, "", err
-		}
-		for _, n := range ns {
-			// Validate the record by doing a forward resolution: it has to
-			// have some A/AAAA.
-			// https://tools.ietf.org/html/rfc7208#section-5.5
-			if r.count > 10 {
-				return false, "", errLookupLimitReached
-			}
-			r.count++
-			addrs, err := r.resolver.LookupIPAddr(r.ctx, n)
-			if err != nil {
-				// RFC explicitly says to skip domains which error here.
-				continue
-			}
-			trace("ptr forward resolution %q -> %q", n, addrs)
-			if len(addrs) > 0 {
-				// Append the lower-case variants so we do a case-insensitive
-				// lookup below.
-				r.ipNames = append(r.ipNames, strings.ToLower(n))
-			}
-		}
+	ok, result, err := r.lookupIPNames()
+	if ok || err != nil {
+		return ok, result, err
 	}
 
 	trace("ptr evaluating %q in %q", ptrDomain, r.ipNames)
@@ -502,6 +1960,127 @@ func (r *resolution) ptrField(res Result, field, domain string) (bool, Result, e
 	return false, "", nil
 }
 
+// lookupIPNames does the reverse lookup of r.ip, and the forward resolution
+// of the names it returns, leaving the validated names in r.ipNames.
+// It only does the lookups once per resolution, and the results are reused
+// afterwards (by all the ptr mechanisms, across includes). The reverse lookup
+// counts once against the lookup limit; the forward resolutions are bounded
+// by the limit on the number of names instead.
+// The return values follow the same semantics as the field processing
+// functions.
+func (r *resolution) lookupIPNames() (bool, Result, error) {
+	if r.ipNames != nil {
+		return false, "", nil
+	}
+
+	r.ipNames = []string{}
+	r.count++
+	r.addQuery("PTR", r.ip.String())
+	ns, err := r.resolver.LookupAddr(r.ctx, r.ip.String())
+	r.endQuery()
+	r.checkVoidLookup(len(ns), err)
+	if r.tooManyAnswers(len(ns)) {
+		return true, PermError, errTooManyAnswers
+	}
+	if err != nil {
+		// https://tools.ietf.org/html/rfc7208#section-5
+		if r.temporary(err) {
+			return true, TempError, err
+		}
+		return false, "", err
+	}
+
+	// Only process the first 10 names, and ignore the rest.
+	// https://tools.ietf.org/html/rfc7208#section-4.6.4
+	if len(ns) > maxPTRNames {
+		trace("ptr: too many names (%d), ignoring the extra ones", len(ns))
+		ns = ns[:maxPTRNames]
+	}
+	r.details.PTRNames = ns
+
+	for _, n := range ns {
+		if r.expired() {
+			return true, TempError, errMaxDurationExceeded
+		}
+
+		// Validate the record by doing a forward resolution: one of its
+		// addresses has to be the ip being checked.
+		// https://tools.ietf.org/html/rfc7208#section-5.5
+		r.addQuery("A/AAAA", n)
+		addrs, err := r.resolver.LookupIPAddr(r.ctx, n)
+		r.endQuery()
+		if r.tooManyAnswers(len(addrs)) {
+			return true, PermError, errTooManyAnswers
+		}
+		if err != nil {
+			// RFC explicitly says to skip domains which error here.
+			continue
+		}
+		trace("ptr forward resolution %q -> %q", n, addrs)
+		for _, addr := range addrs {
+			if addr.IP.Equal(r.ip) {
+				// Append the lower-case variants so we do a
+				// case-insensitive lookup below.
+				r.ipNames = append(r.ipNames, strings.ToLower(n))
+				break
+			}
+		}
+	}
+	r.details.PTRValidated = r.ipNames
+
+	return false, "", nil
+}
+
+// tooManyAnswers returns true if the number of answers of a query is over
+// the limit set with WithMaxAnswersPerLookup, and records it so the
+// evaluation results in PermError.
+func (r *resolution) tooManyAnswers(n int) bool {
+	if r.maxAnswers > 0 && n > r.maxAnswers {
+		trace("too many answers: %d > %d", n, r.maxAnswers)
+		r.answersExceeded = true
+	}
+	return r.answersExceeded
+}
+
+// lookupIP looks up the addresses of the host, for the "a" and "mx"
+// mechanisms. If the resolver supports it, only the family of the ip being
+// checked is looked up.
+// https://tools.ietf.org/html/rfc7208#section-5.3
+func (r *resolution) lookupIP(host string) ([]net.IP, error) {
+	if fr, ok := r.resolver.(familyResolver); ok {
+		network, qtype := "ip6", "AAAA"
+		if r.ip.To4() != nil {
+			network, qtype = "ip4", "A"
+		}
+		r.addQuery(qtype, host)
+		ips, err := fr.LookupIP(r.ctx, network, host)
+		r.endQuery()
+		if _, ok := err.(*net.AddrError); ok {
+			// The host only has addresses of the other family, which
+			// *net.Resolver reports as an error; for us it's an empty
+			// answer.
+			trace("no %s addresses for %q: %v", qtype, host, err)
+			ips, err = nil, nil
+		}
+		if r.tooManyAnswers(len(ips)) {
+			return nil, errTooManyAnswers
+		}
+		return ips, err
+	}
+
+	r.addQuery("A/AAAA", host)
+	addrs, err := r.resolver.LookupIPAddr(r.ctx, host)
+	r.endQuery()
+	if r.tooManyAnswers(len(addrs)) {
+		return nil, errTooManyAnswers
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, err
+}
+
 // existsField processes a "exists" field.
 // https://tools.ietf.org/html/rfc7208#section-5.7
 func (r *resolution) existsField(res Result, field, domain string) (bool, Result, error) {
@@ -517,10 +2096,16 @@ func (r *resolution) existsField(res Result, field, domain string) (bool, Result
 	}
 
 	r.count++
+	r.addQuery("A/AAAA", eDomain)
 	ips, err := r.resolver.LookupIPAddr(r.ctx, eDomain)
+	r.endQuery()
+	r.checkVoidLookup(len(ips), err)
+	if r.tooManyAnswers(len(ips)) {
+		return true, PermError, errTooManyAnswers
+	}
 	if err != nil {
 		// https://tools.ietf.org/html/rfc7208#section-5
-		if isTemporary(err) {
+		if r.temporary(err) {
 			return true, TempError, err
 		}
 		return false, "", err
@@ -535,6 +2120,16 @@ func (r *resolution) existsField(res Result, field, domain string) (bool, Result
 	return false, "", nil
 }
 
+// depthExceeded returns true if evaluating another nested record (via
+// include or redirect) would go over the maximum depth.
+func (r *resolution) depthExceeded() bool {
+	if r.maxDepth > 0 && r.depth >= r.maxDepth {
+		trace("maximum depth (%d) exceeded", r.maxDepth)
+		return true
+	}
+	return false
+}
+
 // includeField processes an "include" field.
 func (r *resolution) includeField(res Result, field, domain string) (bool, Result, error) {
 	// https://tools.ietf.org/html/rfc7208#section-5.2
@@ -543,17 +2138,34 @@ func (r *resolution) includeField(res Result, field, domain string) (bool, Resul
 	if err != nil {
 		return true, PermError, errInvalidMacro
 	}
+	if !r.targetAllowed(incdomain) {
+		trace("include target %q not allowed", incdomain)
+		return true, PermError, &FieldError{
+			domain, "include:" + incdomain, errTargetNotAllowed}
+	}
+	if r.depthExceeded() {
+		return true, PermError, errMaxDepthExceeded
+	}
+	r.includeDepth++
+	r.depth++
 	ir, err := r.Check(incdomain)
+	r.depth--
+	r.includeDepth--
+	// The include only matches if the included record results in Pass; the
+	// other definite results just mean it doesn't match, and the evaluation
+	// of the including record continues.
+	// https://tools.ietf.org/html/rfc7208#section-5.2 (table)
 	switch ir {
 	case Pass:
 		return true, res, err
 	case Fail, SoftFail, Neutral:
-		return false, ir, err
+		return false, "", nil
 	case TempError:
 		return true, TempError, err
 	case PermError:
 		return true, PermError, err
 	case None:
+		r.checkTargetVoidLookup(err)
 		return true, PermError, err
 	}
 
@@ -565,52 +2177,114 @@ type dualMasks struct {
 	v6 int
 }
 
+// ipMatch returns true if ip matches tomatch (an address resolved for an
+// "a" or "mx" mechanism) with the given masks. The IPv4 mask only applies
+// to IPv4 addresses, and the IPv6 mask to IPv6 ones; if the mask for the
+// family was not given, the addresses must be equal. Addresses of different
+// families never match.
+// https://tools.ietf.org/html/rfc7208#section-5.3
 func ipMatch(ip, tomatch net.IP, masks dualMasks) (bool, error) {
-	mask := -1
-	if tomatch.To4() != nil && masks.v4 >= 0 {
-		mask = masks.v4
-	} else if tomatch.To4() == nil && masks.v6 >= 0 {
-		mask = masks.v6
+	mask, bits := masks.v6, 128
+	if tomatch4 := tomatch.To4(); tomatch4 != nil {
+		mask, bits = masks.v4, 32
+		tomatch = tomatch4
+	}
+	if (ip.To4() != nil) != (bits == 32) {
+		return false, nil
 	}
 
 	if mask >= 0 {
-		_, ipnet, err := net.ParseCIDR(
-			fmt.Sprintf("%s/%d", tomatch.String(), mask))
-		if err != nil {
+		cidr := net.CIDRMask(mask, bits)
+		if cidr == nil {
 			return false, errInvalidMask
 		}
-		return ipnet.Contains(ip), nil
+		return tomatch.Mask(cidr).Equal(ip.Mask(cidr)), nil
 	}
 
 	return ip.Equal(tomatch), nil
 }
 
-var aRegexp = regexp.MustCompile(`^[aA](:([^/]+))?(/(\w+))?(//(\w+))?$`)
-var mxRegexp = regexp.MustCompile(`^[mM][xX](:([^/]+))?(/(\w+))?(//(\w+))?$`)
+// splitDomainAndMask splits an "a" or "mx" field into its optional domain,
+// IPv4 mask and IPv6 mask, in the form "name[:domain][/mask4][//mask6]".
+// The name must be the mechanism name, which the field starts with.
+// Returns false if the field is not in that form.
+func splitDomainAndMask(name, field string) (domain, mask4, mask6 string, ok bool) {
+	rest := field[len(name):]
+
+	if strings.HasPrefix(rest, ":") {
+		rest = rest[1:]
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			i = len(rest)
+		}
+		if i == 0 {
+			return "", "", "", false
+		}
+		domain, rest = rest[:i], rest[i:]
+	}
+
+	if strings.HasPrefix(rest, "/") && !strings.HasPrefix(rest, "//") {
+		rest = rest[1:]
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			i = len(rest)
+		}
+		mask4, rest = rest[:i], rest[i:]
+		if !isWord(mask4) {
+			return "", "", "", false
+		}
+	}
+
+	if strings.HasPrefix(rest, "//") {
+		mask6, rest = rest[2:], ""
+		if !isWord(mask6) {
+			return "", "", "", false
+		}
+	}
+
+	return domain, mask4, mask6, rest == ""
+}
+
+// isWord returns true if s is not empty and consists only of letters,
+// digits and underscores.
+func isWord(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' ||
+			c >= 'A' && c <= 'Z' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
 
-func domainAndMask(re *regexp.Regexp, field, domain string) (string, dualMasks, error) {
+// domainAndMask returns the domain and masks of an "a" or "mx" field (see
+// splitDomainAndMask), defaulting to the given domain if the field has none.
+func domainAndMask(name, field, domain string) (string, dualMasks, error) {
 	masks := dualMasks{-1, -1}
-	groups := re.FindStringSubmatch(field)
-	if groups != nil {
-		if groups[2] != "" {
-			domain = groups[2]
-		}
-		if groups[4] != "" {
-			mask4, err := strconv.Atoi(groups[4])
-			if err != nil || mask4 < 0 || mask4 > 32 {
+	fdomain, mask4, mask6, ok := splitDomainAndMask(name, field)
+	if ok {
+		if fdomain != "" {
+			domain = fdomain
+		}
+		if mask4 != "" {
+			m, err := strconv.Atoi(mask4)
+			if err != nil || m < 0 || m > 32 {
 				return "", masks, errInvalidMask
 			}
-			masks.v4 = mask4
+			masks.v4 = m
 		}
-		if groups[6] != "" {
-			mask6, err := strconv.Atoi(groups[6])
-			if err != nil || mask6 < 0 || mask6 > 128 {
+		if mask6 != "" {
+			m, err := strconv.Atoi(mask6)
+			if err != nil || m < 0 || m > 128 {
 				return "", masks, errInvalidMask
 			}
-			masks.v6 = mask6
+			masks.v6 = m
 		}
 	}
-	trace("masks on %q: %q %q %v", field, groups, domain, masks)
 
 	// Test to catch malformed entries: if there's a /, there must be at least
 	// one mask.
@@ -621,12 +2295,31 @@ func domainAndMask(re *regexp.Regexp, field, domain string) (string, dualMasks,
 	return domain, masks, nil
 }
 
+// checkDomainColon returns errInvalidDomain if the "a" or "mx" field has a
+// ":" without a domain after it (like "a:" or "mx:/24"), or a domain with a
+// trailing ":" (like "a:example.com:"). These are not valid, but they are
+// only rejected in strict mode: otherwise, the former is evaluated without
+// a domain, and the latter with the domain as written.
+func checkDomainColon(name, field string) error {
+	if !strings.HasPrefix(field[len(name):], ":") {
+		return nil
+	}
+	fdomain, _, _, ok := splitDomainAndMask(name, field)
+	if !ok || fdomain == "" || strings.HasSuffix(fdomain, ":") {
+		return errInvalidDomain
+	}
+	return nil
+}
+
 // aField processes an "a" field.
 func (r *resolution) aField(res Result, field, domain string) (bool, Result, error) {
 	// https://tools.ietf.org/html/rfc7208#section-5.3
-	aDomain, masks, err := domainAndMask(aRegexp, field, domain)
+	aDomain, masks, err := domainAndMask("a", field, domain)
+	if err == nil && r.strict {
+		err = checkDomainColon("a", field)
+	}
 	if err != nil {
-		return true, PermError, err
+		return true, PermError, fieldError(domain, field, err)
 	}
 	aDomain, err = r.expandMacros(aDomain, domain)
 	if err != nil {
@@ -634,21 +2327,22 @@ func (r *resolution) aField(res Result, field, domain string) (bool, Result, err
 	}
 
 	r.count++
-	ips, err := r.resolver.LookupIPAddr(r.ctx, aDomain)
+	ips, err := r.lookupIP(aDomain)
+	r.checkVoidLookup(len(ips), err)
 	if err != nil {
 		// https://tools.ietf.org/html/rfc7208#section-5
-		if isTemporary(err) {
+		if r.temporary(err) {
 			return true, TempError, err
 		}
 		return false, "", err
 	}
 	for _, ip := range ips {
-		ok, err := ipMatch(r.ip, ip.IP, masks)
+		ok, err := ipMatch(r.ip, ip, masks)
 		if ok {
-			trace("mx matched %v, %v, %v", r.ip, ip.IP, masks)
+			trace("mx matched %v, %v, %v", r.ip, ip, masks)
 			return true, res, errMatchedA
 		} else if err != nil {
-			return true, PermError, err
+			return true, PermError, fieldError(domain, field, err)
 		}
 	}
 
@@ -658,9 +2352,12 @@ func (r *resolution) aField(res Result, field, domain string) (bool, Result, err
 // mxField processes an "mx" field.
 func (r *resolution) mxField(res Result, field, domain string) (bool, Result, error) {
 	// https://tools.ietf.org/html/rfc7208#section-5.4
-	mxDomain, masks, err := domainAndMask(mxRegexp, field, domain)
+	mxDomain, masks, err := domainAndMask("mx", field, domain)
+	if err == nil && r.strict {
+		err = checkDomainColon("mx", field)
+	}
 	if err != nil {
-		return true, PermError, err
+		return true, PermError, fieldError(domain, field, err)
 	}
 	mxDomain, err = r.expandMacros(mxDomain, domain)
 	if err != nil {
@@ -668,35 +2365,46 @@ func (r *resolution) mxField(res Result, field, domain string) (bool, Result, er
 	}
 
 	r.count++
+	r.addQuery("MX", mxDomain)
 	mxs, err := r.resolver.LookupMX(r.ctx, mxDomain)
+	r.endQuery()
+	r.checkVoidLookup(len(mxs), err)
+	if r.tooManyAnswers(len(mxs)) {
+		return true, PermError, errTooManyAnswers
+	}
 	if err != nil {
 		// https://tools.ietf.org/html/rfc7208#section-5
-		if isTemporary(err) {
+		if r.temporary(err) {
 			return true, TempError, err
 		}
 		return false, "", err
 	}
 
-	// There's an explicit maximum of 10 MX records per match.
+	// The address lookups of the MX hosts don't count towards the lookup
+	// limit, but they have their own limit of 10 per mechanism. We look up
+	// all of them, so more than 10 MX records would exceed it.
 	// https://tools.ietf.org/html/rfc7208#section-4.6.4
 	if len(mxs) > 10 {
 		return true, PermError, errTooManyMXRecords
 	}
 
 	mxips := []net.IP{}
-	for _, mx := range mxs {
-		r.count++
-		ips, err := r.resolver.LookupIPAddr(r.ctx, mx.Host)
+	for _, mx := range byPreference(mxs) {
+		if r.expired() {
+			return true, TempError, errMaxDurationExceeded
+		}
+
+		ips, err := r.lookupIP(mx.Host)
 		if err != nil {
 			// https://tools.ietf.org/html/rfc7208#section-5
-			if isTemporary(err) {
+			if r.temporary(err) {
 				return true, TempError, err
 			}
-			return false, "", err
-		}
-		for _, ipaddr := range ips {
-			mxips = append(mxips, ipaddr.IP)
+			// The other hosts may still match.
+			trace("mx host %q: %v", mx.Host, err)
+			continue
 		}
+		mxips = append(mxips, ips...)
 	}
 	for _, ip := range mxips {
 		ok, err := ipMatch(r.ip, ip, masks)
@@ -704,7 +2412,7 @@ func (r *resolution) mxField(res Result, field, domain string) (bool, Result, er
 			trace("mx matched %v, %v, %v", r.ip, ip, masks)
 			return true, res, errMatchedMX
 		} else if err != nil {
-			return true, PermError, err
+			return true, PermError, fieldError(domain, field, err)
 		}
 	}
 
@@ -722,11 +2430,28 @@ func (r *resolution) redirectField(field, domain string) (Result, error) {
 	if rDomain == "" {
 		return PermError, errInvalidDomain
 	}
+	if !r.targetAllowed(rDomain) {
+		trace("redirect target %q not allowed", rDomain)
+		return PermError, &FieldError{
+			domain, "redirect=" + rDomain, errTargetNotAllowed}
+	}
+
+	if r.depthExceeded() {
+		return PermError, errMaxDepthExceeded
+	}
+
+	if r.includeDepth == 0 {
+		r.details.RedirectTarget = rDomain
+	}
 
 	// https://tools.ietf.org/html/rfc7208#section-6.1
+	r.depth++
 	result, err := r.Check(rDomain)
+	r.depth--
 	if result == None {
-		result = PermError
+		r.checkTargetVoidLookup(err)
+		trace("redirect target %q has no record: %v", rDomain, err)
+		return PermError, &RedirectError{domain, rDomain}
 	}
 	return result, err
 }
@@ -749,6 +2474,37 @@ func (r *resolution) expandMacros(s, domain string) (string, error) {
 		return "", errInvalidDomain
 	}
 
+	n, err := r.expand(s, domain, false)
+	if err != nil {
+		return "", err
+	}
+
+	// If the result is too long, remove labels from the left until it fits.
+	// https://tools.ietf.org/html/rfc7208#section-7.3
+	for len(n) > maxDomainLength {
+		i := strings.Index(n, ".")
+		if i < 0 {
+			return "", errInvalidDomain
+		}
+		n = n[i+1:]
+	}
+
+	trace("macro expanded %q to %q", s, n)
+	return n, nil
+}
+
+// expandExplanation expands the macros in an explanation string, where the
+// "c", "r" and "t" macros are also allowed.
+// https://tools.ietf.org/html/rfc7208#section-6.2
+func (r *resolution) expandExplanation(s, domain string) (string, error) {
+	n, err := r.expand(s, domain, true)
+	trace("explanation expanded %q to %q (%v)", s, n, err)
+	return n, err
+}
+
+// expand the macros in s. If exp is true, s is an explanation string;
+// otherwise it is a domain-spec.
+func (r *resolution) expand(s, domain string, exp bool) (string, error) {
 	// Bypass the complex logic if there are no macros present.
 	if !strings.Contains(s, "%") {
 		return s, nil
@@ -834,10 +2590,7 @@ func (r *resolution) expandMacros(s, domain string) (string, error) {
 			case "i":
 				str = r.ip.String()
 			case "p":
-				// This shouldn't be used, we don't want to support it, it's
-				// risky. "unknown" is a safe value.
-				// https://tools.ietf.org/html/rfc7208#section-7.3
-				str = "unknown"
+				str = r.validatedName(domain)
 			case "v":
 				if r.ip.To4() != nil {
 					str = "in-addr"
@@ -846,9 +2599,23 @@ func (r *resolution) expandMacros(s, domain string) (string, error) {
 				}
 			case "h":
 				str = domain
+			case "c", "r", "t":
+				// These are only allowed in explanation strings.
+				// https://tools.ietf.org/html/rfc7208#section-7.2
+				if !exp {
+					return "", errInvalidMacro
+				}
+				switch letter {
+				case "c":
+					str = r.ip.String()
+				case "r":
+					// We don't know the name of the receiving host, and
+					// this is the value the RFC says to use in that case.
+					str = "unknown"
+				case "t":
+					str = strconv.FormatInt(r.now().Unix(), 10)
+				}
 			default:
-				// c, r, t are allowed in exp only, and we don't expand macros
-				// in exp so they are just as invalid as the rest.
 				return "", errInvalidMacro
 			}
 
@@ -891,10 +2658,42 @@ func (r *resolution) expandMacros(s, domain string) (string, error) {
 		n += string(c)
 	}
 
-	trace("macro expanded %q to %q", s, n)
 	return n, nil
 }
 
+// validatedName returns the validated domain name of r.ip, for the "p"
+// macro. It uses the same validated names as the ptr mechanism (doing the
+// lookups if they weren't done already), preferring the domain itself, then
+// its subdomains. If there is none, or there are errors, it returns
+// "unknown".
+// This macro is expensive and should not be used, but we implement it
+// safely for compatibility.
+// https://tools.ietf.org/html/rfc7208#section-7.3
+func (r *resolution) validatedName(domain string) string {
+	r.lookupIPNames()
+
+	names := []string{}
+	for _, n := range r.ipNames {
+		names = append(names, strings.TrimSuffix(n, "."))
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, n := range names {
+		if n == domain {
+			return n
+		}
+	}
+	for _, n := range names {
+		if strings.HasSuffix(n, "."+domain) {
+			return n
+		}
+	}
+	if len(names) > 0 {
+		return names[0]
+	}
+	return "unknown"
+}
+
 func reverseStrings(a []string) {
 	for left, right := 0, len(a)-1; left < right; left, right = left+1, right-1 {
 		a[left], a[right] = a[right], a[left]
@@ -1,10 +1,15 @@
 package spf
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var ip1110 = net.ParseIP("1.1.1.0")
@@ -81,7 +86,7 @@ func TestBasic(t *testing.T) {
 		if res != c.res {
 			t.Errorf("%q: expected %q, got %q", c.txt, c.res, res)
 		}
-		if err != c.err {
+		if !isError(err, c.err) {
 			t.Errorf("%q: expected error [%v], got [%v]", c.txt, c.err, err)
 		}
 	}
@@ -119,9 +124,11 @@ func TestIPv6(t *testing.T) {
 	dns.ip["d6666"] = []net.IP{ip6666}
 	dns.ip["d6660"] = []net.IP{ip6660}
 	dns.mx["d6660"] = []*net.MX{mx("d6660", 5), mx("nothing", 10)}
-	dns.addr["2001:db8::68"] = []string{"sonlas6.", "domain.", "d6666."}
+	dns.addr["2001:db8::68"] = []string{
+		"sonlas6.", "domain.", "d6666.", "mail.domain."}
 	dns.ip["domain"] = []net.IP{ip1111}
 	dns.ip["sonlas6"] = []net.IP{ip6666}
+	dns.ip["mail.domain"] = []net.IP{ip6666}
 
 	for _, c := range cases {
 		dns.txt["domain"] = []string{c.txt}
@@ -132,7 +139,7 @@ func TestIPv6(t *testing.T) {
 		if res != c.res {
 			t.Errorf("%q: expected %q, got %q", c.txt, c.res, res)
 		}
-		if err != c.err {
+		if !isError(err, c.err) {
 			t.Errorf("%q: expected error [%v], got [%v]", c.txt, c.err, err)
 		}
 	}
@@ -205,7 +212,7 @@ func TestInvalidRedirect(t *testing.T) {
 	}
 
 	res, err = CheckHost(ip1111, "domain")
-	if res != PermError || err != errNoResult {
+	if res != PermError || !isError(err, errRedirectNoRecord) {
 		t.Errorf("expected permerror, got %v (%v)", res, err)
 	}
 }
@@ -279,6 +286,55 @@ func TestDNSTemporaryErrors(t *testing.T) {
 	}
 }
 
+func TestNestedTemporaryErrors(t *testing.T) {
+	// Temporary errors at any depth must result in TempError, and never
+	// fall through to the next mechanisms, so they can't be mistaken for a
+	// definite result.
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.errors["tmperr"] = &net.DNSError{
+		Err:         "temporary error for testing",
+		IsTemporary: true,
+	}
+	dns.mx["tmpmx"] = []*net.MX{mx("ok", 10), mx("tmperr", 20)}
+	dns.ip["ok"] = []net.IP{ip6666}
+
+	dns.txt["inc-a"] = []string{"v=spf1 a:tmperr -all"}
+	dns.txt["inc-mx"] = []string{"v=spf1 mx:tmpmx -all"}
+	dns.txt["inc-inc"] = []string{"v=spf1 ip4:1.2.3.4 include:inc-a -all"}
+	dns.txt["inc-exists"] = []string{"v=spf1 exists:tmperr -all"}
+	dns.txt["redir-mx"] = []string{"v=spf1 mx:tmpmx -all"}
+	dns.txt["redir-a"] = []string{"v=spf1 ip4:1.2.3.4 a:tmperr ~all"}
+	dns.txt["redir-redir"] = []string{"v=spf1 redirect=redir-mx"}
+	dns.txt["redir-inc"] = []string{"v=spf1 include:inc-mx -all"}
+
+	cases := []string{
+		"v=spf1 mx:tmperr -all",
+		"v=spf1 mx:tmpmx -all",
+		"v=spf1 ip4:1.2.3.4 mx:tmpmx ?all",
+		"v=spf1 include:tmperr -all",
+		"v=spf1 include:inc-a -all",
+		"v=spf1 include:inc-mx -all",
+		"v=spf1 include:inc-inc -all",
+		"v=spf1 include:inc-exists -all",
+		"v=spf1 -include:inc-a -all",
+		"v=spf1 redirect=tmperr",
+		"v=spf1 redirect=redir-mx",
+		"v=spf1 redirect=redir-a",
+		"v=spf1 redirect=redir-redir",
+		"v=spf1 redirect=redir-inc",
+		"v=spf1 ip4:1.2.3.4 redirect=redir-inc",
+	}
+	for _, txt := range cases {
+		dns.txt["domain"] = []string{txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != TempError || !isTemporary(err) {
+			t.Errorf("%q: expected temperror, got %v (%v)", txt, res, err)
+		}
+	}
+}
+
 func TestDNSPermanentErrors(t *testing.T) {
 	dns := NewDefaultResolver()
 	dnsError := &net.DNSError{
@@ -357,6 +413,36 @@ func TestMacros(t *testing.T) {
 	}
 }
 
+func TestExistsMacrosDefinite(t *testing.T) {
+	// exists and macros are fully supported, so records that depend on
+	// them get a definite result, and not Neutral.
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{
+		"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"}
+	dns.ip["1.1.1.1.user._spf.domain"] = []net.IP{ip1111}
+
+	cases := []struct {
+		ip     net.IP
+		sender string
+		res    Result
+		err    error
+	}{
+		{ip1111, "user@domain", Pass, errMatchedExists},
+		{ip1111, "user-ext@domain", Pass, errMatchedExists},
+		{ip1111, "other@domain", Fail, errMatchedAll},
+		{ip1110, "user@domain", Fail, errMatchedAll},
+	}
+	for _, c := range cases {
+		res, err := CheckHostWithSender(c.ip, "helo", c.sender)
+		if res != c.res || err != c.err {
+			t.Errorf("%v %q: expected %v/%v, got %v/%v",
+				c.ip, c.sender, c.res, c.err, res, err)
+		}
+	}
+}
+
 func TestMacrosV4(t *testing.T) {
 	dns := NewDefaultResolver()
 	trace = t.Logf
@@ -422,6 +508,13 @@ func TestIPMatchHelper(t *testing.T) {
 		{ip6666, ip6660, dualMasks{-1, -1}, false, nil},
 		{ip6666, ip6660, dualMasks{-1, 128}, false, nil},
 		{ip6666, ip6660, dualMasks{-1, 200}, false, errInvalidMask},
+
+		// Masks only apply to their family, and families never match.
+		{ip6666, ip6660, dualMasks{24, -1}, false, nil},
+		{ip1111, ip1110, dualMasks{-1, 24}, false, nil},
+		{ip1111, ip6660, dualMasks{0, 0}, false, nil},
+		{ip6666, ip1110, dualMasks{0, 0}, false, nil},
+		{ip1111, net.ParseIP("::ffff:1.1.1.0"), dualMasks{24, -1}, true, nil},
 	}
 	for _, c := range cases {
 		ok, err := ipMatch(c.ip, c.tomatch, c.masks)
@@ -539,3 +632,2391 @@ func TestWithResolver(t *testing.T) {
 		t.Errorf("expected pass, got %q / %q", res, err)
 	}
 }
+
+func TestWithPermErrorResult(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain1"] = []string{"v=spf1 include:domain2 -all"}
+	dns.txt["domain2"] = []string{"v=spf1 blah"}
+
+	// Without the option, we get the PermError.
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain1")
+	if res != PermError || !isError(err, errUnknownField) {
+		t.Errorf("expected permerror/unknown field, got %q / %q", res, err)
+	}
+
+	// With the option, the final result is remapped but the error is kept.
+	for _, want := range []Result{Fail, None} {
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain1",
+			WithPermErrorResult(want))
+		if res != want || !isError(err, errUnknownField) {
+			t.Errorf("expected %q/unknown field, got %q / %q", want, res, err)
+		}
+	}
+
+	// Other results are not affected.
+	dns.txt["domain2"] = []string{"v=spf1 +all"}
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain1",
+		WithPermErrorResult(Fail))
+	if res != Pass {
+		t.Errorf("expected pass, got %q / %q", res, err)
+	}
+}
+
+func TestWithNoRecordResult(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 -all"}
+	dns.txt["nospf"] = []string{"some-verification=1234"}
+	dns.errors["nxdomain"] = notFoundError("nxdomain")
+
+	cases := []struct {
+		sender string
+		res    Result
+		err    error
+	}{
+		{"user@nospf", Neutral, errNoResult},
+		{"user@nxdomain", Neutral, dns.errors["nxdomain"]},
+		{"user@domain", Fail, errMatchedAll},
+
+		// None because of the inputs, not remapped.
+		{"user@dom ain", None, errInvalidIdentity},
+		{"user@[1.2.3.4]", None, errAddressLiteral},
+	}
+	for _, c := range cases {
+		res, err := CheckHostWithSender(ip1111, "helo", c.sender,
+			WithNoRecordResult(Neutral))
+		if res != c.res || err != c.err {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.sender, c.res, c.err, res, err)
+		}
+	}
+
+	// By default, it's None.
+	res, err := CheckHostWithSender(ip1111, "helo", "user@nospf")
+	if res != None || err != errNoResult {
+		t.Errorf("expected none, got %v (%v)", res, err)
+	}
+}
+
+func TestWithUnknownMechanism(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 fooqux:bar -all"}
+	dns.txt["inc"] = []string{"v=spf1 include:domain ip4:1.1.1.0"}
+	dns.txt["badmask"] = []string{"v=spf1 ip4:1.1.1.1/99"}
+
+	cases := []struct {
+		domain string
+		ip     net.IP
+		opts   []Option
+		res    Result
+	}{
+		{"domain", ip1110, nil, PermError},
+		{"domain", ip1110, []Option{WithUnknownMechanism(Fail)}, Fail},
+		{"domain", ip1110, []Option{WithUnknownMechanism(Neutral)}, Neutral},
+		{"domain", ip1110, []Option{WithUnknownMechanism(PermError)},
+			PermError},
+
+		// Matches before the unknown mechanism are not affected.
+		{"domain", ip1111, []Option{WithUnknownMechanism(Fail)}, Pass},
+
+		// Within include, the PermError propagates as usual, and only the
+		// final result is remapped.
+		{"inc", ip1110, []Option{WithUnknownMechanism(Fail)}, Fail},
+
+		// Other PermErrors are not affected.
+		{"badmask", ip1110, []Option{WithUnknownMechanism(Fail)}, PermError},
+
+		// It takes precedence over WithPermErrorResult.
+		{"domain", ip1110, []Option{WithPermErrorResult(None),
+			WithUnknownMechanism(Fail)}, Fail},
+		{"badmask", ip1110, []Option{WithPermErrorResult(None),
+			WithUnknownMechanism(Fail)}, None},
+	}
+	for _, c := range cases {
+		res, err := CheckHostWithSender(c.ip, "helo", "a@"+c.domain,
+			c.opts...)
+		if res != c.res {
+			t.Errorf("%q %v %d opts: expected %v, got %v (%v)",
+				c.domain, c.ip, len(c.opts), c.res, res, err)
+		}
+	}
+}
+
+func TestCheckMany(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 include:domain2 a:d1111 -all"}
+	dns.txt["domain2"] = []string{"v=spf1 ip6:2001:db8::/32"}
+	dns.ip["d1111"] = []net.IP{ip1111}
+
+	ips := []net.IP{ip1111, ip1110, ip6666}
+	res := CheckMany(ips, "domain")
+	expected := []Result{Pass, Fail, Pass}
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d results, got %v", len(expected), res)
+	}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("%v: expected %v, got %v", ips[i], expected[i], res[i])
+		}
+	}
+
+	// The DNS queries must have been done only once, despite the 3 ips.
+	if dns.lookups["txt"] != 2 || dns.lookups["ip"] != 1 {
+		t.Errorf("unexpected number of lookups: %v", dns.lookups)
+	}
+}
+
+func setupBenchmarkDNS() []net.IP {
+	dns := NewDefaultResolver()
+	dns.txt["domain"] = []string{
+		"v=spf1 include:domain2 a:d1110 mx:d1110 -all"}
+	dns.txt["domain2"] = []string{"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32"}
+	dns.ip["d1110"] = []net.IP{ip1110}
+	dns.mx["d1110"] = []*net.MX{mx("d1110", 5)}
+
+	ips := []net.IP{}
+	for i := 0; i < 50; i++ {
+		ips = append(ips, net.IPv4(198, 51, 100, byte(i)))
+	}
+	return ips
+}
+
+func BenchmarkCheckMany(b *testing.B) {
+	ips := setupBenchmarkDNS()
+	trace = nullTrace
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CheckMany(ips, "domain")
+	}
+}
+
+func BenchmarkCheckHostLoop(b *testing.B) {
+	ips := setupBenchmarkDNS()
+	trace = nullTrace
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ip := range ips {
+			CheckHost(ip, "domain")
+		}
+	}
+}
+
+func TestPTRReverseLookupOnce(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.addr["1.1.1.1"] = []string{"lalala.", "d1111."}
+	dns.ip["lalala"] = []net.IP{ip1111}
+	dns.ip["d1111"] = []net.IP{ip1111}
+	dns.txt["domain"] = []string{"v=spf1 ptr:nomatch include:domain2 -all"}
+	dns.txt["domain2"] = []string{"v=spf1 ptr ptr:lalala"}
+
+	res, err := CheckHost(ip1111, "domain")
+	if res != Pass || err != errMatchedPTR {
+		t.Errorf("expected pass/matched ptr, got %v (%v)", res, err)
+	}
+	if dns.lookups["addr"] != 1 {
+		t.Errorf("expected 1 reverse lookup, got %d", dns.lookups["addr"])
+	}
+}
+
+func TestStrictParsing(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	cases := []struct {
+		txt     string
+		lenient Result
+		strict  Result
+	}{
+		{"v=spf1 ip4:1.1.1.1 -all", Pass, Pass},
+		{"v=spf1  ip4:1.1.1.1  -all ", Pass, Pass},
+		{"v=spf1 ip4:1.1.1.1\t-all", Pass, PermError},
+		{"v=spf1 ip4:1.2.3.4\t-all", Fail, PermError},
+		{"v=spf1 ip4:1.1.1.1\u00a0-all", Pass, PermError},
+		{"v=spf1 ip4:1.2.3.4\r\n-all", Fail, PermError},
+	}
+
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != c.lenient {
+			t.Errorf("%q lenient: expected %v, got %v (%v)",
+				c.txt, c.lenient, res, err)
+		}
+
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+			WithStrictParsing())
+		if res != c.strict {
+			t.Errorf("%q strict: expected %v, got %v (%v)",
+				c.txt, c.strict, res, err)
+		}
+		if res == PermError && err != errInvalidSeparator {
+			t.Errorf("%q strict: expected invalid separator, got %v",
+				c.txt, err)
+		}
+	}
+}
+
+func TestEmptyRecord(t *testing.T) {
+	// A record without mechanisms is valid, and results in Neutral for any
+	// ip, like "?all" would.
+	// https://tools.ietf.org/html/rfc7208#section-4.7
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["empty"] = []string{"v=spf1"}
+	dns.txt["trailing"] = []string{"v=spf1 "}
+	dns.txt["exp"] = []string{"v=spf1 exp=blah"}
+	dns.txt["inc"] = []string{"v=spf1 include:empty -all"}
+	dns.txt["redir"] = []string{"v=spf1 redirect=empty"}
+
+	cases := []struct {
+		domain string
+		res    Result
+	}{
+		{"empty", Neutral},
+		{"trailing", Neutral},
+		{"exp", Neutral},
+		{"redir", Neutral},
+
+		// An include of an empty record doesn't match.
+		{"inc", Fail},
+	}
+	for _, c := range cases {
+		for _, ip := range []net.IP{ip1111, ip1110, ip6666} {
+			res, details, err := CheckHostDetailed(ip, "helo", "user@"+c.domain)
+			if res != c.res {
+				t.Errorf("%q %v: expected %v, got %v (%v)",
+					c.domain, ip, c.res, res, err)
+			}
+			if c.res == Neutral && (err != nil || !details.FellThrough ||
+				details.AllQualifier != "") {
+				t.Errorf("%q %v: unexpected details: %v %v %q", c.domain,
+					ip, err, details.FellThrough, details.AllQualifier)
+			}
+		}
+	}
+}
+
+func TestStrictDomainAndMask(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.ip["domain"] = []net.IP{ip1111}
+	dns.ip["example.com"] = []net.IP{ip1111}
+	dns.mx["domain"] = []*net.MX{mx("example.com", 10)}
+	dns.mx["example.com"] = []*net.MX{mx("example.com", 10)}
+
+	cases := []struct {
+		txt     string
+		lenient Result
+		strict  Result
+		err     error
+	}{
+		// Valid forms.
+		{"v=spf1 a:example.com -all", Pass, Pass, nil},
+		{"v=spf1 mx:example.com -all", Pass, Pass, nil},
+		{"v=spf1 a:example.com/24 -all", Pass, Pass, nil},
+		{"v=spf1 mx:example.com//64 -all", Pass, Pass, nil},
+		{"v=spf1 a -all", Pass, Pass, nil},
+
+		// A trailing slash without a mask is always an error.
+		{"v=spf1 mx:example.com/ -all", PermError, PermError, errInvalidMask},
+		{"v=spf1 a:example.com/ -all", PermError, PermError, errInvalidMask},
+
+		// A trailing colon, or a colon without domain, are only an error in
+		// strict mode. Otherwise, "a:example.com:" looks up a name which
+		// doesn't exist, and "a:" is like "a".
+		{"v=spf1 a:example.com: -all", Fail, PermError, errInvalidDomain},
+		{"v=spf1 mx:example.com: -all", Fail, PermError, errInvalidDomain},
+		{"v=spf1 a: -all", Pass, PermError, errInvalidDomain},
+		{"v=spf1 mx: -all", Pass, PermError, errInvalidDomain},
+	}
+
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != c.lenient {
+			t.Errorf("%q lenient: expected %v, got %v (%v)",
+				c.txt, c.lenient, res, err)
+		}
+
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+			WithStrictParsing())
+		if res != c.strict {
+			t.Errorf("%q strict: expected %v, got %v (%v)",
+				c.txt, c.strict, res, err)
+		}
+		if c.err != nil && !isError(err, c.err) {
+			t.Errorf("%q strict: expected %v, got %v", c.txt, c.err, err)
+		}
+	}
+}
+
+func TestInvalidClientIP(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+
+	for _, ip := range []net.IP{nil, {}, {1, 2, 3}, net.ParseIP("1.1.1")} {
+		res, err := CheckHostWithSender(ip, "helo", "user@domain")
+		if res != None || err != errInvalidClientIP {
+			t.Errorf("%#v: expected none/invalid ip, got %v (%v)",
+				ip, res, err)
+		}
+		res, _, err = CheckRecord(ip, "v=spf1 +all", "helo", "user@domain")
+		if res != None || err != errInvalidClientIP {
+			t.Errorf("%#v: record: expected none/invalid ip, got %v (%v)",
+				ip, res, err)
+		}
+	}
+	if n := dns.lookups["txt"]; n != 0 {
+		t.Errorf("expected no lookups, got %d", n)
+	}
+
+	// Correctly parsed addresses, in any of their forms, are normalized and
+	// evaluated.
+	for _, ip := range []net.IP{
+		ip1111, ip1111.To4(), net.ParseIP("::ffff:1.1.1.1"), {1, 1, 1, 1}} {
+		res, err := CheckHostWithSender(ip, "helo", "user@domain")
+		if res != Pass || err != errMatchedIP {
+			t.Errorf("%#v: expected pass, got %v (%v)", ip, res, err)
+		}
+	}
+	res, err := CheckHostWithSender(ip6666, "helo", "user@domain")
+	if res != Fail {
+		t.Errorf("%v: expected fail, got %v (%v)", ip6666, res, err)
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	cases := []struct {
+		ip  net.IP
+		exp net.IP
+	}{
+		{nil, nil},
+		{net.IP{}, nil},
+		{net.IP{1, 2, 3}, nil},
+		{ip1111, ip1111.To4()},
+		{net.ParseIP("::ffff:1.1.1.1"), ip1111.To4()},
+		{ip6666, ip6666},
+	}
+	for _, c := range cases {
+		got := normalizeIP(c.ip)
+		if !bytes.Equal(got, c.exp) {
+			t.Errorf("%#v: expected %#v, got %#v", c.ip, c.exp, got)
+		}
+	}
+}
+
+func TestHeloValidation(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["mail.domain"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+
+	cases := []struct {
+		helo string
+		res  Result
+		err  error
+	}{
+		{"[192.0.2.1]", None, errAddressLiteral},
+		{"[IPv6:2001:db8::1]", None, errAddressLiteral},
+		{"192.0.2.1", None, errAddressLiteral},
+		{"2001:db8::1", None, errAddressLiteral},
+		{"", None, errInvalidIdentity},
+		{"mail..domain", None, errInvalidIdentity},
+		{"mail.domain", Pass, errMatchedIP},
+		{"mail.domain.", Pass, errMatchedIP},
+	}
+	for _, c := range cases {
+		dns.lookups = map[string]int{}
+		res, err := CheckHostWithSender(ip1111, c.helo, "")
+		if res != c.res || err != c.err {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.helo, c.res, c.err, res, err)
+		}
+		if n := dns.lookups["txt"]; c.res == None && n != 0 {
+			t.Errorf("%q: expected no lookups, got %d", c.helo, n)
+		}
+	}
+
+	// The HELO is not used if the sender has a domain.
+	res, err := CheckHostWithSender(ip1111, "[192.0.2.1]", "user@mail.domain")
+	if res != Pass {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+}
+
+func TestInvalidIdentity(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 -all"}
+
+	long := strings.Repeat("a", 64)
+	cases := []struct {
+		helo, sender string
+	}{
+		{"", ""},
+		{"", "user@"},
+		{"", "user@dom ain"},
+		{"dom ain", ""},
+		{"helo", "user@" + long + ".domain"},
+		{"helo", "user@a..domain"},
+		{"helo", "user@" + strings.Repeat("a.", 127) + "domain"},
+	}
+
+	for _, c := range cases {
+		res, err := CheckHostWithSender(ip1111, c.helo, c.sender)
+		if res != None || err != errInvalidIdentity {
+			t.Errorf("%q/%q: expected none/invalid identity, got %v (%v)",
+				c.helo, c.sender, res, err)
+		}
+	}
+	if n := dns.lookups["txt"]; n != 0 {
+		t.Errorf("expected no lookups, got %d", n)
+	}
+
+	// Check valid domains are still evaluated.
+	for _, sender := range []string{
+		"user@domain", "user@domain.", "user@" + long[1:] + ".domain"} {
+		dns.txt[sender[5:]] = []string{"v=spf1 -all"}
+		res, err := CheckHostWithSender(ip1111, "helo", sender)
+		if res != Fail {
+			t.Errorf("%q: expected fail, got %v (%v)", sender, res, err)
+		}
+	}
+}
+
+func TestPtrDisabled(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.addr["1.1.1.1"] = []string{"d1111."}
+	dns.ip["d1111"] = []net.IP{ip1111}
+	dns.txt["domain"] = []string{"v=spf1 ptr:d1111 ~all"}
+
+	// By default, ptr is evaluated.
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+	if res != Pass || err != errMatchedPTR {
+		t.Errorf("expected pass/matched ptr, got %v (%v)", res, err)
+	}
+
+	// Skip it: the ptr does not match, and we fall through to ~all.
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithPtrDisabled(false))
+	if res != SoftFail || err != errMatchedAll {
+		t.Errorf("expected softfail/matched all, got %v (%v)", res, err)
+	}
+
+	// PermError.
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithPtrDisabled(true))
+	if res != PermError || err != errPtrDisabled {
+		t.Errorf("expected permerror/ptr disabled, got %v (%v)", res, err)
+	}
+
+	// No reverse lookups should have been done when disabled.
+	if n := dns.lookups["addr"]; n != 1 {
+		t.Errorf("expected 1 reverse lookup, got %d", n)
+	}
+}
+
+func TestIncludeNoMatch(t *testing.T) {
+	// The include only matches when the included record passes; a Fail,
+	// SoftFail or Neutral must not terminate the evaluation.
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	cases := []struct {
+		inc string
+		res Result
+		err error
+	}{
+		{"v=spf1 -all", Pass, errMatchedIP},
+		{"v=spf1 ~all", Pass, errMatchedIP},
+		{"v=spf1 ?all", Pass, errMatchedIP},
+		{"v=spf1", Pass, errMatchedIP},
+		{"v=spf1 ip4:1.1.1.1 -all", SoftFail, errMatchedIP},
+	}
+
+	dns.txt["domain"] = []string{"v=spf1 ~include:inc ip4:1.1.1.1 -all"}
+	for _, c := range cases {
+		dns.txt["inc"] = []string{c.inc}
+		res, err := CheckHost(ip1111, "domain")
+		if res != c.res || err != c.err {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.inc, c.res, c.err, res, err)
+		}
+	}
+
+	// Same, but the outer record fails after the include.
+	dns.txt["domain"] = []string{"v=spf1 include:inc -all"}
+	for _, inc := range []string{"v=spf1 -all", "v=spf1 ~all", "v=spf1 ?all"} {
+		dns.txt["inc"] = []string{inc}
+		res, err := CheckHost(ip1111, "domain")
+		if res != Fail || err != errMatchedAll {
+			t.Errorf("%q: expected fail/matched all, got %v/%v",
+				inc, res, err)
+		}
+	}
+}
+
+func TestTrustedNetworks(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 -all"}
+	_, n1, _ := net.ParseCIDR("1.1.1.0/24")
+	_, n2, _ := net.ParseCIDR("2001:db8::/32")
+	opt := WithTrustedNetworks([]net.IPNet{*n1, *n2}, Pass)
+
+	for _, ip := range []net.IP{ip1111, ip6666} {
+		res, err := CheckHostWithSender(ip, "helo", "user@domain", opt)
+		if res != Pass || err != errTrustedNetwork {
+			t.Errorf("%v: expected pass/trusted network, got %v (%v)",
+				ip, res, err)
+		}
+	}
+	if n := dns.lookups["txt"]; n != 0 {
+		t.Errorf("expected no lookups, got %d", n)
+	}
+
+	// IPs outside the networks are checked as usual.
+	res, err := CheckHostWithSender(net.ParseIP("1.1.2.1"), "helo",
+		"user@domain", opt)
+	if res != Fail || err != errMatchedAll {
+		t.Errorf("expected fail/matched all, got %v (%v)", res, err)
+	}
+}
+
+func TestVoidLookups(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.errors["nxdomain"] = notFoundError("nxdomain")
+	dns.ip["d1111"] = []net.IP{ip1111}
+
+	cases := []struct {
+		txt string
+		res Result
+		err error
+	}{
+		{"v=spf1 a:empty a:nxdomain a:d1111", Pass, errMatchedA},
+		{"v=spf1 a:empty a:nxdomain", Neutral, nil},
+		{"v=spf1 a:empty a:nxdomain a:empty", PermError,
+			errVoidLookupLimitReached},
+		{"v=spf1 a:empty a:nxdomain mx:empty a:d1111", PermError,
+			errVoidLookupLimitReached},
+		{"v=spf1 exists:empty exists:empty ptr:nothing a:d1111", PermError,
+			errVoidLookupLimitReached},
+		{"v=spf1 a:empty mx:nxdomain exists:nxdomain -all", PermError,
+			errVoidLookupLimitReached},
+	}
+
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHost(ip1111, "domain")
+		if res != c.res || err != c.err {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.txt, c.res, c.err, res, err)
+		}
+	}
+}
+
+func TestMaxVoidLookups(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.ip["d1111"] = []net.IP{ip1111}
+
+	cases := []struct {
+		max uint
+		txt string
+		res Result
+		err error
+	}{
+		{0, "v=spf1 a:d1111 -all", Pass, errMatchedA},
+		{0, "v=spf1 a:empty a:d1111 -all", PermError,
+			errVoidLookupLimitReached},
+		{0, "v=spf1 a:empty", PermError, errVoidLookupLimitReached},
+		{5, "v=spf1 a:e1 exists:e2 mx:e3 a:e4 a:e5 a:d1111 -all", Pass,
+			errMatchedA},
+		{5, "v=spf1 a:e1 exists:e2 mx:e3 a:e4 a:e5 a:e6 a:d1111 -all",
+			PermError, errVoidLookupLimitReached},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "a@domain",
+			WithMaxVoidLookups(c.max))
+		if res != c.res || err != c.err {
+			t.Errorf("%d %q: expected %v/%v, got %v/%v",
+				c.max, c.txt, c.res, c.err, res, err)
+		}
+	}
+
+	// The default is 2.
+	dns.txt["domain"] = []string{"v=spf1 a:e1 a:e2 a:e3 a:d1111 -all"}
+	res, err := CheckHost(ip1111, "domain")
+	if res != PermError || err != errVoidLookupLimitReached {
+		t.Errorf("expected void limit permerror, got %v (%v)", res, err)
+	}
+}
+
+func TestRedirectVoidAndLimits(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// A redirect to a domain without SPF counts as a void lookup, and is a
+	// permerror with a specific error.
+	dns.txt["domain"] = []string{"v=spf1 redirect=nospf"}
+	res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain")
+	if res != PermError || !isError(err, errRedirectNoRecord) {
+		t.Errorf("expected permerror/redirect no record, got %v (%v)",
+			res, err)
+	}
+	if details.Record != "v=spf1 redirect=nospf" {
+		t.Errorf("unexpected record %q", details.Record)
+	}
+
+	// Same, for a domain that does not exist.
+	dns.errors["nxdomain"] = notFoundError("nxdomain")
+	dns.txt["domain"] = []string{"v=spf1 redirect=nxdomain"}
+	res, err = CheckHost(ip1111, "domain")
+	if res != PermError || !isError(err, errRedirectNoRecord) {
+		t.Errorf("expected permerror/redirect no record, got %v (%v)",
+			res, err)
+	}
+
+	// A chain of redirects that hits the lookup limit.
+	for i := 0; i < 12; i++ {
+		dns.txt[fmt.Sprintf("d%d", i)] = []string{
+			fmt.Sprintf("v=spf1 redirect=d%d", i+1)}
+	}
+	dns.txt["d12"] = []string{"v=spf1 +all"}
+	res, err = CheckHost(ip1111, "d0")
+	if res != PermError || err != errLookupLimitReached {
+		t.Errorf("expected permerror/lookup limit, got %v (%v)", res, err)
+	}
+}
+
+func TestPTRNamesLimit(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// 15 names, all of them resolve.
+	for i := 0; i < 15; i++ {
+		n := fmt.Sprintf("n%d.", i)
+		dns.addr["1.1.1.1"] = append(dns.addr["1.1.1.1"], n)
+		dns.ip[n[:len(n)-1]] = []net.IP{ip1111}
+	}
+
+	cases := []struct {
+		txt string
+		res Result
+	}{
+		{"v=spf1 ptr:n0 -all", Pass},
+		{"v=spf1 ptr:n9 -all", Pass},
+		{"v=spf1 ptr:n10 -all", Fail},
+		{"v=spf1 ptr:n14 -all", Fail},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		dns.lookups = map[string]int{}
+		res, err := CheckHost(ip1111, "domain")
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+		if n := dns.lookups["ip"]; n != 10 {
+			t.Errorf("%q: expected 10 forward lookups, got %d", c.txt, n)
+		}
+	}
+}
+
+func TestFailClosed(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.errors["broken"] = fmt.Errorf("synthetic resolver error")
+	dns.errors["nxdomain"] = notFoundError("nxdomain")
+
+	cases := []struct {
+		domain     string
+		res        Result
+		failClosed Result
+	}{
+		{"broken", None, TempError},
+		{"nxdomain", None, None},
+		{"nospf", None, None},
+	}
+	for _, c := range cases {
+		res, err := CheckHostWithSender(ip1111, "helo", "user@"+c.domain)
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.domain, c.res, res, err)
+		}
+
+		res, err = CheckHostWithSender(ip1111, "helo", "user@"+c.domain,
+			WithFailClosed())
+		if res != c.failClosed {
+			t.Errorf("%q fail closed: expected %v, got %v (%v)",
+				c.domain, c.failClosed, res, err)
+		}
+	}
+}
+
+func TestCombineResults(t *testing.T) {
+	// All results, from the least to the most severe.
+	ordered := []Result{
+		Pass, None, Neutral, PermError, TempError, SoftFail, Fail}
+
+	for i, a := range ordered {
+		if a.Severity() != i {
+			t.Errorf("%v: expected severity %d, got %d", a, i, a.Severity())
+		}
+		for j, b := range ordered {
+			exp := a
+			if j > i {
+				exp = b
+			}
+			if res := CombineResults(a, b); res != exp {
+				t.Errorf("combine(%v, %v): expected %v, got %v",
+					a, b, exp, res)
+			}
+		}
+	}
+
+	unknown := Result("unknown")
+	if unknown.Severity() != -1 {
+		t.Errorf("unknown result has severity %d", unknown.Severity())
+	}
+	if res := CombineResults(unknown, Pass); res != Pass {
+		t.Errorf("combine(unknown, pass): expected pass, got %v", res)
+	}
+}
+
+func TestDuplicateModifiers(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["r1"] = []string{"v=spf1 +all"}
+	dns.txt["r2"] = []string{"v=spf1 -all"}
+	dns.txt["e1"] = []string{"explanation"}
+
+	cases := []struct {
+		txt   string
+		res   Result
+		field string
+	}{
+		{"v=spf1 redirect=r1 redirect=r2", PermError, "redirect=r2"},
+		{"v=spf1 redirect=r1 Redirect=r1", PermError, "Redirect=r1"},
+		{"v=spf1 exp=e1 exp=e1 -all", PermError, "exp=e1"},
+		{"v=spf1 exp=e1 -all exp=e2", PermError, "exp=e2"},
+
+		// One of each is fine.
+		{"v=spf1 exp=e1 redirect=r2", Fail, ""},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+		if c.field == "" {
+			continue
+		}
+		ferr, ok := err.(*FieldError)
+		if !ok || ferr.Field != c.field || ferr.Domain != "domain" ||
+			!isError(err, errDuplicateModifier) {
+			t.Errorf("%q: expected duplicate %q, got %v", c.txt, c.field, err)
+		}
+	}
+}
+
+type customDNSError struct {
+	transient bool
+}
+
+func (e *customDNSError) Error() string {
+	return fmt.Sprintf("custom error, transient: %v", e.transient)
+}
+
+func TestErrorClassifier(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	transient := &customDNSError{true}
+	dns.txt["domain"] = []string{"v=spf1 include:inc a:host mx:mx -all"}
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.2.3.4"}
+
+	classify := func(err error) bool {
+		if cerr, ok := err.(*customDNSError); ok {
+			return cerr.transient
+		}
+		return isTemporary(err)
+	}
+
+	cases := []struct {
+		name       string
+		def, class Result
+	}{
+		// Top-level record, an include, and the a and mx mechanisms.
+		{"domain", None, TempError},
+		{"inc", PermError, TempError},
+		{"host", Fail, TempError},
+		{"mx", Fail, TempError},
+	}
+	for _, c := range cases {
+		dns.errors[c.name] = transient
+
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != c.def {
+			t.Errorf("%q: expected %v by default, got %v (%v)",
+				c.name, c.def, res, err)
+		}
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+			WithErrorClassifier(classify))
+		if res != c.class || err != transient {
+			t.Errorf("%q: expected %v with classifier, got %v (%v)",
+				c.name, c.class, res, err)
+		}
+
+		delete(dns.errors, c.name)
+	}
+
+	// Permanent errors are still permanent.
+	dns.errors["inc"] = &customDNSError{false}
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithErrorClassifier(classify))
+	if res != PermError {
+		t.Errorf("expected permerror, got %v (%v)", res, err)
+	}
+
+	// And they are used to decide which queries to retry.
+	fr := &flakyResolver{dns, 1, transient, map[string]int{}}
+	delete(dns.errors, "inc")
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.1.1.1"}
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithResolver(fr), WithRetry(1, 0), WithErrorClassifier(classify))
+	if res != Pass || fr.seen["txt domain"] != 2 {
+		t.Errorf("expected pass after retrying, got %v (%v) %v",
+			res, err, fr.seen)
+	}
+}
+
+func TestMaxAnswersPerLookup(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	many := []net.IP{}
+	for i := 0; i < 5; i++ {
+		many = append(many, net.IPv4(10, 0, 0, byte(i)))
+	}
+	dns.ip["many"] = append(many, ip1111)
+	dns.ip["few"] = []net.IP{ip1111}
+	dns.mx["many"] = []*net.MX{
+		mx("few", 1), mx("x1", 2), mx("x2", 3), mx("x3", 4), mx("x4", 5)}
+	dns.mx["few"] = []*net.MX{mx("few", 10)}
+	dns.txt["manytxt"] = []string{"a", "b", "c", "d", "v=spf1 +all"}
+	dns.addr["1.1.1.1"] = []string{"a.", "b.", "c.", "d.", "e."}
+
+	cases := []struct {
+		txt string
+		res Result
+	}{
+		{"v=spf1 a:few -all", Pass},
+		{"v=spf1 a:many -all", PermError},
+		{"v=spf1 mx:few -all", Pass},
+		{"v=spf1 mx:many -all", PermError},
+		{"v=spf1 exists:many -all", PermError},
+		{"v=spf1 include:manytxt -all", PermError},
+		{"v=spf1 ptr -all", PermError},
+
+		// The mechanisms that come before are not affected, and the ones
+		// after are not evaluated.
+		{"v=spf1 a:few a:many -all", Pass},
+		{"v=spf1 a:many a:few -all", PermError},
+		{"v=spf1 ip4:1.2.3.4 a:many", PermError},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+			WithMaxAnswersPerLookup(4))
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+		if res == PermError && err != errTooManyAnswers {
+			t.Errorf("%q: expected too many answers, got %v", c.txt, err)
+		}
+
+		// The default limit is generous.
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res == PermError {
+			t.Errorf("%q: unexpected permerror by default (%v)", c.txt, err)
+		}
+	}
+
+	// The top-level record.
+	res, err := CheckHostWithSender(ip1111, "helo", "user@manytxt",
+		WithMaxAnswersPerLookup(4))
+	if res != PermError || err != errTooManyAnswers {
+		t.Errorf("expected too many answers, got %v (%v)", res, err)
+	}
+	res, err = CheckHostWithSender(ip1111, "helo", "user@manytxt",
+		WithMaxAnswersPerLookup(0))
+	if res != Pass {
+		t.Errorf("expected pass without limit, got %v (%v)", res, err)
+	}
+}
+
+func TestScore(t *testing.T) {
+	// All results, from the least to the most severe.
+	ordered := []Result{
+		Pass, None, Neutral, PermError, TempError, SoftFail, Fail}
+
+	def := DefaultScoreTable()
+	if len(def) != len(ordered) {
+		t.Errorf("default table has %d results, expected %d",
+			len(def), len(ordered))
+	}
+	for _, r := range ordered {
+		s, ok := def[r]
+		if !ok {
+			t.Errorf("%v: not in the default table", r)
+		}
+		if r.Score(nil) != s {
+			t.Errorf("%v: expected default score %v, got %v",
+				r, s, r.Score(nil))
+		}
+	}
+
+	// Only pass lowers the score, and the definite negative results score
+	// more than the rest.
+	if Pass.Score(nil) >= 0 {
+		t.Errorf("pass score is not negative: %v", Pass.Score(nil))
+	}
+	for _, r := range []Result{None, Neutral, PermError, TempError} {
+		if r.Score(nil) >= SoftFail.Score(nil) {
+			t.Errorf("%v scores more than softfail", r)
+		}
+	}
+	if SoftFail.Score(nil) >= Fail.Score(nil) {
+		t.Errorf("softfail scores more than fail")
+	}
+
+	// Changes to the returned table don't affect the default.
+	def[Fail] = 10
+	if Fail.Score(nil) == 10 || Fail.Score(def) != 10 {
+		t.Errorf("unexpected scores after changing the table: %v %v",
+			Fail.Score(nil), Fail.Score(def))
+	}
+
+	// Custom tables, with missing and unknown results.
+	table := ScoreTable{Fail: 5}
+	if Fail.Score(table) != 5 || Pass.Score(table) != 0 {
+		t.Errorf("unexpected scores with custom table")
+	}
+	if s := Result("unknown").Score(nil); s != 0 {
+		t.Errorf("unknown result has score %v", s)
+	}
+}
+
+func TestQuotedRecord(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	cases := []struct {
+		txt string
+		res Result
+	}{
+		{`"v=spf1 -all"`, Fail},
+		{`"v=spf1"`, Neutral},
+		{`"v=spf1 ip4:1.1.1.1 -all"`, Pass},
+
+		// Only a single, complete, layer of quotes is removed.
+		{`""v=spf1 -all""`, None},
+		{`"v=spf1 -all`, None},
+		{`"v=spf1 -all" "ip4:1.1.1.1"`, None},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHost(ip1111, "domain")
+		if res != c.res {
+			t.Errorf("%s: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+	}
+}
+
+func TestValidatedNameMacro(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+	ip1112 := net.ParseIP("1.1.1.2")
+
+	// 1.1.1.1 has a validated name, and an unvalidated one (without
+	// addresses). 2001:db8::68 has no reverse names.
+	dns.addr["1.1.1.1"] = []string{"nope.", "mail.Domain.", "other."}
+	dns.ip["mail.domain"] = []net.IP{ip1111}
+	dns.ip["other"] = []net.IP{ip1111}
+	dns.ip["mail.domain.p"] = []net.IP{ip1111}
+	dns.ip["unknown.p"] = []net.IP{ip1111, ip6666, ip1112}
+
+	// 1.1.1.2 has a name that resolves to a different ip, so it's not
+	// validated.
+	dns.addr["1.1.1.2"] = []string{"spoof.domain."}
+	dns.ip["spoof.domain"] = []net.IP{ip1111}
+
+	cases := []struct {
+		ip  net.IP
+		txt string
+		res Result
+	}{
+		// The name under the domain is preferred.
+		{ip1111, "v=spf1 exists:%{p}.p -all", Pass},
+
+		// No validated names, the macro expands to "unknown".
+		{ip6666, "v=spf1 exists:%{p}.p -all", Pass},
+		{ip6666, "v=spf1 exists:%{p}.p exists:%{p}.p -all", Pass},
+		{ip1112, "v=spf1 exists:%{p}.p -all", Pass},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		dns.lookups = map[string]int{}
+		res, err := CheckHostWithSender(c.ip, "helo", "user@domain")
+		if res != c.res {
+			t.Errorf("%v %q: expected %v, got %v (%v)",
+				c.ip, c.txt, c.res, res, err)
+		}
+
+		// The reverse lookup is done only once.
+		if n := dns.lookups["addr"]; n != 1 {
+			t.Errorf("%v %q: expected 1 reverse lookup, got %d",
+				c.ip, c.txt, n)
+		}
+	}
+
+	// When not under the domain, the first validated name is used.
+	dns.txt["other-domain"] = []string{"v=spf1 exists:%{p}.p -all"}
+	res, err := CheckHostWithSender(ip1111, "helo", "user@other-domain")
+	if res != Pass {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+}
+
+func TestScopedIPv6(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 ip6:fe80::/64 ip6:fd00::/8 -all"}
+
+	cases := []struct {
+		s   string
+		ip  net.IP
+		res Result
+	}{
+		{"fe80::1%eth0", net.ParseIP("fe80::1"), Pass},
+		{"fe80::1%25", net.ParseIP("fe80::1"), Pass},
+		{"fd00::1", net.ParseIP("fd00::1"), Pass},
+		{"2001:db8::68%lo", ip6666, Fail},
+		{"1.1.1.1", ip1111, Fail},
+		{"1.1.1.1%eth0", nil, ""},
+		{"fe80::1%", nil, ""},
+		{"%eth0", nil, ""},
+	}
+	for _, c := range cases {
+		ip := ParseIP(c.s)
+		if !ip.Equal(c.ip) {
+			t.Errorf("%q: expected %v, got %v", c.s, c.ip, ip)
+			continue
+		}
+		if ip == nil {
+			continue
+		}
+
+		res, err := CheckHostWithSender(ip, "helo", "user@domain")
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.s, c.res, res, err)
+		}
+
+		// With the option, local addresses always result in None.
+		exp := c.res
+		if ip.IsLinkLocalUnicast() || strings.HasPrefix(c.s, "fd") {
+			exp = None
+		}
+		res, err = CheckHostWithSender(ip, "helo", "user@domain",
+			WithLocalAddressesNone())
+		if res != exp {
+			t.Errorf("%q: expected %v with option, got %v (%v)",
+				c.s, exp, res, err)
+		}
+	}
+
+	res, err := CheckHostWithSender(net.ParseIP("169.254.1.1"), "helo",
+		"user@domain", WithLocalAddressesNone())
+	if res != None || err != errLocalAddress {
+		t.Errorf("expected none for ipv4 link-local, got %v (%v)", res, err)
+	}
+}
+
+func TestSkipPrivateIPs(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 -all"}
+
+	cases := []struct {
+		ip  string
+		res Result
+		err error
+	}{
+		{"10.0.0.1", None, errPrivateAddress},
+		{"10.255.255.255", None, errPrivateAddress},
+		{"127.0.0.1", None, errPrivateAddress},
+		{"192.168.1.1", None, errPrivateAddress},
+		{"224.0.0.1", None, errPrivateAddress},
+		{"::1", None, errPrivateAddress},
+		{"fd00::1", None, errPrivateAddress},
+		{"::ffff:10.0.0.1", None, errPrivateAddress},
+		{"1.1.1.1", Fail, errMatchedAll},
+		{"11.0.0.1", Fail, errMatchedAll},
+		{"2606:4700::1111", Fail, errMatchedAll},
+	}
+	for _, c := range cases {
+		dns.lookups["txt"] = 0
+		res, err := CheckHostWithSender(net.ParseIP(c.ip), "helo",
+			"user@domain", WithSkipPrivateIPs("", nil))
+		if res != c.res || err != c.err {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.ip, c.res, c.err, res, err)
+		}
+		if n := dns.lookups["txt"]; c.res == None && n != 0 {
+			t.Errorf("%q: expected no lookups, got %d", c.ip, n)
+		}
+	}
+
+	// Without the option, private addresses are checked as usual.
+	res, err := CheckHostWithSender(net.ParseIP("10.0.0.1"), "helo",
+		"user@domain")
+	if res != Fail {
+		t.Errorf("expected fail without option, got %v (%v)", res, err)
+	}
+
+	// The result and the networks can be overridden.
+	nets := PrivateNetworks()
+	_, extra, _ := net.ParseCIDR("1.1.1.0/24")
+	nets = append(nets[1:], *extra)
+	for ip, exp := range map[string]Result{
+		"1.1.1.1": Neutral, "10.0.0.1": Neutral, "0.0.0.1": Fail} {
+		res, err = CheckHostWithSender(net.ParseIP(ip), "helo",
+			"user@domain", WithSkipPrivateIPs(Neutral, nets))
+		if res != exp {
+			t.Errorf("%q: expected %v, got %v (%v)", ip, exp, res, err)
+		}
+	}
+
+	// The returned networks are a copy.
+	if n := PrivateNetworks()[0]; n.String() != "0.0.0.0/8" {
+		t.Errorf("private networks modified, got %v", n.String())
+	}
+}
+
+func TestDefaultQualifier(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.ip["domain"] = []net.IP{ip1111}
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.1.1.1"}
+
+	cases := []struct {
+		txt string
+		res Result
+	}{
+		{"v=spf1 a -all", SoftFail},
+		{"v=spf1 +a -all", Pass},
+		{"v=spf1 -a all", Fail},
+		{"v=spf1 ip4:1.2.3.4 all", SoftFail},
+		{"v=spf1 +include:inc -all", Fail}, // inc's ip4 is softfail too.
+		{"v=spf1 ip4:1.2.3.4", Neutral},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+			WithDefaultQualifier(SoftFail))
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+	}
+
+	// Without the option, unqualified mechanisms result in Pass.
+	dns.txt["domain"] = []string{"v=spf1 a -all"}
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+	if res != Pass {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 include:_spf.bad -all"}
+	cases := []struct {
+		txt   string
+		field string
+		err   error
+	}{
+		{"v=spf1 ip4:1.2.3.4 foo:bar", "foo:bar", errUnknownField},
+		{"v=spf1 -ip4:1.2.3.4/40", "ip4:1.2.3.4/40", errInvalidMask},
+		{"v=spf1 ~ip6:lala", "ip6:lala", errInvalidIP},
+		{"v=spf1 a:domain/99", "a:domain/99", errInvalidMask},
+	}
+	for _, c := range cases {
+		dns.txt["_spf.bad"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		ferr, ok := err.(*FieldError)
+		if res != PermError || !ok {
+			t.Errorf("%q: expected permerror with field error, got %v (%v)",
+				c.txt, res, err)
+			continue
+		}
+		if ferr.Domain != "_spf.bad" || ferr.Field != c.field ||
+			!isError(err, c.err) {
+			t.Errorf("%q: unexpected error %#v", c.txt, ferr)
+		}
+	}
+
+	err := &FieldError{"_spf.bad", "foo:bar", errUnknownField}
+	if s := err.Error(); s != `in _spf.bad: unknown field "foo:bar"` {
+		t.Errorf("unexpected error string: %q", s)
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.delay = 10 * time.Millisecond
+	dns.txt["domain"] = []string{"v=spf1 a:d1 a:d2 a:d3 a:d4 a:d5 a:d6 -all"}
+	dns.txt["inc"] = []string{"v=spf1 include:domain"}
+	dns.mx["mx"] = []*net.MX{mx("d1", 5), mx("d2", 5), mx("d3", 5),
+		mx("d4", 5), mx("d5", 5), mx("d6", 5)}
+	dns.txt["mx"] = []string{"v=spf1 mx -all"}
+	for i := 1; i <= 6; i++ {
+		dns.ip[fmt.Sprintf("d%d", i)] = []net.IP{ip1110}
+	}
+
+	for _, domain := range []string{"domain", "inc", "mx"} {
+		dns.lookups = map[string]int{}
+		start := time.Now()
+		res, err := CheckHostWithSender(ip1111, "helo", "user@"+domain,
+			WithMaxDuration(25*time.Millisecond))
+		if res != TempError || err != errMaxDurationExceeded {
+			t.Errorf("%q: expected temperror, got %v (%v)", domain, res, err)
+		}
+
+		// The evaluation should stop at the first check after the maximum
+		// duration, which means at most one extra lookup.
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("%q: took too long: %v", domain, d)
+		}
+		n := 0
+		for _, c := range dns.lookups {
+			n += c
+		}
+		if n > 4 {
+			t.Errorf("%q: too many lookups: %v", domain, dns.lookups)
+		}
+	}
+
+	// Without the option, or with enough time, it completes.
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+	if res != Fail {
+		t.Errorf("expected fail, got %v (%v)", res, err)
+	}
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithMaxDuration(time.Second))
+	if res != Fail {
+		t.Errorf("expected fail, got %v (%v)", res, err)
+	}
+}
+
+func TestRedirectError(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 include:inc -all"}
+	dns.txt["inc"] = []string{"v=spf1 redirect=_spf.%{d}"}
+	dns.txt["_spf.inc"] = []string{"google-site-verification=blah"}
+
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+	rerr, ok := err.(*RedirectError)
+	if res != PermError || !ok {
+		t.Fatalf("expected permerror with redirect error, got %v (%v)",
+			res, err)
+	}
+	if rerr.Domain != "inc" || rerr.Target != "_spf.inc" {
+		t.Errorf("unexpected error: %#v", rerr)
+	}
+	if s := err.Error(); s != "in inc: redirect target _spf.inc has no SPF record" {
+		t.Errorf("unexpected error string: %q", s)
+	}
+	if !isError(err, errRedirectNoRecord) {
+		t.Errorf("error does not unwrap to errRedirectNoRecord")
+	}
+}
+
+func TestNoMatchResults(t *testing.T) {
+	// When no mechanism matches, the result is given by "all" if present,
+	// or the redirect target, and is Neutral otherwise; these must never be
+	// conflated, as receivers act on them differently.
+	// https://tools.ietf.org/html/rfc7208#section-4.7
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["softfail"] = []string{"v=spf1 ip4:1.1.1.0 ~all"}
+	dns.txt["neutral"] = []string{"v=spf1 ip4:1.1.1.0"}
+	dns.ip["host"] = []net.IP{ip1110}
+
+	cases := []struct {
+		txt string
+		res Result
+		err error
+	}{
+		{"v=spf1 ip4:1.1.1.0 ~all", SoftFail, errMatchedAll},
+		{"v=spf1 ip4:1.1.1.0 -all", Fail, errMatchedAll},
+		{"v=spf1 ip4:1.1.1.0 ?all", Neutral, errMatchedAll},
+		{"v=spf1 ip4:1.1.1.0", Neutral, nil},
+		{"v=spf1 a:host mx:host", Neutral, nil},
+		{"v=spf1 a:host ~all", SoftFail, errMatchedAll},
+		{"v=spf1 include:softfail", Neutral, nil},
+		{"v=spf1 include:softfail -all", Fail, errMatchedAll},
+		{"v=spf1 redirect=softfail", SoftFail, errMatchedAll},
+		{"v=spf1 redirect=neutral", Neutral, nil},
+		{"v=spf1 redirect=softfail -all", Fail, errMatchedAll},
+		{"v=spf1 -all redirect=softfail", Fail, errMatchedAll},
+		{"v=spf1 ~all redirect=neutral", SoftFail, errMatchedAll},
+		{"v=spf1 redirect=neutral ~all", SoftFail, errMatchedAll},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != c.res || err != c.err {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.txt, c.res, c.err, res, err)
+		}
+	}
+}
+
+func TestIncludeQualifiers(t *testing.T) {
+	// When the included record passes, the include matches and the result
+	// is given by its own qualifier, not the inner Pass.
+	// https://tools.ietf.org/html/rfc7208#section-5.2
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["inc"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	cases := []struct {
+		txt string
+		res Result
+	}{
+		{"v=spf1 include:inc ?all", Pass},
+		{"v=spf1 +include:inc ?all", Pass},
+		{"v=spf1 -include:inc ?all", Fail},
+		{"v=spf1 ~include:inc ?all", SoftFail},
+		{"v=spf1 ?include:inc -all", Neutral},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHost(ip1111, "domain")
+		if res != c.res || err != errMatchedIP {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.txt, c.res, errMatchedIP, res, err)
+		}
+
+		// If the included record doesn't pass, the include doesn't match.
+		res, err = CheckHost(ip1110, "domain")
+		if res == c.res || err != errMatchedAll {
+			t.Errorf("%q: expected no include match, got %v/%v",
+				c.txt, res, err)
+		}
+	}
+}
+
+func TestConcurrentChecks(t *testing.T) {
+	// Run many checks concurrently, each with its own resolver, and make
+	// sure they don't interfere with each other. This is most useful when
+	// running with -race.
+	trace = t.Logf
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		i := i
+		ip := net.IPv4(10, 0, 0, byte(i))
+
+		// Half use a stub zone, half a test resolver.
+		opt := WithStubZone(Zone{}.
+			TXT("domain", fmt.Sprintf("v=spf1 include:inc%d -all", i)).
+			TXT(fmt.Sprintf("inc%d", i), fmt.Sprintf("v=spf1 a:d%d", i)).
+			A(fmt.Sprintf("d%d", i), ip.String()))
+		if i%2 == 0 {
+			dns := NewResolver()
+			dns.txt["domain"] = []string{fmt.Sprintf("v=spf1 ip4:%v -all", ip)}
+			opt = WithResolver(dns)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				res, err := CheckHostWithSender(ip, "helo", "user@domain", opt)
+				if res != Pass {
+					t.Errorf("%d: expected pass, got %v (%v)", i, res, err)
+				}
+				res, err = CheckHostWithSender(ip1111, "helo", "user@domain",
+					opt)
+				if res != Fail {
+					t.Errorf("%d: expected fail, got %v (%v)", i, res, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMXLookupLimit(t *testing.T) {
+	// Only the mx mechanism counts towards the lookup limit, not the address
+	// lookups of its hosts. Those have their own limit of 10 per mechanism.
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// 1 for the record, 8 for the "a" mechanisms, and 1 for "mx": 10.
+	txt := "v=spf1"
+	for i := 0; i < 8; i++ {
+		txt += fmt.Sprintf(" a:a%d", i)
+		dns.ip[fmt.Sprintf("a%d", i)] = []net.IP{ip1110}
+	}
+	dns.txt["domain"] = []string{txt + " mx -all"}
+
+	cases := []struct {
+		nhosts int
+		res    Result
+		err    error
+	}{
+		{1, Pass, errMatchedMX},
+		{10, Pass, errMatchedMX},
+
+		// More than 10 MX records would need more than 10 address lookups.
+		{11, PermError, errTooManyMXRecords},
+	}
+	for _, c := range cases {
+		dns.mx["domain"] = nil
+		dns.lookups = map[string]int{}
+		for i := 0; i < c.nhosts; i++ {
+			host := fmt.Sprintf("mx%d", i)
+			dns.mx["domain"] = append(dns.mx["domain"], mx(host, 10))
+			dns.ip[host] = []net.IP{ip1110}
+		}
+		// Only the last host matches.
+		dns.ip[fmt.Sprintf("mx%d", c.nhosts-1)] = []net.IP{ip1111}
+
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != c.res || err != c.err {
+			t.Errorf("%d hosts: expected %v/%v, got %v/%v",
+				c.nhosts, c.res, c.err, res, err)
+		}
+	}
+
+	// A mechanism after the mx is over the limit.
+	dns.txt["domain"] = []string{txt + " mx a -all"}
+	dns.ip["mx9"] = []net.IP{ip1110}
+	dns.mx["domain"] = dns.mx["domain"][:10]
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+	if res != PermError || err != errLookupLimitReached {
+		t.Errorf("expected permerror/lookup limit, got %v/%v", res, err)
+	}
+}
+
+func TestMXPreferenceOrder(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// Unsorted, as a custom resolver could return them.
+	mxs := []*net.MX{
+		mx("mx30", 30), mx("mx10", 10), mx("mx20a", 20), mx("mx20b", 20)}
+	dns.mx["domain"] = mxs
+	dns.txt["domain"] = []string{"v=spf1 mx -all"}
+
+	res, details, err := CheckHostDetailed(ip1111, "helo", "user@domain",
+		WithEvaluationSteps())
+	if res != Fail {
+		t.Errorf("expected fail, got %v (%v)", res, err)
+	}
+	queried := []string{}
+	for _, s := range details.Steps {
+		queried = append(queried, s.Queries...)
+	}
+	exp := "TXT domain, MX domain, A/AAAA mx10, A/AAAA mx20a, " +
+		"A/AAAA mx20b, A/AAAA mx30"
+	if got := strings.Join(queried, ", "); got != exp {
+		t.Errorf("expected queries %q, got %q", exp, got)
+	}
+
+	// The resolver's answer is not modified.
+	if mxs[0].Host != "mx30" {
+		t.Errorf("answer modified: %v", mxs)
+	}
+
+	// Hosts with any preference are authorized.
+	dns.ip["mx30"] = []net.IP{ip1111}
+	res, err = CheckHostWithSender(ip1111, "helo", "user@domain")
+	if res != Pass || err != errMatchedMX {
+		t.Errorf("expected pass, got %v (%v)", res, err)
+	}
+}
+
+func TestEmptyMX(t *testing.T) {
+	// A domain that exists but has no MX records doesn't match, and counts
+	// as a void lookup.
+	// https://tools.ietf.org/html/rfc7208#section-4.6.4
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.mx["nomx"] = []*net.MX{}
+	r := newResolution(ip1111, "user@domain", nil)
+	ok, res, err := r.mxField(Pass, "mx:nomx", "domain")
+	if ok || res != "" || err != nil {
+		t.Errorf("expected no match, got %v/%v/%v", ok, res, err)
+	}
+	if r.voidcount != 1 {
+		t.Errorf("expected 1 void lookup, got %d", r.voidcount)
+	}
+	if dns.lookups["ip"] != 0 {
+		t.Errorf("unexpected ip lookups: %v", dns.lookups)
+	}
+
+	// Enough of them go over the void lookup limit.
+	dns.txt["domain"] = []string{"v=spf1 mx:nomx mx:nomx ?all"}
+	res, err = CheckHost(ip1111, "domain")
+	if res != Neutral {
+		t.Errorf("expected neutral, got %v (%v)", res, err)
+	}
+	dns.txt["domain"] = []string{"v=spf1 mx:nomx mx:nomx mx:nomx ?all"}
+	res, err = CheckHost(ip1111, "domain")
+	if res != PermError || err != errVoidLookupLimitReached {
+		t.Errorf("expected void limit permerror, got %v (%v)", res, err)
+	}
+}
+
+func TestBoundedSizes(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// Records that are too long are rejected.
+	long := "v=spf1 " + strings.Repeat("ip4:1.2.3.4 ", 6000) + "-all"
+	dns.txt["domain"] = []string{long}
+	res, err := CheckHost(ip1111, "domain")
+	if res != PermError || err != errRecordTooLong {
+		t.Errorf("expected permerror/too long, got %v (%v)", res, err)
+	}
+	if _, err := Parse(long); err != errRecordTooLong {
+		t.Errorf("expected parse error, got %v", err)
+	}
+
+	// Huge masks are invalid.
+	for _, txt := range []string{
+		"v=spf1 ip4:1.1.1.1/99999999999999999999 -all",
+		"v=spf1 a/99999999999999999999 -all",
+		"v=spf1 mx//99999999999999999999 -all",
+	} {
+		dns.txt["domain"] = []string{txt}
+		res, err := CheckHost(ip1111, "domain")
+		if res != PermError || !isError(err, errInvalidMask) {
+			t.Errorf("%q: expected permerror/invalid mask, got %v (%v)",
+				txt, res, err)
+		}
+	}
+
+	// Domains resulting from macro expansion are truncated from the left.
+	r := newResolution(ip1111, strings.Repeat("x", 200)+"@domain", nil)
+	s, err := r.expandMacros("%{l}.%{l}.%{d}", "domain")
+	exp := strings.Repeat("x", 200) + ".domain"
+	if s != exp || err != nil {
+		t.Errorf("expected %q, got %q (%v)", exp, s, err)
+	}
+	s, err = r.expandMacros("%{l}%{l}.domain", "domain")
+	if s != "domain" || err != nil {
+		t.Errorf("expected \"domain\", got %q (%v)", s, err)
+	}
+	s, err = r.expandMacros("%{l}%{l}", "domain")
+	if s != "" || err != errInvalidDomain {
+		t.Errorf("expected invalid domain, got %q (%v)", s, err)
+	}
+}
+
+func TestBareQualifier(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	for _, txt := range []string{
+		"v=spf1 ip4:1.2.3.4 - -all",
+		"v=spf1 +",
+		"v=spf1 ~ ip4:1.1.1.1",
+		"v=spf1  ?  ",
+	} {
+		dns.txt["domain"] = []string{txt}
+		res, err := CheckHost(ip1111, "domain")
+		ferr, ok := err.(*FieldError)
+		if res != PermError || !ok || len(ferr.Field) != 1 ||
+			ferr.Err != errUnknownField {
+			t.Errorf("%q: expected permerror for bare qualifier, got %v (%v)",
+				txt, res, err)
+		}
+	}
+
+	// Empty fields (from repeated spaces) are skipped.
+	dns.txt["domain"] = []string{"v=spf1  ip4:1.1.1.1   -all "}
+	for _, opts := range [][]Option{nil, {WithStrictParsing()}} {
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain", opts...)
+		if res != Pass {
+			t.Errorf("expected pass, got %v (%v)", res, err)
+		}
+	}
+}
+
+func TestDualCIDRAAAA(t *testing.T) {
+	// An IPv6 client is matched against the AAAA records of the target
+	// using the ip6 prefix length of a dual-cidr spec.
+	// https://tools.ietf.org/html/rfc7208#section-5.6
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.ip["aaaa"] = []net.IP{net.ParseIP("2001:db8::1")}
+	dns.ip["domain"] = []net.IP{net.ParseIP("2001:db8::1")}
+	dns.ip["both"] = []net.IP{ip1110, net.ParseIP("2001:db8::1")}
+	dns.mx["mx"] = []*net.MX{mx("both", 10)}
+
+	cases := []struct {
+		ip  net.IP
+		txt string
+		res Result
+	}{
+		{ip6666, "v=spf1 a//64 -all", Pass},
+		{ip6666, "v=spf1 a:aaaa//64 -all", Pass},
+		{ip6666, "v=spf1 a:aaaa/24//64 -all", Pass},
+		{ip6666, "v=spf1 a:aaaa -all", Fail},
+		{ip6666, "v=spf1 a:aaaa//128 -all", Fail},
+		{ip6666, "v=spf1 a:aaaa/0 -all", Fail},
+		{net.ParseIP("2001:db9::1"), "v=spf1 a:aaaa//64 -all", Fail},
+
+		// The ip4 length only applies to A records, and vice versa.
+		{ip1111, "v=spf1 a:both/24//128 -all", Pass},
+		{ip1111, "v=spf1 a:both//0 -all", Fail},
+		{ip6666, "v=spf1 a:both/0//64 -all", Pass},
+		{ip6666, "v=spf1 a:both/0 -all", Fail},
+
+		// Without an ip6 length, AAAA records must match exactly.
+		{ip1111, "v=spf1 a:both/24 -all", Pass},
+		{net.ParseIP("2001:db8::1"), "v=spf1 a:both/24 -all", Pass},
+		{net.ParseIP("2001:db8::2"), "v=spf1 a:both/24 -all", Fail},
+		{net.ParseIP("2001:db8::2"), "v=spf1 mx:mx/24 -all", Fail},
+		{net.ParseIP("2001:db8::2"), "v=spf1 mx:mx/24//64 -all", Pass},
+		{ip1111, "v=spf1 mx:mx/24 -all", Pass},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHost(c.ip, "domain")
+		if res != c.res {
+			t.Errorf("%v %q: expected %v, got %v (%v)",
+				c.ip, c.txt, c.res, res, err)
+		}
+	}
+}
+
+func TestAllowedIncludes(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["_spf.good"] = []string{"v=spf1 include:_spf.other.good -all"}
+	dns.txt["_spf.other.good"] = []string{"v=spf1 ip4:1.1.1.1"}
+	dns.txt["ok"] = []string{"v=spf1 ip4:1.1.1.1"}
+	dns.txt["bad"] = []string{"v=spf1 ip4:1.1.1.1"}
+	allowed := WithAllowedIncludes([]string{"Good.", "ok"})
+
+	cases := []struct {
+		txt    string
+		res    Result
+		target string
+	}{
+		{"v=spf1 include:_spf.good -all", Pass, ""},
+		{"v=spf1 include:ok -all", Pass, ""},
+		{"v=spf1 redirect=OK", Pass, ""},
+		{"v=spf1 include:bad -all", PermError, "include:bad"},
+		{"v=spf1 redirect=bad", PermError, "redirect=bad"},
+		{"v=spf1 include:%{d}.bad -all", PermError, "include:domain.bad"},
+		{"v=spf1 include:notgood -all", PermError, "include:notgood"},
+
+		// The mechanisms before the include are evaluated as usual.
+		{"v=spf1 ip4:1.1.1.1 include:bad -all", Pass, ""},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+			allowed)
+		if res != c.res {
+			t.Errorf("%q: expected %v, got %v (%v)", c.txt, c.res, res, err)
+		}
+		if c.target == "" {
+			continue
+		}
+		ferr, ok := err.(*FieldError)
+		if !ok || ferr.Field != c.target || ferr.Err != errTargetNotAllowed {
+			t.Errorf("%q: unexpected error %v", c.txt, err)
+		}
+
+		// Without the option, all targets are allowed.
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain")
+		if isError(err, errTargetNotAllowed) {
+			t.Errorf("%q: unexpected error without the option: %v (%v)",
+				c.txt, res, err)
+		}
+	}
+
+	// An empty list does not allow anything.
+	dns.txt["domain"] = []string{"v=spf1 include:ok -all"}
+	res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+		WithAllowedIncludes([]string{}))
+	if res != PermError || !isError(err, errTargetNotAllowed) {
+		t.Errorf("expected permerror, got %v (%v)", res, err)
+	}
+}
+
+func TestMatchBeforeMacro(t *testing.T) {
+	// Mechanisms are evaluated in order, so an earlier match is returned
+	// without evaluating later ones, including those with macros.
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{
+		"v=spf1 ip4:1.1.1.1 exists:%{i}._spf.%{d} -all"}
+	dns.ip["1.1.1.0._spf.domain"] = []net.IP{ip1110}
+
+	res, err := CheckHost(ip1111, "domain")
+	if res != Pass || err != errMatchedIP {
+		t.Errorf("expected pass/matched ip, got %v (%v)", res, err)
+	}
+	if n := dns.lookups["ip"]; n != 0 {
+		t.Errorf("the exists mechanism was evaluated (%d lookups)", n)
+	}
+
+	// If the earlier mechanism doesn't match, the macro is evaluated.
+	res, err = CheckHost(ip1110, "domain")
+	if res != Pass || err != errMatchedExists {
+		t.Errorf("expected pass/matched exists, got %v (%v)", res, err)
+	}
+}
+
+func TestUnsupportedHandler(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// A handler that implements a custom "x-ip:" mechanism, which matches
+	// the given ip exactly.
+	handler := func(field string) (Result, bool) {
+		res, ok := qualToResult[field[0]]
+		if ok {
+			field = field[1:]
+		} else {
+			res = Pass
+		}
+		if !strings.HasPrefix(field, "x-ip:") {
+			return "", false
+		}
+		if field[len("x-ip:"):] == "1.1.1.1" {
+			return res, true
+		}
+		return "", true
+	}
+
+	cases := []struct {
+		txt string
+		res Result
+		err error
+	}{
+		{"v=spf1 x-ip:1.1.1.1 -all", Pass, errMatchedHandler},
+		{"v=spf1 ~x-ip:1.1.1.1 -all", SoftFail, errMatchedHandler},
+		{"v=spf1 x-ip:1.2.3.4 -all", Fail, errMatchedAll},
+		{"v=spf1 x-other -all", PermError, errUnknownField},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain",
+			WithUnsupportedHandler(handler))
+		if res != c.res || !isError(err, c.err) {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.txt, c.res, c.err, res, err)
+		}
+
+		// Without the handler, they're all unknown.
+		res, err = CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != PermError || !isError(err, errUnknownField) {
+			t.Errorf("%q: expected permerror, got %v/%v", c.txt, res, err)
+		}
+	}
+}
+
+func TestIPsOnly(t *testing.T) {
+	NewDefaultResolver()
+	trace = t.Logf
+
+	cases := []struct {
+		txt  string
+		ip   net.IP
+		fast bool
+		res  Result
+		err  error
+	}{
+		{"v=spf1 ip4:1.1.1.1 -all", ip1111, true, Pass, errMatchedIP},
+		{"v=spf1 ip4:1.1.1.1 -all", ip1110, true, Fail, errMatchedAll},
+		{"v=spf1 IP4:1.1.1.0/24 ~ALL", ip1111, true, Pass, errMatchedIP},
+		{"v=spf1 -ip6:2001:db8::/32 ip4:1.1.1.1", ip6666, true, Fail, errMatchedIP},
+		{"v=spf1 ip4:1.1.1.1 exp=x", ip1110, true, Neutral, nil},
+		{"v=spf1 ip4:1.1.1.1/33", ip1110, true, PermError, errInvalidMask},
+		{"v=spf1 ip4:1.1.1.1 +all", ip1110, false, Pass, errMatchedAll},
+		{"v=spf1 ip4:1.1.1.1 a -all", ip1111, false, Pass, errMatchedIP},
+		{"v=spf1 ip4:1.1.1.1 allx", ip1111, false, Pass, errMatchedIP},
+		{"v=spf1 - ip4:1.1.1.1", ip1111, false, PermError, errUnknownField},
+		{"v=spf1 ip4:1.1.1.1 redirect=x", ip1111, false, Pass, errMatchedIP},
+	}
+	for _, c := range cases {
+		r := newResolution(c.ip, "", nil)
+		fields, _ := r.splitFields(c.txt)
+		fast, _, _ := r.ipsOnly(fields, "domain")
+		if fast != c.fast {
+			t.Errorf("%q: expected fast path %v, got %v", c.txt, c.fast, fast)
+		}
+
+		res, err := r.checkRecord("domain", c.txt)
+		if res != c.res || !isError(err, c.err) {
+			t.Errorf("%q: expected %v/%v, got %v/%v",
+				c.txt, c.res, c.err, res, err)
+		}
+	}
+}
+
+// ipsOnlyRecord returns a record with n ip4 mechanisms, the last of which is
+// 1.1.1.1, followed by the extra terms.
+func ipsOnlyRecord(n int, extra string) string {
+	txt := "v=spf1"
+	for i := 0; i < n-1; i++ {
+		txt += fmt.Sprintf(" ip4:10.%d.0.0/16", i)
+	}
+	return txt + " ip4:1.1.1.1 " + extra
+}
+
+func BenchmarkIPsOnly(b *testing.B) {
+	trace = nullTrace
+	benchmarks := []struct {
+		name, txt string
+	}{
+		// Only ip mechanisms, evaluated by the fast path.
+		{"fast", ipsOnlyRecord(50, "-all")},
+
+		// The trailing "a" is never evaluated (the last ip4 matches), but
+		// it forces the general loop.
+		{"general", ipsOnlyRecord(50, "a -all")},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				r := newResolution(ip1111, "", nil)
+				res, _ := r.checkRecord("domain", bm.txt)
+				if res != Pass {
+					b.Fatalf("expected pass, got %v", res)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkInputHandling measures the work done on the input sender and
+// domain before the evaluation, which is only splitting and validating
+// them, compared to a whole (cached) check.
+func BenchmarkInputHandling(b *testing.B) {
+	dns := NewDefaultResolver()
+	trace = nullTrace
+	dns.txt["example.com"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+
+	b.Run("input", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, domain := split("user@example.com")
+			if !isValidDomain(domain) {
+				b.Fatalf("invalid domain %q", domain)
+			}
+		}
+	})
+	b.Run("check", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			CheckHostWithSender(ip1111, "helo", "user@example.com")
+		}
+	})
+}
+
+// regexpDomainAndMask is the regexp-based version of splitDomainAndMask, to
+// compare against.
+var regexpDomainAndMask = map[string]*regexp.Regexp{
+	"a":  regexp.MustCompile(`^[aA](:([^/]+))?(/(\w+))?(//(\w+))?$`),
+	"mx": regexp.MustCompile(`^[mM][xX](:([^/]+))?(/(\w+))?(//(\w+))?$`),
+}
+
+func TestSplitDomainAndMask(t *testing.T) {
+	fields := []string{
+		"a", "a:", "a:d", "a:d.com/24", "a:d/24//64", "a//64", "a/24//64",
+		"a/", "a//", "a///64", "a/24/", "a/24//", "a:d//", "a:/24",
+		"a/x", "a/2 4", "a:d:e/1", "a:%{d}/_1", "A:D/24",
+		"mx", "mx:d", "mx/24", "mx//128", "MX:d/1//2", "mx:d/1//2/3",
+	}
+	for _, field := range fields {
+		name := "a"
+		if strings.HasPrefix(strings.ToLower(field), "mx") {
+			name = "mx"
+		}
+
+		domain, mask4, mask6, ok := splitDomainAndMask(name, field)
+		groups := regexpDomainAndMask[name].FindStringSubmatch(field)
+		if ok != (groups != nil) {
+			t.Errorf("%q: ok %v, regexp %q", field, ok, groups)
+			continue
+		}
+		if ok && (domain != groups[2] || mask4 != groups[4] ||
+			mask6 != groups[6]) {
+			t.Errorf("%q: got %q %q %q, regexp %q",
+				field, domain, mask4, mask6, groups)
+		}
+	}
+}
+
+func TestDomainAndMask(t *testing.T) {
+	cases := []struct {
+		field  string
+		domain string
+		masks  dualMasks
+		err    error
+	}{
+		{"a", "current", dualMasks{-1, -1}, nil},
+		{"a/24", "current", dualMasks{24, -1}, nil},
+		{"a//64", "current", dualMasks{-1, 64}, nil},
+		{"a/24//64", "current", dualMasks{24, 64}, nil},
+		{"a:x", "x", dualMasks{-1, -1}, nil},
+		{"a:x/24", "x", dualMasks{24, -1}, nil},
+		{"a:x.y/24//64", "x.y", dualMasks{24, 64}, nil},
+		{"a:x/", "", dualMasks{-1, -1}, errInvalidMask},
+		{"a/", "", dualMasks{-1, -1}, errInvalidMask},
+		{"a/33", "", dualMasks{-1, -1}, errInvalidMask},
+		{"mx/24", "current", dualMasks{24, -1}, nil},
+		{"mx:x/24", "x", dualMasks{24, -1}, nil},
+	}
+	for _, c := range cases {
+		name := c.field[:strings.IndexAny(c.field+":/", ":/")]
+		domain, masks, err := domainAndMask(name, c.field, "current")
+		if domain != c.domain || masks != c.masks || err != c.err {
+			t.Errorf("%q: expected %q %v %v, got %q %v %v", c.field,
+				c.domain, c.masks, c.err, domain, masks, err)
+		}
+	}
+
+	// Check they're used as expected in the evaluation: "a/24" must
+	// look up the current domain.
+	dns := NewDefaultResolver()
+	trace = t.Logf
+	dns.ip["domain"] = []net.IP{ip1110}
+	dns.ip["x"] = []net.IP{net.ParseIP("1.1.2.1")}
+	for txt, exp := range map[string]Result{
+		"v=spf1 a/24 -all":   Pass,
+		"v=spf1 a -all":      Fail,
+		"v=spf1 a:x/16 -all": Pass,
+		"v=spf1 a:x/24 -all": Fail,
+		"v=spf1 a:x -all":    Fail,
+	} {
+		dns.txt["domain"] = []string{txt}
+		res, err := CheckHostWithSender(ip1111, "helo", "user@domain")
+		if res != exp {
+			t.Errorf("%q: expected %v, got %v (%v)", txt, exp, res, err)
+		}
+	}
+}
+
+func TestDualStackMasks(t *testing.T) {
+	// Each mask applies only to the addresses of its family, and the other
+	// family uses its default (an exact match).
+	// https://tools.ietf.org/html/rfc7208#section-5.3
+	dns := NewDefaultResolver()
+	trace = t.Logf
+	dns.ip["exact"] = []net.IP{ip1111, ip6666}
+	dns.ip["ds"] = []net.IP{ip1110, ip6660}
+	dns.mx["domain"] = []*net.MX{mx("ds", 10)}
+
+	cases := []struct {
+		ip  net.IP
+		txt string
+		res Result
+	}{
+		{ip1111, "v=spf1 a:exact -all", Pass},
+		{ip6666, "v=spf1 a:exact -all", Pass},
+
+		// v4 client.
+		{ip1111, "v=spf1 a:ds -all", Fail},
+		{ip1111, "v=spf1 a:ds/24 -all", Pass},
+		{ip1111, "v=spf1 a:ds//64 -all", Fail},
+		{ip1111, "v=spf1 a:ds/24//128 -all", Pass},
+		{ip1111, "v=spf1 mx/24 -all", Pass},
+
+		// v6 client.
+		{ip6666, "v=spf1 a:ds -all", Fail},
+		{ip6666, "v=spf1 a:ds/24 -all", Fail},
+		{ip6666, "v=spf1 a:ds//48 -all", Pass},
+		{ip6666, "v=spf1 a:ds/32//64 -all", Pass},
+		{ip6666, "v=spf1 mx//64 -all", Pass},
+
+		// A single mask is always the IPv4 one, so "/48" is not valid,
+		// even for a v6 client.
+		{ip6666, "v=spf1 a:ds/48 -all", PermError},
+	}
+	for _, c := range cases {
+		dns.txt["domain"] = []string{c.txt}
+		res, err := CheckHostWithSender(c.ip, "helo", "user@domain")
+		if res != c.res {
+			t.Errorf("%v %q: expected %v, got %v (%v)",
+				c.ip, c.txt, c.res, res, err)
+		}
+	}
+}
+
+func BenchmarkDomainAndMask(b *testing.B) {
+	trace = nullTrace
+	field := "mx:mail.example.com/24//64"
+	b.Run("regexp", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			regexpDomainAndMask["mx"].FindStringSubmatch(field)
+		}
+	})
+	b.Run("manual", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			domainAndMask("mx", field, "domain")
+		}
+	})
+}
+
+func TestMaxDepth(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// d0 includes d1, which includes d2, and so on; d5 redirects to r6,
+	// which has the ip.
+	for i := 0; i < 5; i++ {
+		dns.txt[fmt.Sprintf("d%d", i)] = []string{
+			fmt.Sprintf("v=spf1 include:d%d -all", i+1)}
+	}
+	dns.txt["d5"] = []string{"v=spf1 redirect=r6"}
+	dns.txt["r6"] = []string{"v=spf1 ip4:1.1.1.1"}
+
+	cases := []struct {
+		max    uint
+		res    Result
+		err    error
+		lookup int
+	}{
+		{0, Pass, errMatchedIP, 7},
+		{6, Pass, errMatchedIP, 7},
+		{5, PermError, errMaxDepthExceeded, 6},
+		{3, PermError, errMaxDepthExceeded, 4},
+		{1, PermError, errMaxDepthExceeded, 2},
+	}
+	for _, c := range cases {
+		dns.lookups = map[string]int{}
+		res, err := CheckHostWithSender(ip1111, "helo", "a@d0",
+			WithMaxDepth(c.max))
+		if res != c.res || err != c.err {
+			t.Errorf("max %d: expected %v/%v, got %v/%v",
+				c.max, c.res, c.err, res, err)
+		}
+		if n := dns.lookups["txt"]; n != c.lookup {
+			t.Errorf("max %d: expected %d txt lookups, got %d",
+				c.max, c.lookup, n)
+		}
+	}
+}
+
+// noAAAAResolver is a TestResolver which supports lookups by family, but
+// where the IPv6 lookups always fail, and so do the ones for both families.
+type noAAAAResolver struct {
+	*TestResolver
+}
+
+func (r noAAAAResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups["ip"]++
+	return nil, &net.DNSError{
+		Err: "server misbehaving", Name: host, IsTemporary: true}
+}
+
+func (r noAAAAResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.lookups["ip"]++
+	if network == "ip6" {
+		return nil, &net.DNSError{
+			Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+
+	ips := []net.IP{}
+	for _, ip := range r.ip[strings.TrimRight(strings.ToLower(host), ".")] {
+		if ip.To4() != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func TestEarlyAbort(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// 9 includes, each with 20 mechanisms that don't match, for a total of
+	// 9*(20+1) + 1 = 190 terms (not counting the version).
+	inc := ipsOnlyRecord(20, "")
+	txt := "v=spf1"
+	for i := 0; i < 9; i++ {
+		dns.txt[fmt.Sprintf("inc%d", i)] = []string{inc}
+		txt += fmt.Sprintf(" include:inc%d", i)
+	}
+	dns.txt["domain"] = []string{txt + " -all"}
+
+	cases := []struct {
+		max    uint
+		result Result
+		res    Result
+		err    error
+	}{
+		{0, "", Fail, errMatchedAll},
+		{190, "", Fail, errMatchedAll},
+		{189, "", PermError, errMaxTermsExceeded},
+		{50, PermError, PermError, errMaxTermsExceeded},
+		{50, TempError, TempError, errMaxTermsExceeded},
+	}
+	for _, c := range cases {
+		res, err := CheckHostWithSender(ip6666, "helo", "user@domain",
+			WithEarlyAbort(c.max, c.result))
+		if res != c.res || err != c.err {
+			t.Errorf("%d %q: expected %v/%v, got %v/%v",
+				c.max, c.result, c.res, c.err, res, err)
+		}
+	}
+}
+
+func TestLookupIPByFamily(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 a:a mx:mx -all"}
+	dns.ip["a"] = []net.IP{ip1111}
+	dns.mx["mx"] = []*net.MX{{Host: "mail"}}
+	dns.ip["mail"] = []net.IP{ip1110}
+	opt := WithResolver(noAAAAResolver{dns})
+
+	// The IPv6 lookup errors don't matter for IPv4 clients.
+	res, err := CheckHostWithSender(ip1111, "helo", "a@domain", opt)
+	if res != Pass || err != errMatchedA {
+		t.Errorf("expected pass/matched a, got %v (%v)", res, err)
+	}
+	res, err = CheckHostWithSender(ip1110, "helo", "a@domain", opt)
+	if res != Pass || err != errMatchedMX {
+		t.Errorf("expected pass/matched mx, got %v (%v)", res, err)
+	}
+
+	// But they do for IPv6 clients.
+	res, err = CheckHostWithSender(ip6666, "helo", "a@domain", opt)
+	if res != TempError {
+		t.Errorf("expected temperror, got %v (%v)", res, err)
+	}
+}
+
+// netFamilyResolver is a TestResolver which supports lookups by family, and
+// reports the errors like *net.Resolver does.
+type netFamilyResolver struct {
+	*TestResolver
+}
+
+func (r netFamilyResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.lookups["ip"]++
+	host = strings.TrimRight(strings.ToLower(host), ".")
+	if err := r.errors[host]; err != nil {
+		return nil, err
+	}
+	all, ok := r.ip[host]
+	if !ok {
+		return nil, notFoundError(host)
+	}
+
+	ips := []net.IP{}
+	for _, ip := range all {
+		if (ip.To4() != nil) == (network == "ip4") {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{
+			Err: "no suitable address found", Addr: host}
+	}
+	return ips, nil
+}
+
+func TestMXByFamily(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 mx -all"}
+	dns.mx["domain"] = []*net.MX{
+		mx("v4only", 10), mx("broken", 20), mx("dual", 30)}
+	dns.ip["v4only"] = []net.IP{ip1110}
+	dns.ip["dual"] = []net.IP{ip1111, ip6666}
+	dns.errors["broken"] = &net.DNSError{Err: "refused", Name: "broken"}
+	opt := WithResolver(netFamilyResolver{dns})
+
+	// The hosts without addresses of the client's family, or that fail
+	// with a permanent error, don't stop the others from matching.
+	for _, ip := range []net.IP{ip1110, ip1111, ip6666} {
+		res, err := CheckHostWithSender(ip, "helo", "a@domain", opt)
+		if res != Pass || err != errMatchedMX {
+			t.Errorf("%v: expected pass/matched mx, got %v (%v)",
+				ip, res, err)
+		}
+	}
+	res, err := CheckHostWithSender(ip6660, "helo", "a@domain", opt)
+	if res != Fail || err != errMatchedAll {
+		t.Errorf("expected fail/matched all, got %v (%v)", res, err)
+	}
+}
+
+func TestCheckManyByFamily(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["domain"] = []string{"v=spf1 a:a mx:mx -all"}
+	dns.ip["a"] = []net.IP{ip1111}
+	dns.mx["mx"] = []*net.MX{{Host: "mail"}}
+	dns.ip["mail"] = []net.IP{ip1110}
+
+	// The cache keeps looking up only the family of each ip, so the IPv6
+	// lookup errors don't matter for the IPv4 clients.
+	ips := []net.IP{ip1111, ip1110, net.ParseIP("1.1.1.2")}
+	res := CheckMany(ips, "domain", WithResolver(noAAAAResolver{dns}))
+	expected := []Result{Pass, Pass, Fail}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("%v: expected %v, got %v", ips[i], expected[i], res[i])
+		}
+	}
+
+	// Each address lookup was done only once.
+	if dns.lookups["ip"] != 2 {
+		t.Errorf("unexpected number of lookups: %v", dns.lookups)
+	}
+}
+
+func TestMixedNotationIP6(t *testing.T) {
+	NewDefaultResolver()
+	trace = t.Logf
+
+	cases := []struct {
+		txt string
+		ip  string
+		res Result
+	}{
+		// IPv4-mapped addresses are IPv4, so they never match ip6, even if
+		// written in the mixed notation.
+		{"v=spf1 ip6:::ffff:192.0.2.0/120", "192.0.2.5", Neutral},
+		{"v=spf1 ip6:::ffff:192.0.2.0/120", "::ffff:192.0.2.5", Neutral},
+		{"v=spf1 ip6:::ffff:192.0.2.0/120", "2001:db8::5", Neutral},
+		{"v=spf1 ip6:::ffff:192.0.2.1", "192.0.2.1", Neutral},
+		{"v=spf1 ip6:::/0", "::ffff:192.0.2.1", Neutral},
+		{"v=spf1 ip6:::/0", "2001:db8::5", Pass},
+
+		// But they do match ip4.
+		{"v=spf1 ip4:192.0.2.0/24", "::ffff:192.0.2.5", Pass},
+		{"v=spf1 ip4:192.0.2.1", "::ffff:192.0.2.1", Pass},
+		{"v=spf1 ip4:0.0.0.0/0", "2001:db8::5", Neutral},
+
+		// IPv4-compatible addresses (deprecated) are IPv6.
+		{"v=spf1 ip6:::192.0.2.0/120", "::192.0.2.5", Pass},
+		{"v=spf1 ip6:::192.0.2.0/120", "192.0.2.5", Neutral},
+		{"v=spf1 ip6:::192.0.2.5", "::192.0.2.5", Pass},
+	}
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		res, _, err := CheckRecord(ip, c.txt, "helo", "a@domain")
+		if res != c.res {
+			t.Errorf("%q %v: expected %v, got %v (%v)",
+				c.txt, c.ip, c.res, res, err)
+		}
+
+		res, ok := EvaluateStatic(ip, c.txt)
+		if res != c.res || !ok {
+			t.Errorf("%q %v static: expected %v, got %v/%v",
+				c.txt, c.ip, c.res, res, ok)
+		}
+	}
+}
+
+func TestDomainFallback(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	dns.txt["example.com"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	dns.txt["temp.com"] = []string{"v=spf1 ip4:1.1.1.1 -all"}
+	dns.errors["sub.temp.com"] = &net.DNSError{
+		Err: "temp", IsTemporary: true}
+
+	cases := []struct {
+		ip       net.IP
+		sender   string
+		res      Result
+		identity string
+	}{
+		// The exact domain has no record, but the parent does.
+		{ip1111, "a@sub.example.com", Pass, "example.com"},
+		{ip1110, "a@sub.example.com", Fail, ""},
+
+		// Results other than None are not replaced.
+		{ip1111, "a@sub.temp.com", TempError, ""},
+
+		// Neither has a record.
+		{ip1111, "a@sub.nothing.com", None, ""},
+	}
+	for _, c := range cases {
+		_, domain := split(c.sender)
+		res, details, err := CheckHostDetailed(c.ip, "helo", c.sender,
+			WithDomainFallback("in..valid", parentDomain(domain)))
+		if res != c.res || details.Identity != c.identity {
+			t.Errorf("%v %q: expected %v/%q, got %v/%q (%v)",
+				c.ip, c.sender, c.res, c.identity, res,
+				details.Identity, err)
+		}
+	}
+
+	// Without the option, there's no fallback.
+	res, err := CheckHostWithSender(ip1111, "helo", "a@sub.example.com")
+	if res != None {
+		t.Errorf("expected none, got %v (%v)", res, err)
+	}
+}
+
+func parentDomain(domain string) string {
+	return domain[strings.Index(domain, ".")+1:]
+}
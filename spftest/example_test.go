@@ -0,0 +1,26 @@
+package spftest_test
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/yeo/spf"
+	"github.com/yeo/spf/spftest"
+)
+
+func Example() {
+	zone := spf.Zone{}.
+		TXT("example.com", "v=spf1 mx include:_spf.example.net -all").
+		MX("example.com", "mail.example.com").
+		A("mail.example.com", "192.0.2.1")
+	r := spftest.NewResolver(zone).TempError("_spf.example.net")
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		res, err := spf.CheckHostWithSender(net.ParseIP(ip),
+			"mail.example.com", "user@example.com", spf.WithResolver(r))
+		fmt.Println(ip, res, err)
+	}
+	// Output:
+	// 192.0.2.1 pass matched 'mx'
+	// 192.0.2.2 temperror lookup _spf.example.net: temporary error
+}
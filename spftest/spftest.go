@@ -0,0 +1,137 @@
+// Package spftest provides an in-memory DNS resolver, to test code that
+// does SPF checks without using real DNS.
+//
+// The DNS data is given as an spf.Zone, and the resolver adds error
+// injection and query counting on top of it. It is given to the checks with
+// spf.WithResolver:
+//
+//	zone := spf.Zone{}.
+//		TXT("example.com", "v=spf1 mx -all").
+//		MX("example.com", "mail.example.com").
+//		A("mail.example.com", "192.0.2.1")
+//	r := spftest.NewResolver(zone).
+//		TempError("flaky.example.com")
+//
+//	res, err := spf.CheckHostWithSender(ip, helo, sender,
+//		spf.WithResolver(r))
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+package spftest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/yeo/spf"
+)
+
+// Resolver is an in-memory DNS resolver, which implements spf.DNSResolver.
+// It answers queries from a zone (see spf.NewZoneResolver), unless an error
+// was set for the name.
+//
+// It is safe for concurrent use, including setting errors while it's in
+// use.
+type Resolver struct {
+	zone spf.DNSResolver
+
+	mu     sync.Mutex
+	errors map[string]error
+
+	// Number of queries done for each name, see Queries.
+	queries map[string]int
+}
+
+// NewResolver returns a new Resolver, which answers queries from the given
+// zone. The zone is copied, so later changes to it are not visible to the
+// resolver.
+func NewResolver(zone spf.Zone) *Resolver {
+	return &Resolver{
+		zone:    spf.NewZoneResolver(zone),
+		errors:  map[string]error{},
+		queries: map[string]int{},
+	}
+}
+
+// normName normalizes the name (or ip, for reverse lookups), so it can be
+// used as a key.
+func normName(name string) string {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// TempError makes all queries for the name (or ip, for reverse lookups)
+// fail with a temporary error, like a SERVFAIL or a timeout would. The
+// checks result in TempError when they need it.
+func (r *Resolver) TempError(name string) *Resolver {
+	return r.Error(name, &net.DNSError{
+		Err: "temporary error", Name: name, IsTemporary: true})
+}
+
+// PermError makes all queries for the name (or ip, for reverse lookups)
+// fail with a permanent error which is not a "not found" one, like a
+// REFUSED would.
+func (r *Resolver) PermError(name string) *Resolver {
+	return r.Error(name, &net.DNSError{Err: "permanent error", Name: name})
+}
+
+// Error makes all queries for the name (or ip, for reverse lookups) fail
+// with the given error, and returns the resolver. The spf package expects
+// errors to be *net.DNSError.
+func (r *Resolver) Error(name string, err error) *Resolver {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors[normName(name)] = err
+	return r
+}
+
+// Queries returns the number of queries (of any type) done for the name.
+func (r *Resolver) Queries(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries[normName(name)]
+}
+
+// lookup counts the query, and returns the error set for the name, if any.
+func (r *Resolver) lookup(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = normName(name)
+	r.queries[name]++
+	return r.errors[name]
+}
+
+// LookupTXT implements spf.DNSResolver.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := r.lookup(name); err != nil {
+		return nil, err
+	}
+	return r.zone.LookupTXT(ctx, name)
+}
+
+// LookupMX implements spf.DNSResolver.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if err := r.lookup(name); err != nil {
+		return nil, err
+	}
+	return r.zone.LookupMX(ctx, name)
+}
+
+// LookupIPAddr implements spf.DNSResolver.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if err := r.lookup(host); err != nil {
+		return nil, err
+	}
+	return r.zone.LookupIPAddr(ctx, host)
+}
+
+// LookupAddr implements spf.DNSResolver.
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := r.lookup(addr); err != nil {
+		return nil, err
+	}
+	return r.zone.LookupAddr(ctx, addr)
+}
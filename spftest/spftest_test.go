@@ -0,0 +1,75 @@
+package spftest_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/yeo/spf"
+	"github.com/yeo/spf/spftest"
+)
+
+func TestResolver(t *testing.T) {
+	zone := spf.Zone{}.
+		TXT("Domain.", "v=spf1 mx ptr:ptr.domain include:tmp ~all").
+		MX("domain", "mx1.domain", "mx2.domain").
+		A("mx1.domain", "192.0.2.1").
+		AAAA("mx2.domain", "2001:db8::1").
+		PTR("192.0.2.5", "host.ptr.domain.").
+		A("host.ptr.domain", "192.0.2.5").
+		TXT("perm", "v=spf1 include:broken -all").
+		TXT("broken", "v=spf1 +all")
+	r := spftest.NewResolver(zone).
+		TempError("tmp").
+		PermError("Broken.")
+	opt := spf.WithResolver(r)
+
+	cases := []struct {
+		ip  string
+		res spf.Result
+	}{
+		{"192.0.2.1", spf.Pass},
+		{"2001:db8::1", spf.Pass},
+		{"192.0.2.5", spf.Pass},
+		{"192.0.2.9", spf.TempError},
+	}
+	for _, c := range cases {
+		res, err := spf.CheckHostWithSender(net.ParseIP(c.ip), "helo",
+			"user@domain", opt)
+		if res != c.res {
+			t.Errorf("%s: expected %v, got %v (%v)", c.ip, c.res, res, err)
+		}
+	}
+
+	// Names without data don't exist; permanent errors in includes are
+	// PermError.
+	for sender, exp := range map[string]spf.Result{
+		"user@nothere": spf.None,
+		"user@perm":    spf.PermError,
+	} {
+		res, err := spf.CheckHostWithSender(net.ParseIP("192.0.2.1"),
+			"helo", sender, opt)
+		if res != exp {
+			t.Errorf("%s: expected %v, got %v (%v)", sender, exp, res, err)
+		}
+	}
+
+	if n := r.Queries("DOMAIN"); n != 4*2 {
+		t.Errorf("expected 8 queries for domain, got %d", n)
+	}
+}
+
+func TestErrorsByIP(t *testing.T) {
+	zone := spf.Zone{}.
+		TXT("domain", "v=spf1 ptr -all").
+		PTR("2001:db8::1", "domain")
+	r := spftest.NewResolver(zone).TempError("2001:DB8:0::1")
+
+	res, err := spf.CheckHostWithSender(net.ParseIP("2001:db8::1"),
+		"helo", "user@domain", spf.WithResolver(r))
+	if res != spf.TempError {
+		t.Errorf("expected temperror, got %v (%v)", res, err)
+	}
+	if n := r.Queries("2001:db8::1"); n != 1 {
+		t.Errorf("expected 1 query for the ip, got %d", n)
+	}
+}
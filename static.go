@@ -0,0 +1,124 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+var errNoDNS = fmt.Errorf("DNS queries are not allowed")
+
+// EvaluateStatic evaluates the given SPF record for the ip, without doing
+// any DNS queries. This is useful as a fast path for records that only
+// contain ip4, ip6 and all mechanisms (like flattened records).
+//
+// The returned bool indicates whether the evaluation could be completed.
+// If it is false, the record needs DNS queries to be evaluated (for
+// example, it has include or mx mechanisms that had to be checked), and the
+// caller should use CheckHostWithSender instead.
+//
+// The record is evaluated as CheckHost would, so when the evaluation is
+// completed, the result is the same as if the record was published.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func EvaluateStatic(ip net.IP, record string) (Result, bool) {
+	resolver := &noDNSResolver{}
+	r := newResolution(ip, "postmaster@domain",
+		[]Option{WithResolver(resolver)})
+	if err := r.validIP(); err != nil {
+		return None, true
+	}
+	if !isSPFRecord(record) {
+		trace("static: %v", errInvalidVersion)
+		return PermError, true
+	}
+
+	r.count++
+	res, err := r.checkRecord("domain", record)
+	if resolver.queried {
+		trace("static: needs DNS")
+		return "", false
+	}
+	trace("static: %v %v", res, err)
+	return res, true
+}
+
+// noDNSResolver is a DNSResolver that fails all queries, and remembers if
+// any was attempted. See EvaluateStatic.
+type noDNSResolver struct {
+	queried bool
+}
+
+func (n *noDNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	n.queried = true
+	return nil, errNoDNS
+}
+
+func (n *noDNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	n.queried = true
+	return nil, errNoDNS
+}
+
+func (n *noDNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	n.queried = true
+	return nil, errNoDNS
+}
+
+func (n *noDNSResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	n.queried = true
+	return nil, errNoDNS
+}
+
+// IsDenyAll returns true if the given SPF record doesn't authorize any
+// senders: it has no mechanisms that result in Pass, and ends in "-all" or
+// "~all". This usually indicates a domain that doesn't send mail (like a
+// parked domain). No DNS queries are done.
+//
+// It returns false if the record is not valid, or if the policy can't be
+// determined statically because it depends on a redirect.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func IsDenyAll(record string) bool {
+	rec, err := Parse(record)
+	if err != nil {
+		return false
+	}
+
+	for _, m := range rec.Mechanisms {
+		if m.Name == "all" {
+			// Anything after "all" is not evaluated, including redirect.
+			return m.Qualifier == Fail || m.Qualifier == SoftFail
+		}
+		if m.Qualifier == Pass {
+			return false
+		}
+	}
+
+	// No "all": either the result is Neutral, or it is given by a redirect.
+	return false
+}
+
+// ipNet returns the network of an ip4 or ip6 mechanism. If no prefix length
+// was given, the network contains only the given address.
+func (m Mechanism) ipNet() *net.IPNet {
+	ip := net.ParseIP(m.Value)
+	if m.Name == "ip4" {
+		mask := m.Mask4
+		if mask < 0 {
+			mask = 32
+		}
+		return &net.IPNet{
+			IP:   ip.To4().Mask(net.CIDRMask(mask, 32)),
+			Mask: net.CIDRMask(mask, 32),
+		}
+	}
+
+	mask := m.Mask6
+	if mask < 0 {
+		mask = 128
+	}
+	return &net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(mask, 128)),
+		Mask: net.CIDRMask(mask, 128),
+	}
+}
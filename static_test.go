@@ -0,0 +1,94 @@
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEvaluateStatic(t *testing.T) {
+	trace = t.Logf
+	cases := []struct {
+		ip     net.IP
+		record string
+		res    Result
+		ok     bool
+	}{
+		// Records with only ip mechanisms.
+		{ip1111, "v=spf1 ip4:1.1.1.1 -all", Pass, true},
+		{ip1110, "v=spf1 ip4:1.1.1.1 -all", Fail, true},
+		{ip1110, "v=spf1 ~ip4:1.1.1.1/24 -all", SoftFail, true},
+		{ip6666, "v=spf1 ip4:1.1.1.1/24 ip6:2001:db8::/32 -all", Pass, true},
+		{ip6660, "v=spf1 ip6:2001:db8::68", Neutral, true},
+		{ip1111, "v=spf1", Neutral, true},
+		{ip1111, "v=spf1 ip4:1.1.1.1/99", PermError, true},
+
+		// Records that need DNS, unless there's an early match.
+		{ip1111, "v=spf1 ip4:1.1.1.1 include:domain -all", Pass, true},
+		{ip1110, "v=spf1 ip4:1.1.1.1 include:domain -all", "", false},
+		{ip1110, "v=spf1 a -all", "", false},
+		{ip1110, "v=spf1 ip4:1.1.1.1 redirect=domain", "", false},
+	}
+
+	for _, c := range cases {
+		res, ok := EvaluateStatic(c.ip, c.record)
+		if res != c.res || ok != c.ok {
+			t.Errorf("%v %q: expected %v/%v, got %v/%v",
+				c.ip, c.record, c.res, c.ok, res, ok)
+		}
+	}
+}
+
+func TestIsDenyAll(t *testing.T) {
+	cases := []struct {
+		record string
+		deny   bool
+	}{
+		{"v=spf1 -all", true},
+		{"v=spf1 ~all", true},
+		{"v=spf1 -ALL", true},
+		{"v=spf1 exp=explain._spf.%{d} -all", true},
+		{"v=spf1 -ip4:1.1.1.1 ?a -all", true},
+		{"v=spf1 -all redirect=domain", true},
+		{"v=spf1 ?all", false},
+		{"v=spf1 +all", false},
+		{"v=spf1", false},
+		{"v=spf1 ip4:1.1.1.1 -all", false},
+		{"v=spf1 include:domain ~all", false},
+		{"v=spf1 redirect=domain", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if deny := IsDenyAll(c.record); deny != c.deny {
+			t.Errorf("%q: expected %v, got %v", c.record, c.deny, deny)
+		}
+	}
+}
+
+func TestEvaluateStaticSameAsCheckHost(t *testing.T) {
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// Records that Parse rejects, but that CheckHost evaluates anyway.
+	records := []string{
+		"v=spf1 ip6:1.1.1.1 -all",
+		"v=spf1 ip4:2001:db8::1 ?all",
+		"v=spf1 ip4:1.1.1.1 ip4:1.1.1.1/99 -all",
+		"v=spf1 ip4:1.1.1.1 -all exp=%{x}",
+		"v=spf1 ip4:1.1.1.1/99 -all",
+		"v=spf1 ip4:1.1.1.1 -all",
+	}
+	for _, record := range records {
+		dns.txt["domain"] = []string{record}
+		for _, ip := range []net.IP{ip1111, ip1110, ip6666} {
+			res, ok := EvaluateStatic(ip, record)
+			if !ok {
+				t.Errorf("%v %q: not evaluated", ip, record)
+				continue
+			}
+			if expected, err := CheckHost(ip, "domain"); res != expected {
+				t.Errorf("%v %q: CheckHost returned %v (%v), static %v",
+					ip, record, expected, err, res)
+			}
+		}
+	}
+}
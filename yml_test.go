@@ -26,7 +26,7 @@ var (
 type Suite struct {
 	Description string
 	Tests       map[string]Test
-	ZoneData    map[string][]Record `yaml:"zonedata"`
+	ZoneData    map[string][]ZoneRecord `yaml:"zonedata"`
 }
 
 type Test struct {
@@ -42,7 +42,7 @@ type Test struct {
 }
 
 // Only one of these will be set.
-type Record struct {
+type ZoneRecord struct {
 	A        stringSlice `yaml:"A"`
 	AAAA     stringSlice `yaml:"AAAA"`
 	MX       *MX         `yaml:"MX"`
@@ -54,7 +54,7 @@ type Record struct {
 	SERVFAIL bool        `yaml:"SERVFAIL"`
 }
 
-func (r Record) String() string {
+func (r ZoneRecord) String() string {
 	if len(r.A) > 0 {
 		return fmt.Sprintf("A: %v", r.A)
 	}
@@ -0,0 +1,174 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// ZoneData holds the DNS answers for a single name, see WithStubZone.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type ZoneData struct {
+	TXT  []string
+	MX   []*net.MX
+	A    []net.IP
+	AAAA []net.IP
+
+	// Names for the reverse lookup. Only used when the zone entry is for an
+	// IP address (like "192.0.2.1"), instead of a domain.
+	PTR []string
+}
+
+// Zone is a set of DNS answers, indexed by name, to be used with
+// WithStubZone. Names are case-insensitive, and the trailing "." is
+// optional.
+//
+// It has methods to build it fluently, for example:
+//
+//	zone := spf.Zone{}.
+//		TXT("example.com", "v=spf1 mx -all").
+//		MX("example.com", "mail.example.com").
+//		A("mail.example.com", "192.0.2.1")
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+type Zone map[string]ZoneData
+
+func (z Zone) update(name string, f func(d *ZoneData)) Zone {
+	name = zoneName(name)
+	d := z[name]
+	f(&d)
+	z[name] = d
+	return z
+}
+
+// TXT adds TXT records for the name, and returns the zone.
+func (z Zone) TXT(name string, txts ...string) Zone {
+	return z.update(name, func(d *ZoneData) {
+		d.TXT = append(d.TXT, txts...)
+	})
+}
+
+// MX adds MX records for the name (with increasing preferences, in the
+// given order), and returns the zone.
+func (z Zone) MX(name string, hosts ...string) Zone {
+	return z.update(name, func(d *ZoneData) {
+		for _, host := range hosts {
+			d.MX = append(d.MX,
+				&net.MX{Host: host, Pref: uint16(10 * (len(d.MX) + 1))})
+		}
+	})
+}
+
+// A adds A records for the name, and returns the zone. It panics if any of
+// the addresses is not a valid IPv4 address.
+func (z Zone) A(name string, ips ...string) Zone {
+	return z.update(name, func(d *ZoneData) {
+		for _, s := range ips {
+			ip := net.ParseIP(s).To4()
+			if ip == nil {
+				panic("spf: invalid IPv4 address " + s)
+			}
+			d.A = append(d.A, ip)
+		}
+	})
+}
+
+// AAAA adds AAAA records for the name, and returns the zone. It panics if
+// any of the addresses is not a valid IPv6 address.
+func (z Zone) AAAA(name string, ips ...string) Zone {
+	return z.update(name, func(d *ZoneData) {
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil || ip.To4() != nil {
+				panic("spf: invalid IPv6 address " + s)
+			}
+			d.AAAA = append(d.AAAA, ip)
+		}
+	})
+}
+
+// PTR adds names for the reverse lookup of the ip, and returns the zone.
+// It panics if the ip is not valid.
+func (z Zone) PTR(ip string, names ...string) Zone {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		panic("spf: invalid IP address " + ip)
+	}
+	return z.update(pip.String(), func(d *ZoneData) {
+		d.PTR = append(d.PTR, names...)
+	})
+}
+
+// WithStubZone is an option to resolve DNS queries using the given
+// in-memory zone, instead of querying DNS. Names not in the zone don't
+// exist.
+//
+// This is useful to test complex scenarios fully offline.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func WithStubZone(zone map[string]ZoneData) Option {
+	return func(r *resolution) {
+		r.resolver = NewZoneResolver(zone)
+	}
+}
+
+// NewZoneResolver returns a DNSResolver that answers queries using the given
+// in-memory zone, like WithStubZone does. It can be wrapped by other
+// resolvers, for example to inject errors (see the spftest package).
+//
+// The zone is copied, so later changes to it are not visible to the
+// resolver.
+//
+// This is EXPERIMENTAL for now, and the API is subject to change.
+func NewZoneResolver(zone map[string]ZoneData) DNSResolver {
+	z := Zone{}
+	for name, d := range zone {
+		z[zoneName(name)] = d
+	}
+	return stubResolver{z}
+}
+
+func zoneName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// stubResolver is a DNSResolver that answers from a Zone.
+type stubResolver struct {
+	zone Zone
+}
+
+func (s stubResolver) get(name string) (ZoneData, error) {
+	d, ok := s.zone[zoneName(name)]
+	if !ok {
+		return d, notFoundError(name)
+	}
+	return d, nil
+}
+
+func (s stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	d, err := s.get(name)
+	return d.TXT, err
+}
+
+func (s stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	d, err := s.get(name)
+	return d.MX, err
+}
+
+func (s stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	d, err := s.get(host)
+	addrs := []net.IPAddr{}
+	for _, ip := range append(d.A, d.AAAA...) {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, err
+}
+
+func (s stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+	d, err := s.get(addr)
+	return d.PTR, err
+}
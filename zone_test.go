@@ -0,0 +1,77 @@
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStubZone(t *testing.T) {
+	// Make sure the default resolver is not used.
+	dns := NewDefaultResolver()
+	trace = t.Logf
+
+	// A 3-level include chain.
+	zone := Zone{}.
+		TXT("example.com", "google-site-verification=x",
+			"v=spf1 include:_spf.example.com -all").
+		TXT("_spf.example.com", "v=spf1 mx include:_spf2.example.com").
+		TXT("_spf2.EXAMPLE.com.", "v=spf1 a:out.example.net ptr:example.org").
+		MX("_spf.example.com", "mail.example.com").
+		A("mail.example.com", "192.0.2.1").
+		AAAA("mail.example.com", "2001:db8::1").
+		A("out.example.net", "192.0.2.2", "192.0.2.3").
+		PTR("192.0.2.4", "srv.example.org.").
+		A("srv.example.org", "192.0.2.4")
+
+	cases := []struct {
+		ip  string
+		res Result
+		err error
+	}{
+		{"192.0.2.1", Pass, errMatchedMX},
+		{"2001:db8::1", Pass, errMatchedMX},
+		{"192.0.2.3", Pass, errMatchedA},
+		{"192.0.2.4", Pass, errMatchedPTR},
+		{"192.0.2.5", Fail, errMatchedAll},
+	}
+	for _, c := range cases {
+		res, err := CheckHostWithSender(net.ParseIP(c.ip), "helo",
+			"user@example.com", WithStubZone(zone))
+		if res != c.res || err != c.err {
+			t.Errorf("%s: expected %v/%v, got %v/%v",
+				c.ip, c.res, c.err, res, err)
+		}
+	}
+
+	// Names not in the zone don't exist.
+	res, err := CheckHostWithSender(ip1111, "helo", "user@nothere",
+		WithStubZone(zone))
+	if res != None || !isNotFound(err) {
+		t.Errorf("expected none/not found, got %v/%v", res, err)
+	}
+
+	for k, n := range dns.lookups {
+		if n != 0 {
+			t.Errorf("default resolver was used for %s", k)
+		}
+	}
+}
+
+func TestZoneBuilderPanics(t *testing.T) {
+	cases := []func(){
+		func() { Zone{}.A("x", "2001:db8::1") },
+		func() { Zone{}.AAAA("x", "192.0.2.1") },
+		func() { Zone{}.A("x", "lalala") },
+		func() { Zone{}.PTR("lalala", "x") },
+	}
+	for i, f := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%d: expected panic", i)
+				}
+			}()
+			f()
+		}()
+	}
+}